@@ -0,0 +1,294 @@
+package api
+
+// openAPIDescription is served as openapi.json
+const openAPIDescription = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Recorder Booth API",
+    "version": "1.0.0",
+    "description": "Control and status of a recorder booth. All responses are JSON, errors are {\"error\": \"message\"}. GET requests are open except for downloads, all other requests need the api token as bearer token. Without a configured token the api is read only, control requests and downloads are answered with 403. CORS allows GET from any origin, control requests and downloads only from configured origins."
+  },
+  "servers": [{"url": "/api"}],
+  "paths": {
+    "/status": {
+      "get": {
+        "summary": "Recorder state, metrics and the current session",
+        "responses": {"200": {"description": "Status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}}}
+      }
+    },
+    "/sessions": {
+      "get": {
+        "summary": "List the sessions stored locally, newest first",
+        "responses": {"200": {"description": "Sessions", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SessionInfo"}}}}}}
+      },
+      "post": {
+        "summary": "Start a new session, the current session is stopped and the recorder is started",
+        "security": [{"bearerAuth": []}],
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"type": "object", "properties": {"title": {"type": "string"}}}}}},
+        "responses": {
+          "201": {"description": "The new session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/sessions/current": {
+      "get": {
+        "summary": "The current session",
+        "responses": {
+          "200": {"description": "Session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "404": {"description": "No session running"}
+        }
+      }
+    },
+    "/sessions/current/stop": {
+      "post": {
+        "summary": "Stop the recorder and end the current session",
+        "security": [{"bearerAuth": []}],
+        "responses": {
+          "200": {"description": "The stopped session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "409": {"description": "No session running"}
+        }
+      }
+    },
+    "/sessions/current/markers": {
+      "post": {
+        "summary": "Add a marker to the current session at the time since the session was started",
+        "security": [{"bearerAuth": []}],
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"type": "object", "properties": {"label": {"type": "string"}}}}}},
+        "responses": {
+          "201": {"description": "The session", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Session"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "409": {"description": "No session running"}
+        }
+      }
+    },
+    "/sessions/{id}": {
+      "get": {
+        "summary": "A session with its files and metadata",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "Session", "content": {"application/json": {"schema": {"allOf": [{"$ref": "#/components/schemas/SessionInfo"}, {"type": "object", "properties": {"metadata": {"$ref": "#/components/schemas/Session"}}}]}}}},
+          "404": {"description": "Unknown session"}
+        }
+      }
+    },
+    "/sessions/{id}/files/{name}": {
+      "get": {
+        "summary": "Download a file of a session",
+        "security": [{"bearerAuth": []}],
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "File", "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"description": "Unknown file"}
+        }
+      }
+    },
+    "/storage": {
+      "get": {
+        "summary": "Storage handler health, upload backlog and local storage usage",
+        "responses": {"200": {"description": "Storage", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StorageStatus"}}}}}
+      }
+    },
+    "/analyzers": {
+      "get": {
+        "summary": "List the analyzers",
+        "responses": {"200": {"description": "Analyzers", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Analyzer"}}}}}}
+      }
+    },
+    "/analyzers/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "An analyzer with its parameters",
+        "responses": {
+          "200": {"description": "Analyzer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Analyzer"}}}},
+          "404": {"description": "Unknown analyzer"}
+        }
+      },
+      "delete": {
+        "summary": "Stop and remove an analyzer until the booth is restarted",
+        "security": [{"bearerAuth": []}],
+        "responses": {
+          "204": {"description": "Removed"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"description": "Unknown analyzer"}
+        }
+      }
+    },
+    "/analyzers/{name}/pause": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "post": {
+        "summary": "Pause an analyzer, it gets no audio and publishes nothing until it is resumed",
+        "security": [{"bearerAuth": []}],
+        "responses": {
+          "200": {"description": "Analyzer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Analyzer"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"description": "Unknown analyzer"}
+        }
+      }
+    },
+    "/analyzers/{name}/resume": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "post": {
+        "summary": "Resume a paused analyzer",
+        "security": [{"bearerAuth": []}],
+        "responses": {
+          "200": {"description": "Analyzer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Analyzer"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"description": "Unknown analyzer"}
+        }
+      }
+    },
+    "/analyzers/{name}/parameters": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "put": {
+        "summary": "Change parameters of an analyzer, parameters which are not given keep their value. Only the parameters listed for the analyzer can be changed.",
+        "security": [{"bearerAuth": []}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "number"}}}}},
+        "responses": {
+          "200": {"description": "Analyzer", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Analyzer"}}}},
+          "400": {"description": "Unknown parameter or value out of range"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"description": "Unknown analyzer"}
+        }
+      }
+    },
+    "/analyzers/values": {
+      "get": {
+        "summary": "The latest result of every analyzer topic, e.g. rms or pitch. NaN and infinite values are null.",
+        "responses": {"200": {"description": "Values by topic", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "object", "properties": {"time": {"type": "string", "format": "date-time"}, "value": {}}}}}}}}
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This description",
+        "responses": {"200": {"description": "OpenAPI description"}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer"}
+    },
+    "responses": {
+      "Unauthorized": {"description": "The bearer token is missing or wrong"},
+      "Forbidden": {"description": "No api token is configured"}
+    },
+    "schemas": {
+      "Status": {
+        "type": "object",
+        "properties": {
+          "recorderId": {"type": "string"},
+          "recorder": {
+            "type": "object",
+            "properties": {
+              "running": {"type": "boolean"},
+              "samplerate": {"type": "integer"},
+              "channels": {"type": "integer"},
+              "format": {"type": "string"},
+              "bufferSize": {"type": "integer"},
+              "duration": {"type": "number", "description": "Seconds recorded since the recorder was started"},
+              "bytesRead": {"type": "integer"}
+            }
+          },
+          "session": {"allOf": [{"$ref": "#/components/schemas/Session"}], "nullable": true}
+        }
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "recorderId": {"type": "string"},
+          "started": {"type": "string", "format": "date-time"},
+          "values": {"type": "object", "additionalProperties": {}},
+          "events": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "type": {"type": "string"},
+                "offset": {"type": "integer", "description": "Nanoseconds"},
+                "time": {"type": "string", "format": "date-time"},
+                "data": {}
+              }
+            }
+          }
+        }
+      },
+      "SessionInfo": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "started": {"type": "string", "format": "date-time"},
+          "title": {"type": "string"},
+          "current": {"type": "boolean"},
+          "uploaded": {"type": "boolean"},
+          "files": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "name": {"type": "string"},
+                "size": {"type": "integer"},
+                "modified": {"type": "string", "format": "date-time"}
+              }
+            }
+          }
+        }
+      },
+      "StorageStatus": {
+        "type": "object",
+        "properties": {
+          "handlers": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "handler": {"type": "string"},
+                "healthy": {"type": "boolean", "description": "False if the last event of the handler is an error. Dropped buffers count until the handler has caught up."},
+                "lastEvent": {"type": "string"},
+                "message": {"type": "string"},
+                "time": {"type": "string", "format": "date-time"},
+                "dropped": {"type": "integer"},
+                "queued": {"type": "integer"}
+              }
+            }
+          },
+          "uploadBacklog": {"type": "integer", "description": "Number of chunks which are waiting for upload or failed, summed over all sessions"},
+          "usage": {
+            "type": "object",
+            "nullable": true,
+            "properties": {
+              "used": {"type": "integer"},
+              "free": {"type": "integer"},
+              "total": {"type": "integer"},
+              "sessions": {"type": "integer"},
+              "pending": {"type": "integer"}
+            }
+          }
+        }
+      },
+      "Analyzer": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "paused": {"type": "boolean"},
+          "parameters": {"type": "object", "additionalProperties": {"type": "number"}}
+        }
+      }
+    }
+  }
+}
+`
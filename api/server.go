@@ -0,0 +1,868 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pascalhuerst/recorder-booth/audio"
+	"github.com/pascalhuerst/recorder-booth/storage"
+)
+
+// maxRequestSize limits the body of requests
+const maxRequestSize = 64 * 1024
+
+// ServerConfig wires the api to the parts of the booth it controls
+type ServerConfig struct {
+	RecorderID string
+	// SessionPath is the directory session metadata is saved in
+	SessionPath string
+	// Dirs are the local storage directories searched for session files
+	Dirs     []string
+	Recorder *audio.Recorder
+	Analyzer *audio.Analyzer
+	Results  *audio.Bus
+	Manager  *storage.Manager
+	// Tracker is optional, sessions are reported as uploaded if it is set
+	Tracker *storage.UploadTracker
+	// Token has to be sent as bearer token with every request which changes
+	// something. Without a token the api is read only.
+	Token string
+	// AllowedOrigins may send control requests from a browser, read only
+	// requests are allowed from any origin
+	AllowedOrigins []string
+}
+
+// Server is the http control and status api of the booth. All responses
+// are json, openapi.json describes the endpoints. GET requests are open,
+// all other requests need the token of the config.
+type Server struct {
+	config   ServerConfig
+	basePath string
+
+	// control serializes starting and stopping sessions
+	control sync.Mutex
+
+	mutex   sync.Mutex
+	metrics audio.Metrics
+	usage   *storage.Usage
+	values  map[audio.Topic]audio.Result
+}
+
+// RecorderStatus describes the state of the recorder
+type RecorderStatus struct {
+	Running    bool   `json:"running"`
+	Samplerate int    `json:"samplerate"`
+	Channels   int    `json:"channels"`
+	Format     string `json:"format"`
+	BufferSize int    `json:"bufferSize"`
+	// Duration is the time recorded since the recorder was started in seconds
+	Duration  float64 `json:"duration"`
+	BytesRead uint64  `json:"bytesRead"`
+}
+
+// Status is returned by the status endpoint
+type Status struct {
+	RecorderID string           `json:"recorderId"`
+	Recorder   RecorderStatus   `json:"recorder"`
+	Session    *storage.Session `json:"session"`
+}
+
+// SessionFile is a local file of a session
+type SessionFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// SessionInfo describes a session stored locally
+type SessionInfo struct {
+	ID      string    `json:"id"`
+	Started time.Time `json:"started"`
+	Title   string    `json:"title,omitempty"`
+	Current bool      `json:"current"`
+	// Uploaded is only set if uploads are tracked
+	Uploaded *bool         `json:"uploaded,omitempty"`
+	Files    []SessionFile `json:"files"`
+}
+
+// StorageStatus is returned by the storage endpoint
+type StorageStatus struct {
+	Handlers []storage.HandlerHealth `json:"handlers"`
+	// UploadBacklog is the number of chunks which are waiting for upload or
+	// failed, see UploadTracker.Backlog
+	UploadBacklog int `json:"uploadBacklog"`
+	// Usage is null until local storage has been checked once
+	Usage *storage.Usage `json:"usage"`
+}
+
+// AnalyzerValue is the latest result published on a topic
+type AnalyzerValue struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+type sessionRequest struct {
+	Title string `json:"title"`
+}
+
+type markerRequest struct {
+	Label string `json:"label"`
+}
+
+type marker struct {
+	Label string `json:"label,omitempty"`
+}
+
+// NewServer factory. basePath is the url path the server is mounted at.
+func NewServer(config ServerConfig, basePath string) *Server {
+
+	ret := &Server{
+		config:   config,
+		basePath: strings.TrimSuffix(basePath, "/") + "/",
+		values:   map[audio.Topic]audio.Result{},
+	}
+
+	if config.Results != nil {
+		go ret.collect(config.Results.Subscribe(0))
+	}
+
+	return ret
+}
+
+// SetMetrics updates the recorder metrics reported by the api
+func (s *Server) SetMetrics(m audio.Metrics) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics = m
+}
+
+// SetUsage updates the local storage usage reported by the api
+func (s *Server) SetUsage(u storage.Usage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.usage = &u
+}
+
+func (s *Server) collect(sub *audio.Subscription) {
+	for r := range sub.C() {
+		s.mutex.Lock()
+		s.values[r.Topic] = r
+		s.mutex.Unlock()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Cannot marshal response: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// readJSON decodes the request body into v, an empty body leaves v as is
+func readJSON(r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestSize))
+	if err != nil {
+		return fmt.Errorf("Cannot read request: %v", err)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("Cannot parse request: %v", err)
+	}
+	return nil
+}
+
+// isControl returns true for requests which change something
+func isControl(method string) bool {
+	return method != "GET" && method != "HEAD" && method != "OPTIONS"
+}
+
+// isDownload returns true for requests of session files, the recordings
+// are only handed out with the api token
+func (s *Server) isDownload(r *http.Request) bool {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, s.basePath), "/"), "/")
+	return len(parts) == 4 && parts[0] == "sessions" && parts[2] == "files"
+}
+
+// allowOrigin sets the CORS headers. Control requests and downloads are
+// only allowed from the configured origins.
+func (s *Server) allowOrigin(w http.ResponseWriter, r *http.Request) {
+
+	method := r.Method
+	if method == "OPTIONS" {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+
+	if !isControl(method) && !s.isDownload(r) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	for _, o := range s.config.AllowedOrigins {
+		if origin != "" && o == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			return
+		}
+	}
+}
+
+// authorized checks the bearer token of control requests
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+
+	if s.config.Token == "" {
+		writeError(w, http.StatusForbidden, "No api token is configured")
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.allowOrigin(w, r)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if (isControl(r.Method) || s.isDownload(r)) && !s.authorized(w, r) {
+		return
+	}
+
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, s.basePath), "/")
+	parts := strings.Split(p, "/")
+
+	route := func(method string, handler func(http.ResponseWriter, *http.Request)) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+
+	switch {
+	case p == "status":
+		route("GET", s.status)
+	case p == "openapi.json":
+		route("GET", s.openAPI)
+	case p == "sessions" && r.Method == "POST":
+		s.startSession(w, r)
+	case p == "sessions":
+		route("GET", s.listSessions)
+	case p == "sessions/current":
+		route("GET", s.currentSession)
+	case p == "sessions/current/stop":
+		route("POST", s.stopSession)
+	case p == "sessions/current/markers":
+		route("POST", s.addMarker)
+	case len(parts) == 2 && parts[0] == "sessions":
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.session(w, parts[1]) })
+	case len(parts) == 4 && parts[0] == "sessions" && parts[2] == "files":
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.download(w, r, parts[1], parts[3]) })
+	case p == "storage":
+		route("GET", s.storage)
+	case p == "analyzers":
+		route("GET", s.analyzers)
+	case p == "analyzers/values":
+		route("GET", s.analyzerValues)
+	case len(parts) == 2 && parts[0] == "analyzers" && r.Method == "DELETE":
+		s.removeAnalyzer(w, parts[1])
+	case len(parts) == 2 && parts[0] == "analyzers":
+		route("GET", func(w http.ResponseWriter, r *http.Request) { s.analyzer(w, parts[1]) })
+	case len(parts) == 3 && parts[0] == "analyzers" && parts[2] == "pause":
+		route("POST", func(w http.ResponseWriter, r *http.Request) { s.pauseAnalyzer(w, parts[1], true) })
+	case len(parts) == 3 && parts[0] == "analyzers" && parts[2] == "resume":
+		route("POST", func(w http.ResponseWriter, r *http.Request) { s.pauseAnalyzer(w, parts[1], false) })
+	case len(parts) == 3 && parts[0] == "analyzers" && parts[2] == "parameters":
+		route("PUT", func(w http.ResponseWriter, r *http.Request) { s.configureAnalyzer(w, r, parts[1]) })
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPIDescription))
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+
+	s.mutex.Lock()
+	metrics := s.metrics
+	s.mutex.Unlock()
+
+	config := s.config.Recorder.Config()
+
+	writeJSON(w, http.StatusOK, Status{
+		RecorderID: s.config.RecorderID,
+		Recorder: RecorderStatus{
+			Running:    s.config.Recorder.IsRunning(),
+			Samplerate: config.Samplerate,
+			Channels:   config.Channels,
+			Format:     config.Format.String(),
+			BufferSize: config.BufferSize,
+			Duration:   metrics.Duration.Seconds(),
+			BytesRead:  metrics.BytesRead,
+		},
+		Session: s.config.Manager.Session(),
+	})
+}
+
+// stop marks the session as stopped and saves it
+func (s *Server) stop(session *storage.Session) {
+	session.Set("stopped", time.Now().UTC())
+	if err := session.Save(s.config.SessionPath); err != nil {
+		fmt.Printf("Cannot save session: %v\n", err)
+	}
+}
+
+// startSession starts a new session, the current session is stopped. The
+// recorder is started if it is not running.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request) {
+
+	req := sessionRequest{}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.control.Lock()
+	defer s.control.Unlock()
+
+	// The session only begins when the recorder runs, nothing changes if
+	// it cannot be started
+	started := false
+	if !s.config.Recorder.IsRunning() {
+		if err := s.config.Recorder.Start(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		started = true
+	}
+
+	session := storage.NewSession(s.config.RecorderID)
+	if req.Title != "" {
+		session.Set("title", req.Title)
+	}
+	if err := session.Save(s.config.SessionPath); err != nil {
+		if started {
+			if stopErr := s.config.Recorder.Stop(); stopErr != nil {
+				fmt.Printf("Cannot stop recorder: %v\n", stopErr)
+			}
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if current := s.config.Manager.Session(); current != nil {
+		s.stop(current)
+	}
+	s.config.Manager.SetSession(session)
+
+	fmt.Printf("API: Started session %s\n", session.ID())
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// stopSession stops the recorder and ends the current session
+func (s *Server) stopSession(w http.ResponseWriter, r *http.Request) {
+
+	s.control.Lock()
+	defer s.control.Unlock()
+
+	session := s.config.Manager.Session()
+	if session == nil {
+		writeError(w, http.StatusConflict, "No session running")
+		return
+	}
+
+	if s.config.Recorder.IsRunning() {
+		if err := s.config.Recorder.Stop(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	s.stop(session)
+	s.config.Manager.EndSession()
+
+	fmt.Printf("API: Stopped session %s\n", session.ID())
+	writeJSON(w, http.StatusOK, session)
+}
+
+func (s *Server) currentSession(w http.ResponseWriter, r *http.Request) {
+	session := s.config.Manager.Session()
+	if session == nil {
+		writeError(w, http.StatusNotFound, "No session running")
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// addMarker adds a marker event to the current session, its offset is the
+// time since the session was started
+func (s *Server) addMarker(w http.ResponseWriter, r *http.Request) {
+
+	req := markerRequest{}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	session := s.config.Manager.Session()
+	if session == nil {
+		writeError(w, http.StatusConflict, "No session running")
+		return
+	}
+
+	session.AddEvent("marker", time.Since(session.Started()), marker{Label: req.Label})
+	if err := session.Save(s.config.SessionPath); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// sessionID extracts the session id from a file name like
+// <recorderID>_<sessionID>_... or <recorderID>_<sessionID>.ext
+func (s *Server) sessionID(fileName string) (string, bool) {
+	prefix := s.config.RecorderID + "_"
+	if !strings.HasPrefix(fileName, prefix) || strings.HasSuffix(fileName, ".tmp") {
+		return "", false
+	}
+
+	rest := fileName[len(prefix):]
+	if i := strings.IndexAny(rest, "_."); i > 0 {
+		return rest[:i], true
+	}
+	return "", false
+}
+
+// files returns the local files of all sessions by session id
+func (s *Server) files() map[string][]SessionFile {
+
+	ret := map[string][]SessionFile{}
+	seen := map[string]bool{}
+
+	for _, dir := range s.config.Dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			id, ok := s.sessionID(info.Name())
+			if !ok || info.IsDir() || seen[info.Name()] {
+				continue
+			}
+			seen[info.Name()] = true
+			ret[id] = append(ret[id], SessionFile{
+				Name:     info.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+		}
+	}
+	return ret
+}
+
+// loadSession reads the metadata of a session
+func (s *Server) loadSession(id string) (*SessionInfo, json.RawMessage, error) {
+
+	fileName := path.Join(s.config.SessionPath, fmt.Sprintf("%s_%s.json", s.config.RecorderID, id))
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := struct {
+		ID      string                 `json:"id"`
+		Started time.Time              `json:"started"`
+		Values  map[string]interface{} `json:"values"`
+	}{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, nil, fmt.Errorf("Cannot parse session metadata: %v", err)
+	}
+
+	info := &SessionInfo{
+		ID:      metadata.ID,
+		Started: metadata.Started,
+	}
+	if t, ok := metadata.Values["title"].(string); ok {
+		info.Title = t
+	}
+	if current := s.config.Manager.Session(); current != nil {
+		info.Current = current.ID() == id
+	}
+	if s.config.Tracker != nil {
+		uploaded := s.config.Tracker.IsUploaded(id)
+		info.Uploaded = &uploaded
+	}
+	return info, data, nil
+}
+
+// listSessions lists all sessions with local metadata, newest first
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+
+	infos, err := ioutil.ReadDir(s.config.SessionPath)
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Cannot read session directory: %v", err))
+		return
+	}
+
+	files := s.files()
+	ret := []*SessionInfo{}
+
+	for _, info := range infos {
+		id, ok := s.sessionID(info.Name())
+		if !ok || info.Name() != fmt.Sprintf("%s_%s.json", s.config.RecorderID, id) {
+			continue
+		}
+		session, _, err := s.loadSession(id)
+		if err != nil {
+			fmt.Printf("API: %v\n", err)
+			continue
+		}
+		session.Files = files[id]
+		if session.Files == nil {
+			session.Files = []SessionFile{}
+		}
+		ret = append(ret, session)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.After(ret[j].Started)
+	})
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// session returns the metadata of a session together with its files
+func (s *Server) session(w http.ResponseWriter, id string) {
+
+	info, metadata, err := s.loadSession(id)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "Unknown session")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	info.Files = s.files()[id]
+	if info.Files == nil {
+		info.Files = []SessionFile{}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		*SessionInfo
+		Metadata json.RawMessage `json:"metadata"`
+	}{info, metadata})
+}
+
+// download serves a file of a session as attachment
+func (s *Server) download(w http.ResponseWriter, r *http.Request, id, name string) {
+
+	if fileID, ok := s.sessionID(name); !ok || fileID != id || path.Base(name) != name {
+		writeError(w, http.StatusNotFound, "Unknown file")
+		return
+	}
+
+	for _, dir := range s.config.Dirs {
+		f, err := os.Open(path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "Unknown file")
+}
+
+func (s *Server) storage(w http.ResponseWriter, r *http.Request) {
+
+	s.mutex.Lock()
+	usage := s.usage
+	s.mutex.Unlock()
+
+	ret := StorageStatus{
+		Handlers: s.config.Manager.Health(),
+		Usage:    usage,
+	}
+	if s.config.Tracker != nil {
+		ret.UploadBacklog = s.config.Tracker.Backlog()
+	}
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (s *Server) analyzers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.config.Analyzer.List())
+}
+
+// findAnalyzer returns the analyzer with the given name
+func (s *Server) findAnalyzer(name string) (audio.AnalyzerInfo, bool) {
+	for _, info := range s.config.Analyzer.List() {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return audio.AnalyzerInfo{}, false
+}
+
+func (s *Server) analyzer(w http.ResponseWriter, name string) {
+	info, ok := s.findAnalyzer(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown analyzer")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// pauseAnalyzer pauses or resumes an analyzer, a paused analyzer gets no
+// audio and publishes nothing
+func (s *Server) pauseAnalyzer(w http.ResponseWriter, name string, paused bool) {
+
+	if _, ok := s.findAnalyzer(name); !ok {
+		writeError(w, http.StatusNotFound, "Unknown analyzer")
+		return
+	}
+	if err := s.config.Analyzer.SetPaused(name, paused); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	fmt.Printf("API: Analyzer %s paused: %v\n", name, paused)
+	s.analyzer(w, name)
+}
+
+// removeAnalyzer stops an analyzer and removes it until the next start
+func (s *Server) removeAnalyzer(w http.ResponseWriter, name string) {
+
+	if err := s.config.Analyzer.Remove(name); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	fmt.Printf("API: Removed analyzer %s\n", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// configureAnalyzer changes parameters of an analyzer, parameters which
+// are not given keep their value
+func (s *Server) configureAnalyzer(w http.ResponseWriter, r *http.Request, name string) {
+
+	params := map[string]float64{}
+	if err := readJSON(r, &params); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, ok := s.findAnalyzer(name); !ok {
+		writeError(w, http.StatusNotFound, "Unknown analyzer")
+		return
+	}
+	if err := s.config.Analyzer.Configure(name, params); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fmt.Printf("API: Configured analyzer %s: %v\n", name, params)
+	s.analyzer(w, name)
+}
+
+// analyzerValues returns the latest result of every topic
+func (s *Server) analyzerValues(w http.ResponseWriter, r *http.Request) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := map[audio.Topic]AnalyzerValue{}
+	for topic, result := range s.values {
+		ret[topic] = AnalyzerValue{
+			Time:  result.Time,
+			Value: jsonValue(reflect.ValueOf(result.Value)),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// jsonValue converts v into something encoding/json accepts: NaN and
+// infinite floats, e.g. the level of digital silence in dB, become null
+func jsonValue(v reflect.Value) interface{} {
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		return f
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return jsonValue(v.Elem())
+
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) && v.CanInterface() {
+			return v.Interface()
+		}
+		ret := map[string]interface{}{}
+		jsonFields(v, ret)
+		return ret
+
+	case reflect.Array, reflect.Slice:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		ret := make([]interface{}, v.Len())
+		for i := range ret {
+			ret[i] = jsonValue(v.Index(i))
+		}
+		return ret
+
+	case reflect.Map:
+		ret := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			ret[fmt.Sprint(k)] = jsonValue(v.MapIndex(k))
+		}
+		return ret
+	}
+
+	if v.CanInterface() {
+		return v.Interface()
+	}
+
+	// Fields promoted from an embedded unexported struct
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+	case reflect.String:
+		return v.String()
+	}
+	return nil
+}
+
+// jsonFields adds the exported fields of the struct v to ret like
+// encoding/json does: named by their json tag, without "-" and empty
+// omitempty fields, the fields of embedded structs are promoted
+func jsonFields(v reflect.Value, ret map[string]interface{}) {
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+
+		// Embedded structs are promoted even if their type is unexported
+		field := v.Field(i)
+		if f.Anonymous && tag[0] == "" {
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					continue
+				}
+				field = field.Elem()
+			}
+			if field.Kind() == reflect.Struct {
+				jsonFields(field, ret)
+				continue
+			}
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		omitEmpty := false
+		for _, option := range tag[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+		if omitEmpty && isEmptyJSONValue(field) {
+			continue
+		}
+
+		ret[name] = jsonValue(field)
+	}
+}
+
+// isEmptyJSONValue reports if omitempty leaves v out
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// GainChange is emitted by the AGC whenever its gain moved noticeably
+type GainChange struct {
+	Offset time.Duration
+	GainDB float64
+}
+
+func (g *GainChange) String() string {
+	return fmt.Sprintf("AGC gain %+.1f dB at %v", g.GainDB, g.Offset.Round(time.Millisecond))
+}
+
+// AGCConfig holds the parameters of the automatic gain control
+type AGCConfig struct {
+	// TargetDB is the rms level in dBFS the AGC aims for
+	TargetDB float64
+	// MaxGainDB is the maximum gain the AGC will apply
+	MaxGainDB float64
+	// GateDB is the rms level in dBFS below which the gain is frozen, so
+	// silence is not amplified
+	GateDB float64
+	// Window is the integration time of the level measurement
+	Window time.Duration
+	// MaxSlope is the maximum gain change in dB per second
+	MaxSlope float64
+	// ReportStep is the gain change in dB after which a GainChange is emitted
+	ReportStep float64
+}
+
+// DefaultAGCConfig returns a slow AGC suitable for unattended recordings
+func DefaultAGCConfig() AGCConfig {
+	return AGCConfig{
+		TargetDB:   -20,
+		MaxGainDB:  20,
+		GateDB:     -50,
+		Window:     time.Second * 3,
+		MaxSlope:   1,
+		ReportStep: 0.5,
+	}
+}
+
+// AGC slowly adjusts the gain of both channels towards a target loudness
+type AGC struct {
+	config     AGCConfig
+	samplerate int
+	output     chan GainChange
+
+	meanSquare   float64
+	gainDB       float64
+	reportedDB   float64
+	framesPassed int64
+}
+
+// NewAGC factory. Gain changes are sent to output if it is not nil. Sending
+// never blocks the processing chain, changes are dropped if nobody listens.
+func NewAGC(samplerate int, config AGCConfig, output chan GainChange) *AGC {
+	return &AGC{
+		config:     config,
+		samplerate: samplerate,
+		output:     output,
+	}
+}
+
+func (a *AGC) setPosition(position int64) {
+	a.framesPassed = position
+}
+
+func (a *AGC) process(frames []Frame) []Frame {
+
+	nFrames := len(frames)
+	if nFrames == 0 || a.samplerate <= 0 {
+		return frames
+	}
+
+	sum := 0.0
+	for _, frame := range frames {
+		l := float64(frame.Left) / math.MaxInt16
+		r := float64(frame.Right) / math.MaxInt16
+		sum += (l*l + r*r) / 2
+	}
+
+	bufferDuration := float64(nFrames) / float64(a.samplerate)
+	coefficient := math.Exp(-bufferDuration / a.config.Window.Seconds())
+	a.meanSquare = coefficient*a.meanSquare + (1-coefficient)*sum/float64(nFrames)
+
+	levelDB := 10 * math.Log10(a.meanSquare)
+	if levelDB > a.config.GateDB {
+		desired := math.Min(a.config.TargetDB-levelDB, a.config.MaxGainDB)
+		step := a.config.MaxSlope * bufferDuration
+		a.gainDB += math.Max(-step, math.Min(step, desired-a.gainDB))
+	}
+
+	a.framesPassed += int64(nFrames)
+
+	if math.Abs(a.gainDB-a.reportedDB) >= a.config.ReportStep {
+		if a.output == nil {
+			a.reportedDB = a.gainDB
+		} else {
+			change := GainChange{
+				Offset: time.Duration(a.framesPassed) * time.Second / time.Duration(a.samplerate),
+				GainDB: a.gainDB,
+			}
+			// A dropped change is reported again with the next buffer
+			select {
+			case a.output <- change:
+				a.reportedDB = a.gainDB
+			default:
+			}
+		}
+	}
+
+	gain := dbToLinear(a.gainDB)
+	ret := make([]Frame, nFrames)
+	for i, frame := range frames {
+		ret[i] = Frame{
+			Left:  clip16(float64(frame.Left) * gain),
+			Right: clip16(float64(frame.Right) * gain),
+		}
+	}
+
+	return ret
+}
@@ -3,13 +3,18 @@ package audio
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 // Analyzer can analyze frames for clipping, rms, ...
 type Analyzer struct {
 	frameStream chan []Frame
 	mutex       sync.Mutex
-	analyzers   []AnalyzerInterface
+	analyzers   []*analyzerEntry
+	// position is the number of frames since the last reset
+	position int64
+	// generation counts resets, so entries notice them in stream order
+	generation int
 }
 
 // AnalyzerInterface used to add analyzers
@@ -17,6 +22,88 @@ type AnalyzerInterface interface {
 	process([]Frame)
 }
 
+// configurable is implemented by analyzers which can be retuned at runtime
+type configurable interface {
+	parameters() map[string]float64
+	configure(map[string]float64) error
+}
+
+// positioned is implemented by analyzers and processor stages which report
+// offsets. setPosition is called before every buffer with the position of
+// its first frame since the session started, which also accounts for
+// buffers dropped or skipped while paused.
+type positioned interface {
+	setPosition(int64)
+}
+
+// resetter is implemented by analyzers which keep per session state
+type resetter interface {
+	Reset()
+}
+
+// AnalyzerInfo describes an analyzer
+type AnalyzerInfo struct {
+	Name       string             `json:"name"`
+	Paused     bool               `json:"paused"`
+	Parameters map[string]float64 `json:"parameters,omitempty"`
+}
+
+type analyzerEntry struct {
+	name       string
+	analyzer   AnalyzerInterface
+	paused     uint32
+	input      chan analyzerItem
+	dropped    int
+	generation int
+}
+
+// analyzerItem is a buffer with its position in the session
+type analyzerItem struct {
+	frames     []Frame
+	position   int64
+	generation int
+}
+
+// analyzerQueueSize is the number of buffers an analyzer may lag behind
+// before buffers are dropped for it
+const analyzerQueueSize = 16
+
+func newAnalyzerEntry(name string, ai AnalyzerInterface, generation int) *analyzerEntry {
+	ret := &analyzerEntry{
+		name:       name,
+		analyzer:   ai,
+		input:      make(chan analyzerItem, analyzerQueueSize),
+		generation: generation,
+	}
+	go ret.run()
+	return ret
+}
+
+// run feeds the analyzer in order, so analyzers can rely on the position
+// of a buffer within the stream
+func (e *analyzerEntry) run() {
+	for item := range e.input {
+		if item.generation != e.generation {
+			e.generation = item.generation
+			if r, ok := e.analyzer.(resetter); ok {
+				r.Reset()
+			}
+		}
+		if p, ok := e.analyzer.(positioned); ok {
+			p.setPosition(item.position)
+		}
+		e.analyzer.process(item.frames)
+	}
+}
+
+func (e *analyzerEntry) stop() {
+	close(e.input)
+}
+
+func (e *analyzerEntry) isPaused() bool {
+	return atomic.LoadUint32(&e.paused) != 0
+}
+
 // AnalyzerFrame is a frame representation in float
 type AnalyzerFrame struct {
 	Left  float64
@@ -38,12 +125,131 @@ func (a *Analyzer) InputChannel() chan []Frame {
 	return a.frameStream
 }
 
-// Add adds an analyzer
-func (a *Analyzer) Add(ai AnalyzerInterface) {
+// Add adds an analyzer. The name is used to address the analyzer later on
+// and has to be unique.
+func (a *Analyzer) Add(name string, ai AnalyzerInterface) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	a.analyzers = append(a.analyzers, ai)
+	if a.find(name) != nil {
+		return fmt.Errorf("Cannot add analyzer: %s already exists", name)
+	}
+
+	a.analyzers = append(a.analyzers, newAnalyzerEntry(name, ai, a.generation))
+	return nil
+}
+
+// Reset starts a new session: positions restart at 0 and analyzers which
+// keep per session state, e.g. the clipping log, are reset before they get
+// the next buffer
+func (a *Analyzer) Reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.position = 0
+	a.generation++
+}
+
+// Remove removes the analyzer with the given name
+func (a *Analyzer) Remove(name string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, e := range a.analyzers {
+		if e.name == name {
+			a.analyzers = append(a.analyzers[:i], a.analyzers[i+1:]...)
+			e.stop()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Cannot remove analyzer: %s not found", name)
+}
+
+// Replace swaps the analyzer with the given name for another one
+func (a *Analyzer) Replace(name string, ai AnalyzerInterface) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i, e := range a.analyzers {
+		if e.name == name {
+			a.analyzers[i] = newAnalyzerEntry(name, ai, a.generation)
+			atomic.StoreUint32(&a.analyzers[i].paused, atomic.LoadUint32(&e.paused))
+			e.stop()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Cannot replace analyzer: %s not found", name)
+}
+
+// SetPaused pauses or resumes the analyzer with the given name
+func (a *Analyzer) SetPaused(name string, paused bool) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e := a.find(name)
+	if e == nil {
+		return fmt.Errorf("Cannot pause analyzer: %s not found", name)
+	}
+
+	v := uint32(0)
+	if paused {
+		v = 1
+	}
+	atomic.StoreUint32(&e.paused, v)
+	return nil
+}
+
+// Configure changes parameters of the analyzer with the given name. Only
+// parameters listed by List can be changed.
+func (a *Analyzer) Configure(name string, params map[string]float64) error {
+	a.mutex.Lock()
+	e := a.find(name)
+	a.mutex.Unlock()
+
+	if e == nil {
+		return fmt.Errorf("Cannot configure analyzer: %s not found", name)
+	}
+
+	c, ok := e.analyzer.(configurable)
+	if !ok {
+		return fmt.Errorf("Cannot configure analyzer: %s has no parameters", name)
+	}
+
+	current := c.parameters()
+	for k := range params {
+		if _, ok := current[k]; !ok {
+			return fmt.Errorf("Cannot configure analyzer: %s has no parameter %s", name, k)
+		}
+	}
+
+	return c.configure(params)
+}
+
+// List returns all analyzers
+func (a *Analyzer) List() []AnalyzerInfo {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ret := []AnalyzerInfo{}
+	for _, e := range a.analyzers {
+		info := AnalyzerInfo{Name: e.name, Paused: e.isPaused(), Parameters: map[string]float64{}}
+		if c, ok := e.analyzer.(configurable); ok {
+			info.Parameters = c.parameters()
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+func (a *Analyzer) find(name string) *analyzerEntry {
+	for _, e := range a.analyzers {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
 }
 
 func (a *Analyzer) run() {
@@ -52,11 +258,20 @@ func (a *Analyzer) run() {
 		data := <-a.frameStream
 
 		a.mutex.Lock()
-		curAnalyzers := a.analyzers
-		a.mutex.Unlock()
+		item := analyzerItem{frames: data, position: a.position, generation: a.generation}
+		a.position += int64(len(data))
 
-		for _, ca := range curAnalyzers {
-			go ca.process(data)
+		for _, ca := range a.analyzers {
+			if ca.isPaused() {
+				continue
+			}
+			select {
+			case ca.input <- item:
+			default:
+				ca.dropped++
+				fmt.Printf("Analyzer %s is too slow, dropped %d buffers\n", ca.name, ca.dropped)
+			}
 		}
+		a.mutex.Unlock()
 	}
 }
@@ -0,0 +1,268 @@
+package audio
+
+import (
+	"sync"
+	"time"
+)
+
+// Topic identifies the kind of result published on the bus
+type Topic string
+
+const (
+	// TopicRms carries RmsAnalyzerResult
+	TopicRms = Topic("rms")
+	// TopicHeadroom carries HeadroomAnalyzerResult
+	TopicHeadroom = Topic("headroom")
+	// TopicAlert carries AlertEvent
+	TopicAlert = Topic("alert")
+	// TopicDCOffset carries DCOffsetAnalyzerResult
+	TopicDCOffset = Topic("dcoffset")
+	// TopicClipping carries ClippingStatistics
+	TopicClipping = Topic("clipping")
+	// TopicClippingEvent carries ClippingEvent
+	TopicClippingEvent = Topic("clippingEvent")
+	// TopicPitch carries PitchAnalyzerResult
+	TopicPitch = Topic("pitch")
+	// TopicTempo carries TempoAnalyzerResult
+	TopicTempo = Topic("tempo")
+	// TopicBeat carries BeatEvent
+	TopicBeat = Topic("beat")
+)
+
+// eventTopics carry events instead of levels. Every event is delivered, up
+// to eventQueueSize events per subscription, while level topics only keep
+// the latest result.
+var eventTopics = map[Topic]bool{
+	TopicAlert:         true,
+	TopicBeat:          true,
+	TopicClippingEvent: true,
+}
+
+// eventQueueSize is the number of events a subscriber may lag behind before
+// the oldest events are dropped
+const eventQueueSize = 64
+
+// Result is a single analyzer result as delivered to subscribers
+type Result struct {
+	Topic Topic
+	Time  time.Time
+	Value interface{}
+}
+
+// Publisher is used by analyzers to publish their results
+type Publisher interface {
+	Publish(topic Topic, value interface{})
+}
+
+// Bus distributes analyzer results to any number of subscribers. Publishing
+// never blocks: each subscriber only keeps the latest result per level topic
+// and a bounded queue of events, so slow subscribers skip results instead of
+// stalling the analyzers.
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives results for a set of topics
+type Subscription struct {
+	bus      *Bus
+	topics   map[Topic]bool
+	interval time.Duration
+	output   chan Result
+	notify   chan struct{}
+	done     chan struct{}
+	once     sync.Once
+
+	mutex   sync.Mutex
+	pending map[Topic]Result
+	events  []Result
+	dropped int
+	// order holds one entry per pending level topic and per queued event
+	order []Topic
+}
+
+// NewBus factory
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscribe subscribes to the given topics, all topics if none are given.
+// Level results are delivered at most once per interval per topic, an
+// interval of 0 delivers every result the subscriber is fast enough to read.
+// Events are never held back by the interval.
+func (b *Bus) Subscribe(interval time.Duration, topics ...Topic) *Subscription {
+
+	s := &Subscription{
+		bus:      b,
+		topics:   map[Topic]bool{},
+		interval: interval,
+		output:   make(chan Result),
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		pending:  map[Topic]Result{},
+	}
+
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+
+	b.mutex.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mutex.Unlock()
+
+	go s.run()
+	return s
+}
+
+// Publish hands a result to all subscribers of topic
+func (b *Bus) Publish(topic Topic, value interface{}) {
+
+	r := Result{
+		Topic: topic,
+		Time:  time.Now(),
+		Value: value,
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for s := range b.subscribers {
+		s.offer(r)
+	}
+}
+
+// C returns the channel results are delivered on. It is closed after Cancel.
+func (s *Subscription) C() <-chan Result {
+	return s.output
+}
+
+// Cancel ends the subscription
+func (s *Subscription) Cancel() {
+	s.once.Do(func() {
+		s.bus.mutex.Lock()
+		delete(s.bus.subscribers, s)
+		s.bus.mutex.Unlock()
+		close(s.done)
+	})
+}
+
+// Dropped returns the number of events dropped because the subscriber was
+// too slow
+func (s *Subscription) Dropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) offer(r Result) {
+
+	if len(s.topics) > 0 && !s.topics[r.Topic] {
+		return
+	}
+
+	s.mutex.Lock()
+	if eventTopics[r.Topic] {
+		if len(s.events) >= eventQueueSize {
+			s.removeFromOrder(s.events[0].Topic)
+			s.events = s.events[1:]
+			s.dropped++
+		}
+		s.events = append(s.events, r)
+		s.order = append(s.order, r.Topic)
+	} else {
+		if _, ok := s.pending[r.Topic]; !ok {
+			s.order = append(s.order, r.Topic)
+		}
+		s.pending[r.Topic] = r
+	}
+	s.mutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) next() (Result, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.order) == 0 {
+		return Result{}, false
+	}
+
+	topic := s.order[0]
+	s.order = s.order[1:]
+
+	if eventTopics[topic] {
+		// Events of all topics share the queue, the first one of topic is
+		// the oldest
+		for i, r := range s.events {
+			if r.Topic == topic {
+				s.events = append(s.events[:i], s.events[i+1:]...)
+				return r, true
+			}
+		}
+	}
+
+	r := s.pending[topic]
+	delete(s.pending, topic)
+	return r, true
+}
+
+func (s *Subscription) run() {
+
+	defer close(s.output)
+
+	lastSent := map[Topic]time.Time{}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		}
+
+		for {
+			r, ok := s.next()
+			if !ok {
+				break
+			}
+
+			if wait := s.interval - time.Since(lastSent[r.Topic]); wait > 0 && !eventTopics[r.Topic] {
+				select {
+				case <-s.done:
+					return
+				case <-time.After(wait):
+				}
+
+				// A newer result might have arrived while waiting
+				s.mutex.Lock()
+				if newer, ok := s.pending[r.Topic]; ok {
+					r = newer
+					delete(s.pending, r.Topic)
+					s.removeFromOrder(r.Topic)
+				}
+				s.mutex.Unlock()
+			}
+
+			select {
+			case <-s.done:
+				return
+			case s.output <- r:
+				lastSent[r.Topic] = time.Now()
+			}
+		}
+	}
+}
+
+func (s *Subscription) removeFromOrder(topic Topic) {
+	for i, t := range s.order {
+		if t == topic {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package audio
+
+// MonoDownmix mixes left and right into both channels
+type MonoDownmix struct{}
+
+// NewMonoDownmix factory
+func NewMonoDownmix() *MonoDownmix {
+	return &MonoDownmix{}
+}
+
+func (m *MonoDownmix) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		v := int16((int32(frame.Left) + int32(frame.Right)) / 2)
+		ret[i] = Frame{Left: v, Right: v}
+	}
+
+	return ret
+}
+
+// ChannelSwap swaps left and right
+type ChannelSwap struct{}
+
+// NewChannelSwap factory
+func NewChannelSwap() *ChannelSwap {
+	return &ChannelSwap{}
+}
+
+func (c *ChannelSwap) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		ret[i] = Frame{Left: frame.Right, Right: frame.Left}
+	}
+
+	return ret
+}
@@ -0,0 +1,189 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ClippingEvent describes one run of clipped samples on a channel
+type ClippingEvent struct {
+	Offset  time.Duration
+	Sample  int64
+	Channel Channel
+	// Length is the number of clipped samples in a row
+	Length int
+	Peak   int16
+}
+
+func (c *ClippingEvent) String() string {
+	return fmt.Sprintf("Clipping on %s channel at %v: %d samples, peak %d", c.Channel, c.Offset.Round(time.Millisecond), c.Length, c.Peak)
+}
+
+// ClippingStatistics summarizes all clipping events of a session
+type ClippingStatistics struct {
+	Events         int
+	ClippedSamples [2]int
+	Longest        int
+	First          time.Duration
+	Last           time.Duration
+}
+
+func (c *ClippingStatistics) String() string {
+	ret := "Clipping:\n"
+	ret += fmt.Sprintf("  Events : %d\n", c.Events)
+	ret += fmt.Sprintf("  Samples: l: %d\tr: %d\n", c.ClippedSamples[ChannelLeft], c.ClippedSamples[ChannelRight])
+	ret += fmt.Sprintf("  Longest: %d samples\n", c.Longest)
+	return ret
+}
+
+type clippingRun struct {
+	start  int64
+	length int
+	peak   int16
+}
+
+// ClippingAnalyzer detects every run of clipped samples with its position
+// in the session. Every event is published on TopicClippingEvent, the
+// statistics are published whenever an event occurred. Only the statistics
+// are kept, they are reset with every session by the Analyzer.
+type ClippingAnalyzer struct {
+	publisher  Publisher
+	samplerate int
+	mutex      sync.Mutex
+
+	// clippingThreshold is the headroom at or below which a sample counts as clipped
+	clippingThreshold int16
+
+	position int64
+	runs     [2]*clippingRun
+	// events holds the events of the buffer being processed
+	events []ClippingEvent
+	stats  ClippingStatistics
+}
+
+// NewClippingAnalyzer factory
+func NewClippingAnalyzer(samplerate int, publisher Publisher) *ClippingAnalyzer {
+	return &ClippingAnalyzer{
+		publisher:         publisher,
+		samplerate:        samplerate,
+		clippingThreshold: 1,
+	}
+}
+
+// Reset clears the statistics, e.g. when a new session starts
+func (c *ClippingAnalyzer) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.position = 0
+	c.runs = [2]*clippingRun{}
+	c.stats = ClippingStatistics{}
+}
+
+func (c *ClippingAnalyzer) setPosition(position int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// A run still open from before a gap continues at the new position
+	c.position = position
+}
+
+func (c *ClippingAnalyzer) parameters() map[string]float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return map[string]float64{
+		"clippingThreshold": float64(c.clippingThreshold),
+	}
+}
+
+func (c *ClippingAnalyzer) configure(params map[string]float64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if v, ok := params["clippingThreshold"]; ok {
+		if v < 0 || v > math.MaxInt16 {
+			return fmt.Errorf("Cannot configure clipping analyzer: clippingThreshold out of range: %v", v)
+		}
+		c.clippingThreshold = int16(v)
+	}
+
+	return nil
+}
+
+func (c *ClippingAnalyzer) sampleToDuration(sample int64) time.Duration {
+	if c.samplerate <= 0 {
+		return 0
+	}
+	return time.Duration(sample) * time.Second / time.Duration(c.samplerate)
+}
+
+func (c *ClippingAnalyzer) track(channel Channel, v int16) {
+
+	peak := abs(v)
+	if v == math.MinInt16 {
+		peak = math.MaxInt16
+	}
+
+	run := c.runs[channel]
+
+	if math.MaxInt16-peak <= c.clippingThreshold {
+		if run == nil {
+			c.runs[channel] = &clippingRun{start: c.position, length: 1, peak: peak}
+		} else {
+			run.length++
+			run.peak = max(run.peak, peak)
+		}
+		return
+	}
+
+	if run == nil {
+		return
+	}
+
+	e := ClippingEvent{
+		Offset:  c.sampleToDuration(run.start),
+		Sample:  run.start,
+		Channel: channel,
+		Length:  run.length,
+		Peak:    run.peak,
+	}
+	c.events = append(c.events, e)
+	c.runs[channel] = nil
+
+	c.stats.Events++
+	c.stats.ClippedSamples[channel] += run.length
+	if run.length > c.stats.Longest {
+		c.stats.Longest = run.length
+	}
+	if c.stats.Events == 1 {
+		c.stats.First = e.Offset
+	}
+	c.stats.Last = e.Offset
+}
+
+func (c *ClippingAnalyzer) process(frames []Frame) {
+
+	c.mutex.Lock()
+
+	c.events = c.events[:0]
+	for _, frame := range frames {
+		c.track(ChannelLeft, frame.Left)
+		c.track(ChannelRight, frame.Right)
+		c.position++
+	}
+
+	events := append([]ClippingEvent{}, c.events...)
+	stats := c.stats
+	c.mutex.Unlock()
+
+	if len(events) == 0 || c.publisher == nil {
+		return
+	}
+	for _, e := range events {
+		c.publisher.Publish(TopicClippingEvent, e)
+	}
+	c.publisher.Publish(TopicClipping, stats)
+}
@@ -0,0 +1,48 @@
+package audio
+
+import (
+	"math"
+)
+
+// DCBlocker is a first order high pass filter which removes dc offset
+type DCBlocker struct {
+	r     float64
+	lastX AnalyzerFrame
+	lastY AnalyzerFrame
+}
+
+// NewDCBlocker factory. cutoff is the -3dB frequency in Hz, a few Hz is
+// enough to remove any dc offset without touching the audible range.
+func NewDCBlocker(samplerate int, cutoff float64) *DCBlocker {
+	return &DCBlocker{
+		r: 1 - (2 * math.Pi * cutoff / float64(samplerate)),
+	}
+}
+
+func clip16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+func (d *DCBlocker) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		x := AnalyzerFrame{Left: float64(frame.Left), Right: float64(frame.Right)}
+
+		d.lastY.Left = x.Left - d.lastX.Left + d.r*d.lastY.Left
+		d.lastY.Right = x.Right - d.lastX.Right + d.r*d.lastY.Right
+		d.lastX = x
+
+		ret[i] = Frame{Left: clip16(d.lastY.Left), Right: clip16(d.lastY.Right)}
+	}
+
+	return ret
+}
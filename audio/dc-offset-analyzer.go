@@ -0,0 +1,104 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// dcOffsetFloorDB is reported instead of -Inf when there is no offset at all
+const dcOffsetFloorDB = -120
+
+// DCOffsetAnalyzerResult is the output of this analyzer
+type DCOffsetAnalyzerResult struct {
+	Offset   AnalyzerFrame
+	OffsetDB AnalyzerFrame
+}
+
+func (d *DCOffsetAnalyzerResult) String() string {
+	ret := "DC Offset:\n"
+	ret += fmt.Sprintf("  Linear: l: %v\n", d.Offset.Left)
+	ret += fmt.Sprintf("          r: %v\n", d.Offset.Right)
+	ret += fmt.Sprintf("  Log   : l: %v dB\n", d.OffsetDB.Left)
+	ret += fmt.Sprintf("          r: %v dB\n", d.OffsetDB.Right)
+	return ret
+}
+
+// DCOffsetAnalyzer can analyze samples for their dc offset. It has to see
+// the signal before a dc blocker, which removes the offset.
+type DCOffsetAnalyzer struct {
+	publisher Publisher
+	smoothing float64
+	mutex     sync.Mutex
+	offset    AnalyzerFrame
+}
+
+// NewDCOffsetAnalyzer factory. smoothing (0..1) is the weight of the previous
+// offset, 0 reports the mean of each buffer as is.
+func NewDCOffsetAnalyzer(smoothing float64, publisher Publisher) *DCOffsetAnalyzer {
+	return &DCOffsetAnalyzer{
+		publisher: publisher,
+		smoothing: smoothing,
+	}
+}
+
+func (d *DCOffsetAnalyzer) parameters() map[string]float64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return map[string]float64{
+		"smoothing": d.smoothing,
+	}
+}
+
+func (d *DCOffsetAnalyzer) configure(params map[string]float64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if v, ok := params["smoothing"]; ok {
+		if v < 0 || v >= 1 {
+			return fmt.Errorf("Cannot configure dc offset analyzer: smoothing out of range: %v", v)
+		}
+		d.smoothing = v
+	}
+
+	return nil
+}
+
+func (d *DCOffsetAnalyzer) process(frames []Frame) {
+
+	nSamples := len(frames)
+	if nSamples == 0 {
+		return
+	}
+
+	mean := AnalyzerFrame{}
+	for _, frame := range frames {
+		mean.Left += float64(frame.Left) / float64(math.MaxInt16)
+		mean.Right += float64(frame.Right) / float64(math.MaxInt16)
+	}
+	mean.Left /= float64(nSamples)
+	mean.Right /= float64(nSamples)
+
+	d.mutex.Lock()
+	d.offset.Left = d.smoothing*d.offset.Left + (1-d.smoothing)*mean.Left
+	d.offset.Right = d.smoothing*d.offset.Right + (1-d.smoothing)*mean.Right
+
+	result := DCOffsetAnalyzerResult{Offset: d.offset}
+	d.mutex.Unlock()
+
+	result.OffsetDB.Left = offsetToDB(result.Offset.Left)
+	result.OffsetDB.Right = offsetToDB(result.Offset.Right)
+
+	if d.publisher != nil {
+		d.publisher.Publish(TopicDCOffset, result)
+	}
+}
+
+func offsetToDB(offset float64) float64 {
+	db := 20 * math.Log10(math.Abs(offset))
+	if math.IsInf(db, 0) || math.IsNaN(db) || db < dcOffsetFloorDB {
+		return dcOffsetFloorDB
+	}
+	return db
+}
@@ -0,0 +1,35 @@
+package audio
+
+import (
+	"math"
+)
+
+// Gain applies a static gain to both channels
+type Gain struct {
+	gain float64
+}
+
+// NewGain factory
+func NewGain(gainDB float64) *Gain {
+	return &Gain{
+		gain: dbToLinear(gainDB),
+	}
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+func (g *Gain) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		ret[i] = Frame{
+			Left:  clip16(float64(frame.Left) * g.gain),
+			Right: clip16(float64(frame.Right) * g.gain),
+		}
+	}
+
+	return ret
+}
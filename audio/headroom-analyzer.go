@@ -3,12 +3,17 @@ package audio
 import (
 	"fmt"
 	"math"
+	"sync"
 )
 
 // HeadroomAnalyzer can analyze samples for it's rams value
 type HeadroomAnalyzer struct {
-	output chan HeadroomAnalyzerResult
-	result HeadroomAnalyzerResult
+	publisher Publisher
+	mutex     sync.Mutex
+	result    HeadroomAnalyzerResult
+
+	// clippingThreshold is the headroom at or below which a buffer counts as clipping
+	clippingThreshold int16
 }
 
 // HeadroomAnalyzerResult is the output of this analyzer
@@ -27,9 +32,9 @@ func (h *HeadroomAnalyzerResult) String() string {
 }
 
 // NewHeadroomAnalyzer factory
-func NewHeadroomAnalyzer(output chan HeadroomAnalyzerResult) *HeadroomAnalyzer {
+func NewHeadroomAnalyzer(publisher Publisher) *HeadroomAnalyzer {
 	return &HeadroomAnalyzer{
-		output: output,
+		publisher: publisher,
 		result: HeadroomAnalyzerResult{
 			LastHeadroom: Frame{
 				Left:  math.MaxInt16,
@@ -41,7 +46,31 @@ func NewHeadroomAnalyzer(output chan HeadroomAnalyzerResult) *HeadroomAnalyzer {
 			},
 			ClippingCount: 0,
 		},
+		clippingThreshold: 1,
+	}
+}
+
+func (h *HeadroomAnalyzer) parameters() map[string]float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return map[string]float64{
+		"clippingThreshold": float64(h.clippingThreshold),
+	}
+}
+
+func (h *HeadroomAnalyzer) configure(params map[string]float64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if v, ok := params["clippingThreshold"]; ok {
+		if v < 0 || v > math.MaxInt16 {
+			return fmt.Errorf("Cannot configure headroom analyzer: clippingThreshold out of range: %v", v)
+		}
+		h.clippingThreshold = int16(v)
 	}
+
+	return nil
 }
 
 func min(a, b int16) int16 {
@@ -62,6 +91,8 @@ func abs(a int16) int16 {
 
 func (h *HeadroomAnalyzer) process(frames []Frame) {
 
+	h.mutex.Lock()
+
 	h.result.LastHeadroom.Left = math.MaxInt16
 	h.result.LastHeadroom.Right = math.MaxInt16
 
@@ -72,15 +103,18 @@ func (h *HeadroomAnalyzer) process(frames []Frame) {
 		h.result.LastHeadroom.Right = min(h.result.LastHeadroom.Right, headRoomRight)
 	}
 
-	if h.result.LastHeadroom.Left <= 1 || h.result.LastHeadroom.Right <= 1 {
+	if h.result.LastHeadroom.Left <= h.clippingThreshold || h.result.LastHeadroom.Right <= h.clippingThreshold {
 		h.result.ClippingCount++
 	}
 
 	h.result.WorstHeadroom.Left = min(h.result.WorstHeadroom.Left, h.result.LastHeadroom.Left)
 	h.result.WorstHeadroom.Right = min(h.result.WorstHeadroom.Right, h.result.LastHeadroom.Right)
 
-	if h.output != nil {
-		h.output <- h.result
+	result := h.result
+	h.mutex.Unlock()
+
+	if h.publisher != nil {
+		h.publisher.Publish(TopicHeadroom, result)
 	}
 
 }
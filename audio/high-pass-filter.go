@@ -0,0 +1,51 @@
+package audio
+
+import (
+	"math"
+)
+
+// HighPassFilter is a second order butterworth high pass filter
+type HighPassFilter struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	x1, x2     AnalyzerFrame
+	y1, y2     AnalyzerFrame
+}
+
+// NewHighPassFilter factory. cutoff is the -3dB frequency in Hz.
+func NewHighPassFilter(samplerate int, cutoff float64) *HighPassFilter {
+
+	w0 := 2 * math.Pi * cutoff / float64(samplerate)
+	alpha := math.Sin(w0) / math.Sqrt2 // q = 1/sqrt(2)
+	cosW0 := math.Cos(w0)
+	a0 := 1 + alpha
+
+	return &HighPassFilter{
+		b0: (1 + cosW0) / 2 / a0,
+		b1: -(1 + cosW0) / a0,
+		b2: (1 + cosW0) / 2 / a0,
+		a1: -2 * cosW0 / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func (h *HighPassFilter) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		x := AnalyzerFrame{Left: float64(frame.Left), Right: float64(frame.Right)}
+
+		y := AnalyzerFrame{
+			Left:  h.b0*x.Left + h.b1*h.x1.Left + h.b2*h.x2.Left - h.a1*h.y1.Left - h.a2*h.y2.Left,
+			Right: h.b0*x.Right + h.b1*h.x1.Right + h.b2*h.x2.Right - h.a1*h.y1.Right - h.a2*h.y2.Right,
+		}
+
+		h.x2, h.x1 = h.x1, x
+		h.y2, h.y1 = h.y1, y
+
+		ret[i] = Frame{Left: clip16(y.Left), Right: clip16(y.Right)}
+	}
+
+	return ret
+}
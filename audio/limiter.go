@@ -0,0 +1,98 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// Limiter is a look ahead brickwall limiter which keeps the peak level of
+// both channels below a threshold. The signal is delayed by the look ahead
+// time so the gain can be reduced before a peak arrives.
+type Limiter struct {
+	threshold float64
+	attack    float64
+	release   float64
+	gain      float64
+
+	delay    []Frame
+	required []float64
+	pos      int
+
+	// indices into delay of a sliding window minimum of required gains
+	window []int
+}
+
+// NewLimiter factory
+func NewLimiter(samplerate int, thresholdDB float64, lookahead, release time.Duration) *Limiter {
+
+	n := int(lookahead.Seconds() * float64(samplerate))
+	if n < 1 {
+		n = 1
+	}
+
+	required := make([]float64, n)
+	for i := range required {
+		required[i] = 1
+	}
+
+	return &Limiter{
+		threshold: dbToLinear(thresholdDB) * math.MaxInt16,
+		attack:    timeToCoefficient(samplerate, lookahead/4),
+		release:   timeToCoefficient(samplerate, release),
+		gain:      1,
+		delay:     make([]Frame, n),
+		required:  required,
+	}
+}
+
+func (l *Limiter) requiredGain(frame Frame) float64 {
+	peak := math.Max(math.Abs(float64(frame.Left)), math.Abs(float64(frame.Right)))
+	if peak > l.threshold {
+		return l.threshold / peak
+	}
+	return 1
+}
+
+func (l *Limiter) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+	n := len(l.delay)
+
+	for i, frame := range frames {
+		out := l.delay[l.pos]
+		outRequired := l.required[l.pos]
+
+		// Maintain the minimum of the required gains within the look ahead window
+		if len(l.window) > 0 && l.window[0] == l.pos {
+			l.window = l.window[1:]
+		}
+
+		req := l.requiredGain(frame)
+		l.delay[l.pos] = frame
+		l.required[l.pos] = req
+
+		for len(l.window) > 0 && l.required[l.window[len(l.window)-1]] >= req {
+			l.window = l.window[:len(l.window)-1]
+		}
+		l.window = append(l.window, l.pos)
+
+		target := l.required[l.window[0]]
+		if target < l.gain {
+			l.gain = l.attack*l.gain + (1-l.attack)*target
+		} else {
+			l.gain = l.release*l.gain + (1-l.release)*target
+		}
+
+		l.pos = (l.pos + 1) % n
+
+		// Never let a sample pass above the threshold
+		g := math.Min(l.gain, outRequired)
+
+		ret[i] = Frame{
+			Left:  clip16(float64(out.Left) * g),
+			Right: clip16(float64(out.Right) * g),
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,60 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// NoiseGate mutes both channels while the signal stays below a threshold
+type NoiseGate struct {
+	threshold float64
+	attack    float64
+	release   float64
+	envelope  float64
+	gain      float64
+}
+
+func timeToCoefficient(samplerate int, t time.Duration) float64 {
+	if t <= 0 || samplerate <= 0 {
+		return 0
+	}
+	return math.Exp(-1 / (t.Seconds() * float64(samplerate)))
+}
+
+// NewNoiseGate factory. attack is the time to open, release the time to
+// close the gate.
+func NewNoiseGate(samplerate int, thresholdDB float64, attack, release time.Duration) *NoiseGate {
+	return &NoiseGate{
+		threshold: dbToLinear(thresholdDB) * math.MaxInt16,
+		attack:    timeToCoefficient(samplerate, attack),
+		release:   timeToCoefficient(samplerate, release),
+	}
+}
+
+func (n *NoiseGate) process(frames []Frame) []Frame {
+
+	ret := make([]Frame, len(frames))
+
+	for i, frame := range frames {
+		level := math.Max(math.Abs(float64(frame.Left)), math.Abs(float64(frame.Right)))
+
+		if level > n.envelope {
+			n.envelope = level
+		} else {
+			n.envelope = n.release*n.envelope + (1-n.release)*level
+		}
+
+		if n.envelope >= n.threshold {
+			n.gain = n.attack*n.gain + (1 - n.attack)
+		} else {
+			n.gain = n.release * n.gain
+		}
+
+		ret[i] = Frame{
+			Left:  clip16(float64(frame.Left) * n.gain),
+			Right: clip16(float64(frame.Right) * n.gain),
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,232 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// PitchAnalyzerResult is the output of this analyzer
+type PitchAnalyzerResult struct {
+	Frequency  float64
+	Note       string
+	Cents      float64
+	Confidence float64
+}
+
+func (p *PitchAnalyzerResult) String() string {
+	if p.Confidence == 0 {
+		return "Pitch: -\n"
+	}
+	return fmt.Sprintf("Pitch: %.2f Hz %s %+.0f cents (%.2f)\n", p.Frequency, p.Note, p.Cents, p.Confidence)
+}
+
+// PitchAnalyzerConfig holds the parameters of the pitch analyzer
+type PitchAnalyzerConfig struct {
+	// Reference is the frequency of A4 in Hz
+	Reference float64
+	// MinFrequency and MaxFrequency limit the detection range in Hz
+	MinFrequency float64
+	MaxFrequency float64
+	// Threshold is the YIN threshold, lower values are stricter
+	Threshold float64
+	// GateDB is the rms level in dBFS below which nothing is detected
+	GateDB float64
+}
+
+// DefaultPitchAnalyzerConfig returns a config suitable for most instruments
+func DefaultPitchAnalyzerConfig() PitchAnalyzerConfig {
+	return PitchAnalyzerConfig{
+		Reference:    440,
+		MinFrequency: 50,
+		MaxFrequency: 1500,
+		Threshold:    0.15,
+		GateDB:       -50,
+	}
+}
+
+// pitchDecimation is the factor the input is downsampled by before analysis
+const pitchDecimation = 4
+
+// PitchAnalyzer estimates the fundamental frequency of the input with the
+// YIN algorithm. Both channels are mixed to mono and downsampled first.
+type PitchAnalyzer struct {
+	publisher  Publisher
+	mutex      sync.Mutex
+	config     PitchAnalyzerConfig
+	samplerate float64
+
+	window   []float64
+	hop      int
+	received int
+	acc      float64
+	accCount int
+}
+
+// NewPitchAnalyzer factory
+func NewPitchAnalyzer(samplerate int, config PitchAnalyzerConfig, publisher Publisher) *PitchAnalyzer {
+
+	rate := float64(samplerate) / pitchDecimation
+
+	// The window has to hold two periods of the lowest frequency
+	size := int(2 * rate / config.MinFrequency)
+
+	return &PitchAnalyzer{
+		publisher:  publisher,
+		config:     config,
+		samplerate: rate,
+		window:     make([]float64, 0, size),
+		hop:        size / 4,
+	}
+}
+
+func (p *PitchAnalyzer) parameters() map[string]float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return map[string]float64{
+		"reference": p.config.Reference,
+		"threshold": p.config.Threshold,
+		"gateDB":    p.config.GateDB,
+	}
+}
+
+func (p *PitchAnalyzer) configure(params map[string]float64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if v, ok := params["reference"]; ok {
+		if v < 400 || v > 480 {
+			return fmt.Errorf("Cannot configure pitch analyzer: reference out of range: %v", v)
+		}
+		p.config.Reference = v
+	}
+	if v, ok := params["threshold"]; ok {
+		if v <= 0 || v >= 1 {
+			return fmt.Errorf("Cannot configure pitch analyzer: threshold out of range: %v", v)
+		}
+		p.config.Threshold = v
+	}
+	if v, ok := params["gateDB"]; ok {
+		p.config.GateDB = v
+	}
+
+	return nil
+}
+
+func (p *PitchAnalyzer) process(frames []Frame) {
+
+	p.mutex.Lock()
+
+	results := []PitchAnalyzerResult{}
+
+	for _, frame := range frames {
+		p.acc += (float64(frame.Left) + float64(frame.Right)) / 2 / math.MaxInt16
+		p.accCount++
+		if p.accCount < pitchDecimation {
+			continue
+		}
+
+		v := p.acc / pitchDecimation
+		p.acc = 0
+		p.accCount = 0
+
+		if len(p.window) == cap(p.window) {
+			copy(p.window, p.window[1:])
+			p.window[len(p.window)-1] = v
+		} else {
+			p.window = append(p.window, v)
+		}
+
+		p.received++
+		if len(p.window) == cap(p.window) && p.received >= p.hop {
+			p.received = 0
+			results = append(results, p.estimate())
+		}
+	}
+
+	p.mutex.Unlock()
+
+	if p.publisher == nil {
+		return
+	}
+
+	for _, r := range results {
+		p.publisher.Publish(TopicPitch, r)
+	}
+}
+
+func (p *PitchAnalyzer) estimate() PitchAnalyzerResult {
+
+	x := p.window
+
+	sum := 0.0
+	for _, v := range x {
+		sum += v * v
+	}
+	if 10*math.Log10(sum/float64(len(x))) < p.config.GateDB {
+		return PitchAnalyzerResult{}
+	}
+
+	tauMin := int(p.samplerate / p.config.MaxFrequency)
+	tauMax := len(x) / 2
+	if tauMin < 2 {
+		tauMin = 2
+	}
+	w := len(x) - tauMax
+
+	// Cumulative mean normalized difference function
+	d := make([]float64, tauMax+1)
+	d[0] = 1
+	running := 0.0
+	for tau := 1; tau <= tauMax; tau++ {
+		diff := 0.0
+		for j := 0; j < w; j++ {
+			delta := x[j] - x[j+tau]
+			diff += delta * delta
+		}
+		running += diff
+		if running == 0 {
+			d[tau] = 1
+			continue
+		}
+		d[tau] = diff * float64(tau) / running
+	}
+
+	tau := -1
+	for t := tauMin; t < tauMax; t++ {
+		if d[t] < p.config.Threshold {
+			for t+1 < tauMax && d[t+1] < d[t] {
+				t++
+			}
+			tau = t
+			break
+		}
+	}
+
+	if tau < 0 {
+		return PitchAnalyzerResult{}
+	}
+
+	// Parabolic interpolation for sub sample accuracy
+	better := float64(tau)
+	if tau > 0 && tau < tauMax {
+		s0, s1, s2 := d[tau-1], d[tau], d[tau+1]
+		if denom := 2 * (2*s1 - s2 - s0); denom != 0 {
+			better += (s2 - s0) / denom
+		}
+	}
+
+	frequency := p.samplerate / better
+	note := 69 + 12*math.Log2(frequency/p.config.Reference)
+	nearest := int(math.Round(note))
+
+	return PitchAnalyzerResult{
+		Frequency:  frequency,
+		Note:       fmt.Sprintf("%s%d", noteNames[((nearest%12)+12)%12], nearest/12-1),
+		Cents:      100 * (note - float64(nearest)),
+		Confidence: 1 - d[tau],
+	}
+}
@@ -0,0 +1,64 @@
+package audio
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProcessorStageType names a kind of processing stage
+type ProcessorStageType string
+
+const (
+	// StageGain applies a static gain
+	StageGain = ProcessorStageType("gain")
+	// StageDCBlocker removes dc offset
+	StageDCBlocker = ProcessorStageType("dcblocker")
+	// StageHighPass is a second order high pass filter
+	StageHighPass = ProcessorStageType("highpass")
+	// StageNoiseGate mutes the signal below a threshold
+	StageNoiseGate = ProcessorStageType("noisegate")
+	// StageLimiter is a look ahead brickwall limiter
+	StageLimiter = ProcessorStageType("limiter")
+	// StageMono mixes both channels down to mono
+	StageMono = ProcessorStageType("mono")
+	// StageChannelSwap swaps left and right
+	StageChannelSwap = ProcessorStageType("swap")
+)
+
+// ProcessorStageConfig describes one stage of the processing chain. Only the
+// fields used by the given Type are evaluated.
+type ProcessorStageConfig struct {
+	Type   ProcessorStageType
+	Name   string
+	Bypass bool
+
+	GainDB      float64
+	Cutoff      float64
+	ThresholdDB float64
+	Attack      time.Duration
+	Release     time.Duration
+	Lookahead   time.Duration
+}
+
+// NewProcessorStage creates a stage from its config
+func NewProcessorStage(samplerate int, config ProcessorStageConfig) (ProcessorStage, error) {
+
+	switch config.Type {
+	case StageGain:
+		return NewGain(config.GainDB), nil
+	case StageDCBlocker:
+		return NewDCBlocker(samplerate, config.Cutoff), nil
+	case StageHighPass:
+		return NewHighPassFilter(samplerate, config.Cutoff), nil
+	case StageNoiseGate:
+		return NewNoiseGate(samplerate, config.ThresholdDB, config.Attack, config.Release), nil
+	case StageLimiter:
+		return NewLimiter(samplerate, config.ThresholdDB, config.Lookahead, config.Release), nil
+	case StageMono:
+		return NewMonoDownmix(), nil
+	case StageChannelSwap:
+		return NewChannelSwap(), nil
+	}
+
+	return nil, fmt.Errorf("Cannot create processor stage: Unknown type '%s'", config.Type)
+}
@@ -0,0 +1,194 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Processor runs frames through a chain of stages and hands the result
+// to storage (as raw bytes) and analysis (as frames). The input tap gets
+// the frames as they were recorded.
+type Processor struct {
+	frameStream chan []Frame
+	rawOutput   chan []byte
+	frameOutput chan []Frame
+	inputTap    chan []Frame
+	mutex       sync.Mutex
+	stages      []*processorEntry
+	// position is the number of frames since the last reset
+	position int64
+}
+
+// ProcessorStage used to add processing stages
+type ProcessorStage interface {
+	process([]Frame) []Frame
+}
+
+// ProcessorStageInfo describes a stage in the chain
+type ProcessorStageInfo struct {
+	Name     string
+	Bypassed bool
+}
+
+type processorEntry struct {
+	name   string
+	stage  ProcessorStage
+	bypass uint32
+}
+
+func (e *processorEntry) isBypassed() bool {
+	return atomic.LoadUint32(&e.bypass) != 0
+}
+
+// NewProcessor processor factory
+func NewProcessor(rawOutput chan []byte, frameOutput chan []Frame) *Processor {
+	ret := &Processor{
+		frameStream: make(chan []Frame),
+		rawOutput:   rawOutput,
+		frameOutput: frameOutput,
+	}
+	go ret.run()
+
+	return ret
+}
+
+// InputChannel returns the input channel for the processor
+func (p *Processor) InputChannel() chan []Frame {
+	return p.frameStream
+}
+
+// SetInputTap hands a copy of every buffer to c before it is processed,
+// e.g. to detect clipping or a dc offset of the input
+func (p *Processor) SetInputTap(c chan []Frame) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inputTap = c
+}
+
+// Add appends a stage to the end of the chain. The name is used to
+// address the stage later on and has to be unique.
+func (p *Processor) Add(name string, s ProcessorStage) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, e := range p.stages {
+		if e.name == name {
+			return fmt.Errorf("Cannot add processor stage: %s already exists", name)
+		}
+	}
+
+	p.stages = append(p.stages, &processorEntry{name: name, stage: s})
+	return nil
+}
+
+// Configure appends all stages described by configs to the chain
+func (p *Processor) Configure(samplerate int, configs []ProcessorStageConfig) error {
+
+	for _, c := range configs {
+		s, err := NewProcessorStage(samplerate, c)
+		if err != nil {
+			return err
+		}
+
+		name := c.Name
+		if name == "" {
+			name = string(c.Type)
+		}
+
+		if err = p.Add(name, s); err != nil {
+			return err
+		}
+
+		if c.Bypass {
+			p.SetBypass(name, true)
+		}
+	}
+
+	return nil
+}
+
+// SetBypass bypasses or enables the stage with the given name
+func (p *Processor) SetBypass(name string, bypass bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, e := range p.stages {
+		if e.name == name {
+			v := uint32(0)
+			if bypass {
+				v = 1
+			}
+			atomic.StoreUint32(&e.bypass, v)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Cannot bypass processor stage: %s not found", name)
+}
+
+// Stages returns the current chain in processing order
+func (p *Processor) Stages() []ProcessorStageInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ret := []ProcessorStageInfo{}
+	for _, e := range p.stages {
+		ret = append(ret, ProcessorStageInfo{Name: e.name, Bypassed: e.isBypassed()})
+	}
+	return ret
+}
+
+func encodeFrames(frames []Frame) []byte {
+	ret := make([]byte, len(frames)*4)
+	for i, frame := range frames {
+		binary.LittleEndian.PutUint16(ret[i*4:], uint16(frame.Left))
+		binary.LittleEndian.PutUint16(ret[i*4+2:], uint16(frame.Right))
+	}
+	return ret
+}
+
+// Reset restarts positions at 0 when a new session starts
+func (p *Processor) Reset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.position = 0
+}
+
+func (p *Processor) run() {
+	fmt.Printf("Starting processor\n")
+	for {
+		data := <-p.frameStream
+
+		p.mutex.Lock()
+		curStages := p.stages
+		inputTap := p.inputTap
+		position := p.position
+		p.position += int64(len(data))
+		p.mutex.Unlock()
+
+		// Stages may process in place
+		if inputTap != nil {
+			inputTap <- append([]Frame{}, data...)
+		}
+
+		for _, cs := range curStages {
+			if cs.isBypassed() {
+				continue
+			}
+			if ps, ok := cs.stage.(positioned); ok {
+				ps.setPosition(position)
+			}
+			data = cs.stage.process(data)
+		}
+
+		if p.rawOutput != nil {
+			p.rawOutput <- encodeFrames(data)
+		}
+
+		if p.frameOutput != nil {
+			p.frameOutput <- data
+		}
+	}
+}
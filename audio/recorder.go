@@ -66,6 +66,11 @@ func (a *Recorder) IsRunning() bool {
 	return atomic.LoadUint32(&a.isRunning) != 0
 }
 
+// Config returns the recording configuration
+func (a *Recorder) Config() Config {
+	return a.config
+}
+
 // Start starts the recorder
 func (a *Recorder) Start() error {
 
@@ -73,6 +78,8 @@ func (a *Recorder) Start() error {
 		return fmt.Errorf("Cannot start recorder: Already running")
 	}
 
+	// The context is set up here, so Stop works right after Start
+	a.ctx, a.shutdown = context.WithCancel(context.Background())
 	atomic.StoreUint32(&a.isRunning, 1)
 	go a.run()
 	return nil
@@ -127,9 +134,6 @@ func (a *Recorder) setup() error {
 func (a *Recorder) run() {
 
 	defer atomic.StoreUint32(&a.isRunning, 0)
-	ctx, shutdown := context.WithCancel(context.Background())
-	a.ctx = ctx
-	a.shutdown = shutdown
 
 	metrics := Metrics{
 		BytesRead: 0,
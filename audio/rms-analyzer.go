@@ -22,14 +22,14 @@ func (r *RmsAnalyzerResult) String() string {
 
 // RmsAnalyzer can analyze samples for it's rams value
 type RmsAnalyzer struct {
-	output  chan RmsAnalyzerResult
-	counter int
+	publisher Publisher
+	counter   int
 }
 
 // NewRmsAnalyzer factory
-func NewRmsAnalyzer(output chan RmsAnalyzerResult) *RmsAnalyzer {
+func NewRmsAnalyzer(publisher Publisher) *RmsAnalyzer {
 	return &RmsAnalyzer{
-		output: output,
+		publisher: publisher,
 	}
 }
 
@@ -50,7 +50,7 @@ func (r *RmsAnalyzer) process(frames []Frame) {
 	result.RmsDB.Left = 20 * math.Log10(result.Rms.Left)
 	result.RmsDB.Right = 20 * math.Log10(result.Rms.Right)
 
-	if r.output != nil {
-		r.output <- result
+	if r.publisher != nil {
+		r.publisher.Publish(TopicRms, result)
 	}
 }
@@ -0,0 +1,280 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Channel identifies one channel of a stereo frame
+type Channel int
+
+const (
+	// ChannelLeft is the left channel
+	ChannelLeft = Channel(iota)
+	// ChannelRight is the right channel
+	ChannelRight
+)
+
+func (c Channel) String() string {
+	switch c {
+	case ChannelLeft:
+		return "left"
+	case ChannelRight:
+		return "right"
+	}
+	return fmt.Sprintf("channel %d", int(c))
+}
+
+// AlertType describes what kind of problem was detected
+type AlertType int
+
+const (
+	// AlertSilence means the level stayed below the silence threshold
+	AlertSilence = AlertType(iota)
+	// AlertDigitalZero means all samples were exactly zero
+	AlertDigitalZero
+	// AlertDCStuck means the input is stuck at a constant non zero value
+	AlertDCStuck
+)
+
+func (t AlertType) String() string {
+	switch t {
+	case AlertSilence:
+		return "silence"
+	case AlertDigitalZero:
+		return "digital zero"
+	case AlertDCStuck:
+		return "dc stuck"
+	}
+	return fmt.Sprintf("alert %d", int(t))
+}
+
+// AlertEvent is emitted when an alert is raised or cleared
+type AlertEvent struct {
+	Type     AlertType
+	Channel  Channel
+	Active   bool
+	Duration time.Duration
+	Time     time.Time
+}
+
+func (e *AlertEvent) String() string {
+	state := "cleared"
+	if e.Active {
+		state = "raised"
+	}
+	return fmt.Sprintf("Alert %s on %s channel %s after %v", e.Type, e.Channel, state, e.Duration.Round(time.Millisecond))
+}
+
+// SilenceAnalyzerConfig holds thresholds and durations for the silence analyzer
+type SilenceAnalyzerConfig struct {
+	// SilenceThresholdDB is the peak level in dBFS below which a buffer counts as silent
+	SilenceThresholdDB float64
+	// SilenceDuration is how long a channel needs to be silent to raise an alert
+	SilenceDuration time.Duration
+	// DigitalZeroDuration is how long a channel needs to be digital zero to raise an alert
+	DigitalZeroDuration time.Duration
+	// DCStuckTolerance is the maximum peak to peak value of a stuck input
+	DCStuckTolerance int16
+	// DCStuckDuration is how long a channel needs to be stuck to raise an alert
+	DCStuckDuration time.Duration
+}
+
+// DefaultSilenceAnalyzerConfig returns sane defaults for the silence analyzer
+func DefaultSilenceAnalyzerConfig() SilenceAnalyzerConfig {
+	return SilenceAnalyzerConfig{
+		SilenceThresholdDB:  -60,
+		SilenceDuration:     time.Second * 30,
+		DigitalZeroDuration: time.Second * 2,
+		DCStuckTolerance:    2,
+		DCStuckDuration:     time.Second * 2,
+	}
+}
+
+type alertState struct {
+	frames int
+	active bool
+}
+
+// SilenceAnalyzer detects silent, digital zero and dc stuck channels
+type SilenceAnalyzer struct {
+	publisher  Publisher
+	config     SilenceAnalyzerConfig
+	samplerate int
+	threshold  int16
+	mutex      sync.Mutex
+	states     map[AlertType]*[2]alertState
+}
+
+// NewSilenceAnalyzer factory
+func NewSilenceAnalyzer(samplerate int, config SilenceAnalyzerConfig, publisher Publisher) *SilenceAnalyzer {
+	return &SilenceAnalyzer{
+		publisher:  publisher,
+		config:     config,
+		samplerate: samplerate,
+		threshold:  int16(math.MaxInt16 * dbToLinear(config.SilenceThresholdDB)),
+		states: map[AlertType]*[2]alertState{
+			AlertSilence:     {},
+			AlertDigitalZero: {},
+			AlertDCStuck:     {},
+		},
+	}
+}
+
+func (s *SilenceAnalyzer) parameters() map[string]float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return map[string]float64{
+		"silenceThresholdDB":  s.config.SilenceThresholdDB,
+		"silenceDuration":     s.config.SilenceDuration.Seconds(),
+		"digitalZeroDuration": s.config.DigitalZeroDuration.Seconds(),
+		"dcStuckTolerance":    float64(s.config.DCStuckTolerance),
+		"dcStuckDuration":     s.config.DCStuckDuration.Seconds(),
+	}
+}
+
+func (s *SilenceAnalyzer) configure(params map[string]float64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seconds := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second))
+	}
+
+	for k, v := range params {
+		if v < 0 && k != "silenceThresholdDB" {
+			return fmt.Errorf("Cannot configure silence analyzer: %s must not be negative: %v", k, v)
+		}
+	}
+
+	if v, ok := params["silenceThresholdDB"]; ok {
+		s.config.SilenceThresholdDB = v
+		s.threshold = int16(math.MaxInt16 * dbToLinear(v))
+	}
+	if v, ok := params["silenceDuration"]; ok {
+		s.config.SilenceDuration = seconds(v)
+	}
+	if v, ok := params["digitalZeroDuration"]; ok {
+		s.config.DigitalZeroDuration = seconds(v)
+	}
+	if v, ok := params["dcStuckTolerance"]; ok {
+		s.config.DCStuckTolerance = int16(math.Min(v, math.MaxInt16))
+	}
+	if v, ok := params["dcStuckDuration"]; ok {
+		s.config.DCStuckDuration = seconds(v)
+	}
+
+	return nil
+}
+
+func (s *SilenceAnalyzer) framesToDuration(frames int) time.Duration {
+	if s.samplerate <= 0 {
+		return 0
+	}
+	return time.Duration(frames) * time.Second / time.Duration(s.samplerate)
+}
+
+func (s *SilenceAnalyzer) limit(t AlertType) time.Duration {
+	switch t {
+	case AlertSilence:
+		return s.config.SilenceDuration
+	case AlertDigitalZero:
+		return s.config.DigitalZeroDuration
+	case AlertDCStuck:
+		return s.config.DCStuckDuration
+	}
+	return 0
+}
+
+func (s *SilenceAnalyzer) update(t AlertType, c Channel, hit bool, nFrames int) *AlertEvent {
+
+	state := &s.states[t][c]
+
+	if hit {
+		state.frames += nFrames
+		if !state.active && s.framesToDuration(state.frames) >= s.limit(t) {
+			state.active = true
+			return &AlertEvent{Type: t, Channel: c, Active: true, Duration: s.framesToDuration(state.frames), Time: time.Now()}
+		}
+		return nil
+	}
+
+	duration := s.framesToDuration(state.frames)
+	wasActive := state.active
+	state.frames = 0
+	state.active = false
+
+	if wasActive {
+		return &AlertEvent{Type: t, Channel: c, Active: false, Duration: duration, Time: time.Now()}
+	}
+	return nil
+}
+
+func (s *SilenceAnalyzer) process(frames []Frame) {
+
+	if len(frames) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+
+	var minL, maxL, minR, maxR int16 = math.MaxInt16, math.MinInt16, math.MaxInt16, math.MinInt16
+	var peakL, peakR int16
+
+	for _, frame := range frames {
+		if frame.Left < minL {
+			minL = frame.Left
+		}
+		if frame.Left > maxL {
+			maxL = frame.Left
+		}
+		if frame.Right < minR {
+			minR = frame.Right
+		}
+		if frame.Right > maxR {
+			maxR = frame.Right
+		}
+		peakL = max(peakL, abs(frame.Left))
+		peakR = max(peakR, abs(frame.Right))
+	}
+
+	type channelStats struct {
+		channel  Channel
+		min, max int16
+		peak     int16
+	}
+
+	events := []*AlertEvent{}
+	for _, c := range []channelStats{{ChannelLeft, minL, maxL, peakL}, {ChannelRight, minR, maxR, peakR}} {
+		zero := c.min == 0 && c.max == 0
+		stuck := !zero && int(c.max)-int(c.min) <= int(s.config.DCStuckTolerance)
+		silent := !zero && !stuck && c.peak < s.threshold
+
+		events = append(events,
+			s.update(AlertDigitalZero, c.channel, zero, len(frames)),
+			s.update(AlertDCStuck, c.channel, stuck, len(frames)),
+			s.update(AlertSilence, c.channel, silent, len(frames)))
+	}
+
+	s.mutex.Unlock()
+
+	if s.publisher == nil {
+		return
+	}
+
+	for _, e := range events {
+		if e != nil {
+			s.publisher.Publish(TopicAlert, *e)
+		}
+	}
+}
+
+func max(a, b int16) int16 {
+	if a > b {
+		return a
+	}
+	return b
+}
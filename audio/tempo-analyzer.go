@@ -0,0 +1,353 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// TempoAnalyzerResult is the current tempo estimate
+type TempoAnalyzerResult struct {
+	Offset     time.Duration
+	BPM        float64
+	Confidence float64
+}
+
+func (t *TempoAnalyzerResult) String() string {
+	return fmt.Sprintf("Tempo: %.1f BPM (%.2f)\n", t.BPM, t.Confidence)
+}
+
+// BeatEvent is published on every beat
+type BeatEvent struct {
+	Offset time.Duration
+	BPM    float64
+	// Onset is true if the beat coincides with a detected onset
+	Onset bool
+}
+
+// TempoAnalyzerConfig holds the parameters of the tempo analyzer
+type TempoAnalyzerConfig struct {
+	// MinBPM and MaxBPM limit the tempo range
+	MinBPM float64
+	MaxBPM float64
+	// Sensitivity scales the adaptive onset threshold, lower values detect more onsets
+	Sensitivity float64
+	// MinConfidence is the confidence below which no beats are published
+	MinConfidence float64
+}
+
+// DefaultTempoAnalyzerConfig returns a config suitable for most music
+func DefaultTempoAnalyzerConfig() TempoAnalyzerConfig {
+	return TempoAnalyzerConfig{
+		MinBPM:        60,
+		MaxBPM:        180,
+		Sensitivity:   1.5,
+		MinConfidence: 0.2,
+	}
+}
+
+const (
+	// tempoHop is the number of frames one value of the onset function covers
+	tempoHop = 512
+	// tempoHistory is the duration of onset function the tempo is estimated from
+	tempoHistory = time.Second * 6
+	// tempoInterval is the time between two tempo estimates
+	tempoInterval = time.Second
+	// onsetWindow is the duration the adaptive onset threshold is calculated on
+	onsetWindow = time.Millisecond * 500
+	// onsetMinDistance is the minimum time between two onsets
+	onsetMinDistance = time.Millisecond * 50
+)
+
+// TempoAnalyzer detects onsets and estimates the tempo from the autocorrelation
+// of an onset detection function. Beats are predicted from the tempo and
+// locked to the detected onsets.
+type TempoAnalyzer struct {
+	publisher Publisher
+	mutex     sync.Mutex
+	config    TempoAnalyzerConfig
+	fps       float64
+
+	energy     float64
+	count      int
+	lastEnergy float64
+
+	odf       []float64
+	position  int64
+	lastOnset int64
+	sinceEst  int
+	// sessionPosition is the session position of the next frame, hopStart
+	// the session position of the first frame of the current hop. Offsets
+	// are reported from these, the odf position only keeps the beat phase.
+	sessionPosition int64
+	hopStart        int64
+
+	tempo    TempoAnalyzerResult
+	period   float64
+	nextBeat float64
+}
+
+// NewTempoAnalyzer factory
+func NewTempoAnalyzer(samplerate int, config TempoAnalyzerConfig, publisher Publisher) *TempoAnalyzer {
+	return &TempoAnalyzer{
+		publisher: publisher,
+		config:    config,
+		fps:       float64(samplerate) / tempoHop,
+		lastOnset: math.MinInt32,
+	}
+}
+
+func (t *TempoAnalyzer) parameters() map[string]float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return map[string]float64{
+		"minBPM":        t.config.MinBPM,
+		"maxBPM":        t.config.MaxBPM,
+		"sensitivity":   t.config.Sensitivity,
+		"minConfidence": t.config.MinConfidence,
+	}
+}
+
+func (t *TempoAnalyzer) configure(params map[string]float64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	config := t.config
+	if v, ok := params["minBPM"]; ok {
+		config.MinBPM = v
+	}
+	if v, ok := params["maxBPM"]; ok {
+		config.MaxBPM = v
+	}
+	if v, ok := params["sensitivity"]; ok {
+		config.Sensitivity = v
+	}
+	if v, ok := params["minConfidence"]; ok {
+		config.MinConfidence = v
+	}
+
+	if config.MinBPM <= 0 || config.MaxBPM <= config.MinBPM {
+		return fmt.Errorf("Cannot configure tempo analyzer: Invalid bpm range %v..%v", config.MinBPM, config.MaxBPM)
+	}
+
+	// The autocorrelation needs at least one odf value per beat and two
+	// beats within the history
+	minLag, maxLag := t.lags(config)
+	if minLag < 1 {
+		return fmt.Errorf("Cannot configure tempo analyzer: maxBPM %v above %v", config.MaxBPM, 60*t.fps)
+	}
+	if 2*maxLag > t.historySize() {
+		return fmt.Errorf("Cannot configure tempo analyzer: minBPM %v below %v", config.MinBPM, math.Ceil(2*60*t.fps/float64(t.historySize())))
+	}
+
+	t.config = config
+	return nil
+}
+
+// lags returns the autocorrelation lags in odf values for the bpm range
+func (t *TempoAnalyzer) lags(config TempoAnalyzerConfig) (minLag, maxLag int) {
+	return int(60 * t.fps / config.MaxBPM), int(60 * t.fps / config.MinBPM)
+}
+
+// historySize is the number of odf values kept for the autocorrelation
+func (t *TempoAnalyzer) historySize() int {
+	return int(tempoHistory.Seconds() * t.fps)
+}
+
+func (t *TempoAnalyzer) sampleToDuration(sample int64) time.Duration {
+	return time.Duration(float64(sample) / (t.fps * tempoHop) * float64(time.Second))
+}
+
+func (t *TempoAnalyzer) setPosition(position int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sessionPosition = position
+}
+
+func (t *TempoAnalyzer) process(frames []Frame) {
+
+	t.mutex.Lock()
+
+	beats := []BeatEvent{}
+	estimated := false
+
+	for _, frame := range frames {
+		v := (float64(frame.Left) + float64(frame.Right)) / 2 / math.MaxInt16
+		t.energy += v * v
+		t.count++
+		t.sessionPosition++
+		if t.count < tempoHop {
+			continue
+		}
+		t.hopStart = t.sessionPosition - tempoHop
+
+		if beat, ok := t.step(); ok {
+			beats = append(beats, beat)
+		}
+
+		t.sinceEst++
+		if float64(t.sinceEst) >= tempoInterval.Seconds()*t.fps {
+			t.sinceEst = 0
+			t.estimate()
+			estimated = true
+		}
+	}
+
+	tempo := t.tempo
+	t.mutex.Unlock()
+
+	if t.publisher == nil {
+		return
+	}
+
+	if estimated {
+		t.publisher.Publish(TopicTempo, tempo)
+	}
+	for _, b := range beats {
+		t.publisher.Publish(TopicBeat, b)
+	}
+}
+
+// step adds one value to the onset detection function and returns a beat
+// if one is due
+func (t *TempoAnalyzer) step() (BeatEvent, bool) {
+
+	const eps = 1e-10
+
+	energy := math.Log(t.energy/tempoHop + eps)
+	t.energy = 0
+	t.count = 0
+
+	flux := math.Max(0, energy-t.lastEnergy)
+	t.lastEnergy = energy
+
+	t.odf = append(t.odf, flux)
+	if max := t.historySize(); len(t.odf) > max {
+		t.odf = t.odf[len(t.odf)-max:]
+	}
+
+	pos := t.position
+	t.position++
+
+	onset := t.isOnset() && float64(pos-t.lastOnset) >= onsetMinDistance.Seconds()*t.fps
+	if onset {
+		t.lastOnset = pos
+	}
+
+	if t.period == 0 || t.tempo.Confidence < t.config.MinConfidence {
+		return BeatEvent{}, false
+	}
+
+	// Lock the beat phase to onsets close to the predicted beat
+	if onset && math.Abs(float64(pos)-t.nextBeat) < 0.2*t.period {
+		t.nextBeat = float64(pos)
+	}
+
+	if float64(pos) < t.nextBeat {
+		return BeatEvent{}, false
+	}
+
+	beat := BeatEvent{
+		Offset: t.sampleToDuration(t.hopStart),
+		BPM:    t.tempo.BPM,
+		Onset:  onset,
+	}
+
+	for t.nextBeat <= float64(pos) {
+		t.nextBeat += t.period
+	}
+
+	return beat, true
+}
+
+func (t *TempoAnalyzer) isOnset() bool {
+
+	n := len(t.odf)
+	window := int(onsetWindow.Seconds() * t.fps)
+	if n < window || n < 2 {
+		return false
+	}
+
+	mean, sq := 0.0, 0.0
+	for _, v := range t.odf[n-window:] {
+		mean += v
+		sq += v * v
+	}
+	mean /= float64(window)
+	std := math.Sqrt(math.Max(0, sq/float64(window)-mean*mean))
+
+	cur := t.odf[n-1]
+	return cur > mean+t.config.Sensitivity*std && cur > t.odf[n-2] && cur > 0.1
+}
+
+func (t *TempoAnalyzer) estimate() {
+
+	n := len(t.odf)
+	minLag, maxLag := t.lags(t.config)
+	if n < 2*maxLag {
+		return
+	}
+
+	mean := 0.0
+	for _, v := range t.odf {
+		mean += v
+	}
+	mean /= float64(n)
+
+	ac0 := 0.0
+	for _, v := range t.odf {
+		ac0 += (v - mean) * (v - mean)
+	}
+	if ac0 == 0 {
+		t.tempo = TempoAnalyzerResult{}
+		return
+	}
+
+	acs := make([]float64, maxLag+2)
+	for lag := minLag - 1; lag <= maxLag+1; lag++ {
+		for i := lag; i < n; i++ {
+			acs[lag] += (t.odf[i] - mean) * (t.odf[i-lag] - mean)
+		}
+		acs[lag] /= ac0
+	}
+
+	bestLag, bestScore, bestAc := 0, 0.0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		ac := acs[lag]
+
+		// Prefer tempos around 120 BPM to avoid octave errors
+		bpm := 60 * t.fps / float64(lag)
+		weight := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120), 2))
+
+		if score := ac * weight; score > bestScore {
+			bestLag, bestScore, bestAc = lag, score, ac
+		}
+	}
+
+	if bestLag == 0 {
+		t.tempo = TempoAnalyzerResult{}
+		return
+	}
+
+	// A strong peak at half the lag means we locked to every second beat
+	if half := bestLag / 2; half >= minLag && acs[half] > 0.5*bestAc {
+		bestLag, bestAc = half, acs[half]
+	}
+
+	// Parabolic interpolation for a finer tempo resolution
+	t.period = float64(bestLag)
+	if denom := 2 * (2*acs[bestLag] - acs[bestLag-1] - acs[bestLag+1]); denom != 0 {
+		t.period += (acs[bestLag+1] - acs[bestLag-1]) / denom
+	}
+	t.tempo = TempoAnalyzerResult{
+		Offset:     t.sampleToDuration(t.hopStart + tempoHop),
+		BPM:        60 * t.fps / t.period,
+		Confidence: bestAc,
+	}
+
+	if t.nextBeat < float64(t.position) {
+		t.nextBeat = float64(t.position)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/pascalhuerst/recorder-booth/ingest"
+)
+
+func main() {
+
+	listen := flag.String("listen", ":8080", "Address to listen on")
+	dir := flag.String("dir", "/var/lib/recorder-booth/uploads", "Directory uploads are stored in")
+	token := flag.String("token", os.Getenv("INGEST_TOKEN"), "Bearer token clients have to send")
+	hmacKey := flag.String("hmac-key", os.Getenv("INGEST_HMAC_KEY"), "Key clients sign requests with")
+	hmacKeyID := flag.String("hmac-key-id", "", "Id clients send with signed requests")
+	flag.Parse()
+
+	tusServer, err := ingest.NewTusServer(*dir, "/files/")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	auth := ingest.TusAuth{BearerToken: *token}
+	if *hmacKey != "" {
+		auth.HMACKeys = map[string]string{*hmacKeyID: *hmacKey}
+	}
+	if auth.BearerToken == "" && auth.HMACKeys == nil {
+		fmt.Printf("Warning: No token or hmac key set, accepting uploads from anyone\n")
+	}
+	tusServer.SetAuth(auth)
+
+	http.Handle("/files/", tusServer)
+
+	fmt.Printf("Ingest server listening on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
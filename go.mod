@@ -5,7 +5,10 @@ go 1.15
 require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/pascalhuerst/framebuffer v0.0.0-20201212112953-a3472fb50352
+	github.com/pkg/sftp v1.13.6
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/yobert/alsa v0.0.0-20200618200352-d079056f5370
+	golang.org/x/crypto v0.1.0
 	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
+	golang.org/x/net v0.1.0
 )
@@ -0,0 +1,452 @@
+package ingest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-defer-length,checksum"
+	// tusMaxChunk limits the body of a single PATCH request
+	tusMaxChunk = 64 * 1024 * 1024
+	// tusMaxSkew is how far the timestamp of a signed request may be off
+	tusMaxSkew = time.Minute * 5
+)
+
+// TusAuth holds the credentials clients have to present, they match the
+// HTTPClientConfig of the storage handlers. Requests are accepted if any
+// configured method succeeds, without any method all requests are accepted.
+type TusAuth struct {
+	// BearerToken is expected in the Authorization header
+	BearerToken string
+	// HMACKeys maps key ids to keys for signed requests. The key of a
+	// request without X-Key-Id is looked up with an empty id.
+	HMACKeys map[string]string
+}
+
+// tusInfo is stored next to the data of an upload, so uploads can be
+// resumed after a restart of the server
+type tusInfo struct {
+	ID       string            `json:"id"`
+	Offset   int64             `json:"offset"`
+	Length   int64             `json:"length"`
+	Deferred bool              `json:"deferred"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// TusServer receives resumable uploads with the tus protocol. Uploads are
+// kept as <id>.part in dir while they are running and are renamed to the
+// file name from their metadata when they are complete.
+type TusServer struct {
+	dir      string
+	basePath string
+	mutex    sync.Mutex
+	// locks serializes requests on the same upload
+	locks map[string]*sync.Mutex
+	auth  TusAuth
+}
+
+// NewTusServer factory. basePath is the url path the server is mounted at.
+func NewTusServer(dir, basePath string) (*TusServer, error) {
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("Cannot create upload directory: %v", err)
+	}
+
+	return &TusServer{
+		dir:      dir,
+		basePath: strings.TrimSuffix(basePath, "/") + "/",
+		locks:    map[string]*sync.Mutex{},
+	}, nil
+}
+
+// SetAuth sets the credentials clients have to present
+func (ts *TusServer) SetAuth(auth TusAuth) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.auth = auth
+}
+
+// authorized checks the bearer token or the signature of r, body is the
+// complete request body
+func (ts *TusServer) authorized(r *http.Request, body []byte) bool {
+
+	ts.mutex.Lock()
+	auth := ts.auth
+	ts.mutex.Unlock()
+
+	if auth.BearerToken == "" && len(auth.HMACKeys) == 0 {
+		return true
+	}
+
+	if auth.BearerToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(auth.BearerToken)) == 1 {
+			return true
+		}
+	}
+
+	key, ok := auth.HMACKeys[r.Header.Get("X-Key-Id")]
+	if !ok {
+		return false
+	}
+
+	timestamp := r.Header.Get("X-Timestamp")
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(t, 0)); skew > tusMaxSkew || skew < -tusMaxSkew {
+		return false
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return false
+	}
+
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func (ts *TusServer) lock(id string) func() {
+	ts.mutex.Lock()
+	l, ok := ts.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		ts.locks[id] = l
+	}
+	ts.mutex.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func (ts *TusServer) infoFileName(id string) string {
+	return path.Join(ts.dir, id+".info")
+}
+
+func (ts *TusServer) dataFileName(id string) string {
+	return path.Join(ts.dir, id+".part")
+}
+
+func (ts *TusServer) loadInfo(id string) (*tusInfo, error) {
+	b, err := ioutil.ReadFile(ts.infoFileName(id))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &tusInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, fmt.Errorf("Cannot parse upload info: %v", err)
+	}
+	return info, nil
+}
+
+func (ts *TusServer) saveInfo(info *tusInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal upload info: %v", err)
+	}
+
+	tmp := ts.infoFileName(info.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return fmt.Errorf("Cannot write upload info: %v", err)
+	}
+	return os.Rename(tmp, ts.infoFileName(info.ID))
+}
+
+func (ts *TusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", "sha256")
+		w.Header().Set("Tus-Max-Size", "0")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	// The body is read before anything else, signatures cover it
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, tusMaxChunk+1))
+	if err != nil {
+		// Keep nothing of an interrupted request, the client resumes at the old offset
+		http.Error(w, "Cannot read body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > tusMaxChunk {
+		http.Error(w, "Chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !ts.authorized(r, body) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, ts.basePath)
+	if id == strings.TrimSuffix(ts.basePath, "/") {
+		id = ""
+	}
+
+	if id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ts.create(w, r)
+		return
+	}
+
+	if strings.ContainsAny(id, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+
+	unlock := ts.lock(id)
+	defer unlock()
+
+	info, err := ts.loadInfo(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		ts.head(w, info)
+	case "PATCH":
+		ts.patch(w, r, info, body)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseMetadata(header string) map[string]string {
+	ret := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			if b, err := base64.StdEncoding.DecodeString(fields[1]); err == nil {
+				value = string(b)
+			}
+		}
+		ret[fields[0]] = value
+	}
+	return ret
+}
+
+func (ts *TusServer) create(w http.ResponseWriter, r *http.Request) {
+
+	info := &tusInfo{
+		Length:   -1,
+		Metadata: parseMetadata(r.Header.Get("Upload-Metadata")),
+	}
+
+	if r.Header.Get("Upload-Defer-Length") == "1" {
+		info.Deferred = true
+	} else {
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		info.Length = length
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Cannot create id", http.StatusInternalServerError)
+		return
+	}
+	info.ID = hex.EncodeToString(id)
+
+	f, err := os.Create(ts.dataFileName(info.ID))
+	if err != nil {
+		http.Error(w, "Cannot create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := ts.saveInfo(info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("Upload %s created for %s\n", info.ID, info.Metadata["filename"])
+
+	w.Header().Set("Location", ts.basePath+info.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (ts *TusServer) head(w http.ResponseWriter, info *tusInfo) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	if info.Deferred {
+		w.Header().Set("Upload-Defer-Length", "1")
+	} else {
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ts *TusServer) patch(w http.ResponseWriter, r *http.Request, info *tusInfo, data []byte) {
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != info.Offset {
+		http.Error(w, "Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	if v := r.Header.Get("Upload-Length"); v != "" && info.Deferred {
+		length, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || length < info.Offset {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		info.Length = length
+		info.Deferred = false
+	}
+
+	if !info.Deferred && info.Offset+int64(len(data)) > info.Length {
+		http.Error(w, "Upload exceeds length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		fields := strings.Fields(v)
+		if len(fields) != 2 || fields[0] != "sha256" {
+			http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(data)
+		if fields[1] != base64.StdEncoding.EncodeToString(sum[:]) {
+			http.Error(w, "Checksum mismatch", 460)
+			return
+		}
+	}
+
+	// An empty request only declares the length or repeats the last one
+	if len(data) == 0 {
+		if err := ts.saveInfo(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !info.Deferred && info.Offset == info.Length {
+			ts.complete(info)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := os.OpenFile(ts.dataFileName(info.ID), os.O_WRONLY, 0666)
+	if err != nil {
+		http.Error(w, "Cannot open upload", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = f.WriteAt(data, info.Offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		http.Error(w, "Cannot write upload", http.StatusInternalServerError)
+		return
+	}
+
+	info.Offset += int64(len(data))
+	if err := ts.saveInfo(info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !info.Deferred && info.Offset == info.Length {
+		ts.complete(info)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fileName returns a safe name for a finished upload. The name from the
+// metadata is only used if it is a plain file name which cannot be taken
+// for the files of an upload.
+func fileName(info *tusInfo) string {
+
+	name := info.Metadata["filename"]
+	valid := name != "" && !strings.HasPrefix(name, ".") &&
+		!strings.HasSuffix(name, ".info") && !strings.HasSuffix(name, ".part") && !strings.HasSuffix(name, ".tmp")
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			valid = false
+		}
+	}
+
+	if !valid {
+		return info.ID + ".raw"
+	}
+	return name
+}
+
+// complete moves a finished upload to its final name, existing files are
+// never overwritten. The upload info stays, so a client which missed the
+// last response still finds its offset.
+func (ts *TusServer) complete(info *tusInfo) {
+
+	if _, err := os.Stat(ts.dataFileName(info.ID)); os.IsNotExist(err) {
+		return
+	}
+
+	name := fileName(info)
+
+	// Link fails if the name is taken, unlike rename
+	err := os.Link(ts.dataFileName(info.ID), path.Join(ts.dir, name))
+	if os.IsExist(err) {
+		name = info.ID + "_" + name
+		err = os.Link(ts.dataFileName(info.ID), path.Join(ts.dir, name))
+	}
+	if err != nil {
+		fmt.Printf("Cannot move upload %s to %s: %v\n", info.ID, name, err)
+		return
+	}
+	os.Remove(ts.dataFileName(info.ID))
+
+	fmt.Printf("Upload %s complete: %s (%d bytes)\n", info.ID, name, info.Offset)
+}
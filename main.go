@@ -6,9 +6,12 @@ import (
 	"image/png"
 	"log"
 	"math"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/pascalhuerst/framebuffer"
+	"github.com/pascalhuerst/recorder-booth/api"
 	"github.com/pascalhuerst/recorder-booth/audio"
 	"github.com/pascalhuerst/recorder-booth/io"
 	"github.com/pascalhuerst/recorder-booth/storage"
@@ -78,6 +81,7 @@ func main() {
 	*/
 
 	//rss1 := ui.NewRecordStatusScreen(d1)
+	tuner := ui.NewTunerScreen(d1)
 
 	d2, err := makeDisplay(1)
 	if err != nil {
@@ -165,18 +169,22 @@ func main() {
 	}
 	fmt.Printf("Recording device: %v\n", recordDevice)
 
-	rmsCh := make(chan audio.RmsAnalyzerResult)
+	results := audio.NewBus()
+
+	rmsSub := results.Subscribe(time.Millisecond*20, audio.TopicRms)
 	go func() {
 		counter := 0
-		for {
-			v := <-rmsCh
+		for r := range rmsSub.C() {
+			v := r.Value.(audio.RmsAnalyzerResult)
 			//d1V := float32(80+v.RmsDB.Left) / 100.0
 			//rss1.SetLevel(d1V)
 
 			//pl := v.Rms.Left * 10.0
 			pl := (80.0 - math.Abs(2.0*math.Max(v.RmsDB.Left, -40.0))) / 8.0 // 0..10
 			nLedsL := int(math.Round(pl - 0.5))
-			leftLedBar.Set(nLedsL)
+			if !tuner.IsVisible() {
+				leftLedBar.Set(nLedsL)
+			}
 
 			d2V := float32(80+v.RmsDB.Right) / 100.0
 			rss2.SetLevel(d2V)
@@ -195,13 +203,13 @@ func main() {
 	}()
 
 	clippingLed := ui.NewLed(ui.LedGPIOMapping{Controller: gpioController2, GPIOIndex: 0, Invert: true})
-	headroomCh := make(chan audio.HeadroomAnalyzerResult)
+	headroomSub := results.Subscribe(time.Millisecond*50, audio.TopicHeadroom)
 	go func() {
 		counter := 0
 		lastClippingCount := 0
 
-		for {
-			v := <-headroomCh
+		for r := range headroomSub.C() {
+			v := r.Value.(audio.HeadroomAnalyzerResult)
 			// Test: Turn on red led
 
 			if v.ClippingCount > lastClippingCount {
@@ -220,26 +228,318 @@ func main() {
 		}
 	}()
 
+	// apiServer is set before the recorder is started and storage is checked
+	var apiServer *api.Server
+
 	metricsCh := make(chan audio.Metrics)
 	go func() {
 		for {
 			v := <-metricsCh
 			rss2.SetDuration(v.Duration)
+			apiServer.SetMetrics(v)
+		}
+	}()
+
+	alertSub := results.Subscribe(0, audio.TopicAlert)
+	go func() {
+		active := map[string]audio.AlertEvent{}
+		for r := range alertSub.C() {
+			v := r.Value.(audio.AlertEvent)
+			fmt.Printf("%s\n", v.String())
+
+			key := fmt.Sprintf("%s/%s", v.Type, v.Channel)
+			if v.Active {
+				active[key] = v
+			} else {
+				delete(active, key)
+			}
+
+			alert := ""
+			for _, a := range active {
+				alert = fmt.Sprintf("%s: %s", a.Channel, a.Type)
+			}
+			rss2.SetAlert(alert)
+		}
+	}()
+
+	dcOffsetSub := results.Subscribe(time.Second*10, audio.TopicDCOffset)
+	go func() {
+		for r := range dcOffsetSub.C() {
+			v := r.Value.(audio.DCOffsetAnalyzerResult)
+			fmt.Printf("%s\n", v.String())
 		}
 	}()
 
 	analyzer := audio.NewAnalyzer()
-	headroomAnalyzer := audio.NewHeadroomAnalyzer(headroomCh)
-	analyzer.Add(headroomAnalyzer)
-	rmsAnalyzer := audio.NewRmsAnalyzer(rmsCh)
-	analyzer.Add(rmsAnalyzer)
+	analyzer.Add("headroom", audio.NewHeadroomAnalyzer(results))
+	analyzer.Add("rms", audio.NewRmsAnalyzer(results))
+	analyzer.Add("silence", audio.NewSilenceAnalyzer(cfg.Samplerate, audio.DefaultSilenceAnalyzerConfig(), results))
+	analyzer.Add("dcoffset", audio.NewDCOffsetAnalyzer(0.9, results))
+	analyzer.Add("clipping", audio.NewClippingAnalyzer(cfg.Samplerate, results))
+	analyzer.Add("pitch", audio.NewPitchAnalyzer(cfg.Samplerate, audio.DefaultPitchAnalyzerConfig(), results))
+	analyzer.Add("tempo", audio.NewTempoAnalyzer(cfg.Samplerate, audio.DefaultTempoAnalyzerConfig(), results))
+
+	// The tuner takes over the first display and the left led bar while a
+	// stable pitch is detected
+	pitchSub := results.Subscribe(time.Millisecond*50, audio.TopicPitch)
+	go func() {
+		var stableSince, lastSeen time.Time
+		for {
+			select {
+			case r := <-pitchSub.C():
+				v := r.Value.(audio.PitchAnalyzerResult)
+				if v.Confidence < 0.9 {
+					stableSince = time.Time{}
+					tuner.ClearPitch()
+					break
+				}
+
+				if stableSince.IsZero() {
+					stableSince = time.Now()
+				}
+				lastSeen = time.Now()
+				tuner.SetPitch(v.Note, v.Cents, v.Frequency)
+
+				if time.Since(stableSince) > time.Millisecond*500 {
+					tuner.Show()
+					leftLedBar.SetCentered(v.Cents / 50)
+				}
+			case <-time.After(time.Second):
+			}
+
+			if tuner.IsVisible() && time.Since(lastSeen) > time.Second*3 {
+				tuner.Hide()
+				d1.DrawImage(img)
+			}
+		}
+	}()
+
+	sessionPath := "/tmp/sessions"
+	session := storage.NewSession("RecorderBooth")
 
 	manager := storage.NewManager()
-	manager.Add(storage.NewSnapcastStorageHandler("/tmp/stream-pipe", "RecorderBooth"))
-	//manager.Add(storage.NewChunkStorageHandler("/tmp/chunks", "RecorderBooth", 1024*32))
-	manager.Add(storage.NewHTTPStorageHandler("http://server.lan:8080/upload", "RecorderBooth", 1024*256))
+	manager.SetFormat(storage.AudioFormat{
+		Samplerate:     cfg.Samplerate,
+		Channels:       2,
+		SampleFormat:   "S16_LE",
+		BytesPerSample: 2,
+	})
+	manager.SetSession(session)
+	snapcastStorageHandler := storage.NewSnapcastStorageHandler("/tmp/stream-pipe", "RecorderBooth")
+	//snapcastStorageHandler.SetControl(storage.SnapcastControlConfig{Address: "localhost:1705", Mute: true})
+	manager.Add(snapcastStorageHandler)
+	//manager.Add(storage.NewChunkStorageHandler("/tmp/chunks", "RecorderBooth", 1024*32, "/var/tmp/chunks"))
+	uploadTracker := storage.NewUploadTracker(sessionPath, "RecorderBooth")
+	httpStorageHandler := storage.NewHTTPStorageHandler("http://server.lan:8080/upload", "RecorderBooth", 1024*256, sessionPath)
+	httpStorageHandler.SetUploadTracker(uploadTracker)
+	httpClientConfig := storage.DefaultHTTPClientConfig()
+	httpClientConfig.CAFile = os.Getenv("RECORDER_UPLOAD_CA")
+	httpClientConfig.CertFile = os.Getenv("RECORDER_UPLOAD_CERT")
+	httpClientConfig.KeyFile = os.Getenv("RECORDER_UPLOAD_KEY")
+	httpClientConfig.BearerToken = os.Getenv("RECORDER_UPLOAD_TOKEN")
+	httpClientConfig.HMACKey = os.Getenv("RECORDER_UPLOAD_HMAC_KEY")
+	httpClientConfig.HMACKeyID = "RecorderBooth"
+	if err := httpStorageHandler.SetClientConfig(httpClientConfig); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	manager.Add(httpStorageHandler)
+	//manager.Add(storage.NewTusStorageHandler("http://server.lan:8080/files/", "RecorderBooth", 1024*256))
+	//manager.Add(storage.NewS3StorageHandler(storage.S3Config{Endpoint: "http://minio.lan:9000", Bucket: "recordings", Prefix: "booth/", AccessKey: os.Getenv("RECORDER_S3_ACCESS_KEY"), SecretKey: os.Getenv("RECORDER_S3_SECRET_KEY"), PathStyle: true}, "RecorderBooth"))
+	//manager.Add(storage.NewWebDAVStorageHandler("https://cloud.example.com/remote.php/dav/files/booth/recordings", "booth", os.Getenv("RECORDER_WEBDAV_PASSWORD"), "RecorderBooth", 0, sessionPath))
+	//manager.Add(storage.NewSFTPStorageHandler(storage.SFTPConfig{Address: "archive.lan:22", User: "booth", KeyFile: "/etc/recorder-booth/id_ed25519", KnownHostsFile: "/etc/recorder-booth/known_hosts", Directory: "recordings"}, "RecorderBooth", 1024*1024, sessionPath))
+	//manager.Add(storage.NewIcecastStorageHandler(storage.IcecastConfig{URL: "http://stream.lan:8000/booth.ogg", Password: os.Getenv("RECORDER_ICECAST_PASSWORD"), Name: "Recorder Booth"}, "RecorderBooth"))
+	//manager.Add(storage.NewRTPStorageHandler(storage.RTPConfig{Destination: "239.69.83.1:5004", Interface: "eth0", Announce: true}, "RecorderBooth"))
+	if pcmStreamHandler, err := storage.NewPCMStreamHandler(storage.PCMStreamTCPServer, ":7000", "RecorderBooth"); err != nil {
+		fmt.Println(err)
+	} else {
+		manager.Add(pcmStreamHandler)
+	}
+	manager.Add(storage.NewWaveformStorageHandler(sessionPath, "RecorderBooth", cfg.Samplerate, []int{256, 1024, 4096}, time.Second*10))
+
+	liveStream := storage.NewLiveStreamHandler("RecorderBooth")
+	manager.Add(liveStream)
+	hlsPath := "/tmp/hls"
+	hlsStorageHandler := storage.NewHLSStorageHandler(hlsPath, "RecorderBooth", time.Second*2, 6)
+	manager.Add(hlsStorageHandler)
+	apiToken := os.Getenv("RECORDER_API_TOKEN")
+	webSocketHandler := storage.NewWebSocketHandler(results)
+	webSocketHandler.SetPCMAccess(apiToken, nil)
+	manager.Add(webSocketHandler)
+
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/live.wav", liveStream)
+	httpMux.Handle("/live.ogg", liveStream)
+	httpMux.Handle("/hls/", http.StripPrefix("/hls/", hlsStorageHandler))
+	httpMux.Handle("/ws", webSocketHandler)
+	go func() {
+		if err := http.ListenAndServe(":8080", httpMux); err != nil {
+			fmt.Printf("Cannot start http server: %v\n", err)
+		}
+	}()
+
+	go func() {
+		for e := range manager.Events() {
+			if e.Type != storage.EventRecovered {
+				rss2.SetAlert(e.Type.String())
+			} else {
+				rss2.SetAlert("")
+			}
+		}
+	}()
+
+	usageCh := make(chan storage.Usage)
+	go func() {
+		for {
+			v := <-usageCh
+			rss2.SetStorage(v.Free, v.Total)
+			apiServer.SetUsage(v)
+		}
+	}()
+
+	gainCh := make(chan audio.GainChange, 8)
+	go func() {
+		for {
+			v := <-gainCh
+			fmt.Printf("%s\n", v.String())
+			rss2.SetGain(v.GainDB)
+			if session := manager.Session(); session != nil {
+				session.AddEvent("gain", v.Offset, v.GainDB)
+				if err := session.Save(sessionPath); err != nil {
+					fmt.Printf("Cannot save session: %v\n", err)
+				}
+			}
+		}
+	}()
+
+	// The session keeps the first clipping events with their position, the
+	// statistics count all of them
+	const maxSessionClippingEvents = 100
+	clippingSub := results.Subscribe(time.Second, audio.TopicClipping, audio.TopicClippingEvent)
+	go func() {
+		clippingSession, clippingEvents := "", 0
+		for r := range clippingSub.C() {
+			session := manager.Session()
+
+			if e, ok := r.Value.(audio.ClippingEvent); ok {
+				if session == nil {
+					continue
+				}
+				if session.ID() != clippingSession {
+					clippingSession, clippingEvents = session.ID(), 0
+				}
+				if clippingEvents < maxSessionClippingEvents {
+					session.AddEvent("clipping", e.Offset, e)
+					clippingEvents++
+				}
+				continue
+			}
+
+			v := r.Value.(audio.ClippingStatistics)
+			rss2.SetClipping(v.Events)
+			if session == nil {
+				continue
+			}
+			session.Set("clipping", v)
+			if err := session.Save(sessionPath); err != nil {
+				fmt.Printf("Cannot save session: %v\n", err)
+			}
+		}
+	}()
+
+	// Second indicator led next to the right level meter
+	beatLed := ui.NewLed(ui.LedGPIOMapping{Controller: gpioController4, GPIOIndex: 0, Invert: true})
+	beatSub := results.Subscribe(0, audio.TopicBeat)
+	go func() {
+		for range beatSub.C() {
+			beatLed.Set(true)
+			time.Sleep(time.Millisecond * 50)
+			beatLed.Set(false)
+		}
+	}()
+
+	tempoSub := results.Subscribe(0, audio.TopicTempo)
+	go func() {
+		lastBPM := 0.0
+		for r := range tempoSub.C() {
+			v := r.Value.(audio.TempoAnalyzerResult)
+			if v.Confidence < audio.DefaultTempoAnalyzerConfig().MinConfidence || math.Abs(v.BPM-lastBPM) < 2 {
+				continue
+			}
+			lastBPM = v.BPM
+
+			session := manager.Session()
+			if session == nil {
+				continue
+			}
+			session.Set("bpm", math.Round(v.BPM))
+			session.AddEvent("tempo", v.Offset, v.BPM)
+			if err := session.Save(sessionPath); err != nil {
+				fmt.Printf("Cannot save session: %v\n", err)
+			}
+		}
+	}()
+
+	// Storage gets the processed signal. The analyzers see the signal as
+	// recorded, the limiter would hide clipping and the dc blocker an offset.
+	processor := audio.NewProcessor(manager.InputChannel(), nil)
+	processor.SetInputTap(analyzer.InputChannel())
+	err = processor.Configure(cfg.Samplerate, []audio.ProcessorStageConfig{
+		{Type: audio.StageDCBlocker, Cutoff: 5},
+		{Type: audio.StageGain, GainDB: 0, Bypass: true},
+		{Type: audio.StageHighPass, Cutoff: 40, Bypass: true},
+		{Type: audio.StageNoiseGate, ThresholdDB: -60, Attack: time.Millisecond, Release: time.Millisecond * 200, Bypass: true},
+	})
+	if err != nil {
+		fmt.Printf("Error configuring processor: %v\n", err)
+	}
+
+	processor.Add("agc", audio.NewAGC(cfg.Samplerate, audio.DefaultAGCConfig(), gainCh))
+
+	err = processor.Configure(cfg.Samplerate, []audio.ProcessorStageConfig{
+		{Type: audio.StageLimiter, ThresholdDB: -1, Lookahead: time.Millisecond * 5, Release: time.Millisecond * 100},
+		{Type: audio.StageMono, Bypass: true},
+		{Type: audio.StageChannelSwap, Bypass: true},
+	})
+	if err != nil {
+		fmt.Printf("Error configuring processor: %v\n", err)
+	}
+
+	// Offsets and per session statistics start over with every session
+	manager.AddSessionListener(func(*storage.Session) {
+		processor.Reset()
+		analyzer.Reset()
+	})
+
+	recorder := audio.NewRecorder(recordDevice, cfg, nil, processor.InputChannel(), metricsCh)
+
+	storageDirs := []string{"/tmp/chunks", "/var/tmp/chunks", sessionPath, hlsPath}
+	apiServer = api.NewServer(api.ServerConfig{
+		RecorderID:  "RecorderBooth",
+		SessionPath: sessionPath,
+		Dirs:        storageDirs,
+		Recorder:    recorder,
+		Analyzer:    analyzer,
+		Results:     results,
+		Manager:     manager,
+		Tracker:     uploadTracker,
+		Token:       apiToken,
+	}, "/api/")
+	if apiToken == "" {
+		fmt.Printf("API: RECORDER_API_TOKEN is not set, the api is read only\n")
+	}
+	httpMux.Handle("/api/", apiServer)
+
+	storage.NewRetentionManager(storageDirs, "RecorderBooth", storage.RetentionPolicy{
+		MaxUsage: 8 << 30,
+		MinFree:  512 << 20,
+		MaxAge:   time.Hour * 24 * 30,
+		Interval: time.Minute,
+		// Sessions are uploaded by the http storage handler and kept
+		// until they are
+		RequireUpload: true,
+	}, manager, uploadTracker.IsUploaded, usageCh)
 
-	recorder := audio.NewRecorder(recordDevice, cfg, manager.InputChannel(), analyzer.InputChannel(), metricsCh)
 	err = recorder.Start()
 	if err != nil {
 		fmt.Printf("Error starting recorder: %v\n", err)
@@ -2,28 +2,77 @@ package storage
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// chunkRetries is the number of attempts to write a chunk into one path
+const chunkRetries = 2
+
+// chunkBacklog is the number of chunks kept in memory while no path is writable
+const chunkBacklog = 16
+
+// chunkFileName returns the name of a chunk, the last part is the time of writing, e.g.
+// domestic-recorder-booth_1613136001080749145_0000000000001149_1613137568493136160.raw
+func chunkFileName(recorderID, sessionID string, index int) string {
+	return fmt.Sprintf("%s_%s_%016d_%s.raw", recorderID, sessionID, index, strconv.FormatInt(time.Now().UTC().UnixNano(), 10))
+}
+
+// parseChunkFileName returns the session id and the index of a chunk name
+// created by chunkFileName
+func parseChunkFileName(recorderID, name string) (string, int, bool) {
+	prefix := recorderID + "_"
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".raw") {
+		return "", 0, false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, prefix), "_")
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], index, true
+}
+
+// sessionFileName returns the name of the audio of a whole session
+func sessionFileName(recorderID, sessionID string) string {
+	return fmt.Sprintf("%s_%s.raw", recorderID, sessionID)
+}
+
+type pendingChunk struct {
+	sessionID string
+	index     int
+	data      []byte
+}
+
 // ChunkStorageHandler can store chunks
 type ChunkStorageHandler struct {
 	stroagePath string
+	paths       []string
+	pathIndex   int
 	recorderID  string
 	chunkCount  int
 	chunkSize   int
 	chunkBuffer []byte
 	sessionID   string
+	pending     []pendingChunk
+	failing     bool
+	eventStream chan Event
 }
 
-// NewChunkStorageHandler factory
-func NewChunkStorageHandler(storagePath, recorderID string, chunkSize int) *ChunkStorageHandler {
+// NewChunkStorageHandler factory. If writing into storagePath fails, the
+// handler switches to the alternatePaths in the given order.
+func NewChunkStorageHandler(storagePath, recorderID string, chunkSize int, alternatePaths ...string) *ChunkStorageHandler {
 
 	ret := ChunkStorageHandler{
 		stroagePath: storagePath,
+		paths:       append([]string{storagePath}, alternatePaths...),
 		recorderID:  recorderID,
 		chunkCount:  0,
 		chunkSize:   chunkSize,
@@ -31,31 +80,139 @@ func NewChunkStorageHandler(storagePath, recorderID string, chunkSize int) *Chun
 		sessionID:   strconv.FormatInt(time.Now().UTC().UnixNano(), 10),
 	}
 
-	os.Mkdir(ret.stroagePath, 0777)
+	if err := os.MkdirAll(ret.stroagePath, 0777); err != nil {
+		fmt.Printf("Cannot create chunk directory %s: %v\n", ret.stroagePath, err)
+	}
+
 	return &ret
 }
 
+func (csh *ChunkStorageHandler) setEventStream(s chan Event) {
+	csh.eventStream = s
+}
+
+func (csh *ChunkStorageHandler) setSession(s *Session) {
+	csh.endSession()
+
+	csh.sessionID = s.ID()
+	csh.chunkCount = 0
+}
+
+// endSession stores what is left of the session
+func (csh *ChunkStorageHandler) endSession() {
+	if len(csh.chunkBuffer) > 0 {
+		csh.queue(csh.chunkBuffer)
+		csh.chunkBuffer = []byte{}
+		csh.flush()
+	}
+}
+
 func (csh *ChunkStorageHandler) store(b []byte) {
 
 	csh.chunkBuffer = append(csh.chunkBuffer, b...)
 
 	if len(csh.chunkBuffer) >= csh.chunkSize {
-		//domestic-recorder-booth_1613136001080749145_0000000000001149_1613137568493136160.raw
-		fileName := fmt.Sprintf("%s_%s_%016d_%s.raw", csh.recorderID, csh.sessionID, csh.chunkCount, strconv.FormatInt(time.Now().UTC().UnixNano(), 10))
+		csh.queue(csh.chunkBuffer[:csh.chunkSize])
+		csh.chunkBuffer = append([]byte{}, csh.chunkBuffer[csh.chunkSize:]...)
+		csh.flush()
+	}
+}
 
-		file, err := os.Create(path.Join(csh.stroagePath, fileName))
-		defer file.Close()
-		if err != nil {
-			log.Fatal(err)
+func (csh *ChunkStorageHandler) queue(data []byte) {
+
+	csh.pending = append(csh.pending, pendingChunk{
+		sessionID: csh.sessionID,
+		index:     csh.chunkCount,
+		data:      append([]byte{}, data...),
+	})
+	csh.chunkCount++
+
+	if len(csh.pending) > chunkBacklog {
+		dropped := csh.pending[0]
+		csh.pending = csh.pending[1:]
+		sendEvent(csh.eventStream, "ChunkStorageHandler", EventDataDropped, "Dropped chunk %d of session %s", dropped.index, dropped.sessionID)
+	}
+}
+
+// flush writes all pending chunks, switching paths on errors
+func (csh *ChunkStorageHandler) flush() {
+
+	for len(csh.pending) > 0 {
+		c := csh.pending[0]
+
+		if !csh.writeWithRetries(c) {
+			return
 		}
 
-		_, err = file.Write(b)
-		if err != nil {
-			log.Fatal(err)
+		csh.pending = csh.pending[1:]
+		if csh.failing {
+			csh.failing = false
+			sendEvent(csh.eventStream, "ChunkStorageHandler", EventRecovered, "Writing into %s", csh.paths[csh.pathIndex])
 		}
+	}
+}
 
-		csh.chunkBuffer = []byte{}
-		csh.chunkCount++
+func (csh *ChunkStorageHandler) writeWithRetries(c pendingChunk) bool {
+
+	for tried := 0; tried < len(csh.paths); tried++ {
+		dir := csh.paths[csh.pathIndex]
+
+		var err error
+		for i := 0; i < chunkRetries; i++ {
+			if err = csh.write(dir, c); err == nil {
+				return true
+			}
+		}
+
+		csh.failing = true
+		sendEvent(csh.eventStream, "ChunkStorageHandler", EventWriteError, "Cannot write chunk %d into %s: %v", c.index, dir, err)
+
+		if len(csh.paths) > 1 {
+			csh.pathIndex = (csh.pathIndex + 1) % len(csh.paths)
+			sendEvent(csh.eventStream, "ChunkStorageHandler", EventPathSwitched, "Switched to %s", csh.paths[csh.pathIndex])
+		}
+	}
+
+	return false
+}
+
+// write stores a chunk into dir. The data is written into a temporary file
+// which is synced and renamed, so there are never partial chunks.
+func (csh *ChunkStorageHandler) write(dir string, c pendingChunk) error {
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	filePath := path.Join(dir, chunkFileName(csh.recorderID, c.sessionID, c.index))
+
+	file, err := os.Create(filePath + ".part")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(c.data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath + ".part")
+		return err
+	}
+
+	if err = os.Rename(filePath+".part", filePath); err != nil {
+		os.Remove(filePath + ".part")
+		return err
+	}
+
+	// Make the rename durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
 	}
 
+	return nil
 }
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType describes what happened to a storage handler
+type EventType int
+
+const (
+	// EventWriteError means data could not be written
+	EventWriteError = EventType(iota)
+	// EventPathSwitched means a handler switched to another storage path
+	EventPathSwitched
+	// EventDataDropped means data was lost
+	EventDataDropped
+	// EventRecovered means a handler works again after an error
+	EventRecovered
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventWriteError:
+		return "write error"
+	case EventPathSwitched:
+		return "path switched"
+	case EventDataDropped:
+		return "data dropped"
+	case EventRecovered:
+		return "recovered"
+	}
+	return fmt.Sprintf("event %d", int(t))
+}
+
+// Event is reported by storage handlers
+type Event struct {
+	Handler string
+	Type    EventType
+	Message string
+	Time    time.Time
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s: %s: %s", e.Handler, e.Type, e.Message)
+}
+
+// eventReporter is implemented by handlers which report events
+type eventReporter interface {
+	setEventStream(chan Event)
+}
+
+// sendEvent hands an event to stream without blocking
+func sendEvent(stream chan Event, handler string, t EventType, format string, a ...interface{}) {
+
+	e := Event{
+		Handler: handler,
+		Type:    t,
+		Message: fmt.Sprintf(format, a...),
+		Time:    time.Now(),
+	}
+
+	fmt.Printf("%s\n", e.String())
+
+	if stream == nil {
+		return
+	}
+
+	select {
+	case stream <- e:
+	default:
+	}
+}
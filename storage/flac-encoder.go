@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// flacBlockSize is the number of samples per channel in one flac frame
+const flacBlockSize = 4096
+
+// flacMaxFixedOrder is the highest order of the fixed predictors
+const flacMaxFixedOrder = 4
+
+// flacMaxPartitionOrder limits the number of rice partitions to 2^4
+const flacMaxPartitionOrder = 4
+
+// bitWriter writes bit fields msb first
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) writeBits(v uint64, bits uint) {
+	for bits > 32 {
+		bits -= 32
+		w.writeBits(v>>bits, 32)
+	}
+	w.acc = w.acc<<bits | v&(1<<bits-1)
+	w.n += bits
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.n))
+	}
+}
+
+func (w *bitWriter) writeUnary(q uint64) {
+	for q >= 32 {
+		w.writeBits(0, 32)
+		q -= 32
+	}
+	w.writeBits(1, uint(q)+1)
+}
+
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.writeBits(0, 8-w.n)
+	}
+}
+
+func flacCRC8(data []byte) byte {
+	crc := byte(0)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func flacCRC16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+var flacSampleRateCodes = map[int]uint64{
+	88200:  0x1,
+	176400: 0x2,
+	192000: 0x3,
+	8000:   0x4,
+	16000:  0x5,
+	22050:  0x6,
+	24000:  0x7,
+	32000:  0x8,
+	44100:  0x9,
+	48000:  0xa,
+	96000:  0xb,
+}
+
+// flacEncoder encodes 16 bit pcm into flac frames. The frames use fixed
+// predictors and rice coding, which is cheap enough for live encoding.
+type flacEncoder struct {
+	format      AudioFormat
+	frameNumber uint64
+	samples     uint64
+	pending     []byte
+}
+
+func newFLACEncoder(format AudioFormat) (*flacEncoder, error) {
+	if format.BytesPerSample != 2 {
+		return nil, fmt.Errorf("Cannot encode flac: Unsupported sample format %s", format.SampleFormat)
+	}
+	if format.Channels < 1 || format.Channels > 8 {
+		return nil, fmt.Errorf("Cannot encode flac: Unsupported number of channels %d", format.Channels)
+	}
+	return &flacEncoder{format: format}, nil
+}
+
+// streamInfo returns the STREAMINFO metadata block without block header
+func (e *flacEncoder) streamInfo() []byte {
+	w := bitWriter{}
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(flacBlockSize, 16)
+	// Frame sizes and the number of samples are unknown for live streams
+	w.writeBits(0, 24)
+	w.writeBits(0, 24)
+	w.writeBits(uint64(e.format.Samplerate), 20)
+	w.writeBits(uint64(e.format.Channels-1), 3)
+	w.writeBits(15, 5)
+	w.writeBits(0, 36)
+	w.buf = append(w.buf, make([]byte, 16)...)
+	return w.buf
+}
+
+// flacMetadataBlock returns a metadata block with its header
+func flacMetadataBlock(blockType byte, last bool, data []byte) []byte {
+	header := []byte{blockType, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}
+	if last {
+		header[0] |= 0x80
+	}
+	return append(header, data...)
+}
+
+// vorbisComment returns a VORBIS_COMMENT metadata block body
+func vorbisComment(comments map[string]string) []byte {
+	vendor := "recorder-booth"
+	ret := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(ret, uint32(len(vendor)))
+	ret = append(ret, vendor...)
+
+	n := make([]byte, 4)
+	binary.LittleEndian.PutUint32(n, uint32(len(comments)))
+	ret = append(ret, n...)
+
+	for k, v := range comments {
+		c := k + "=" + v
+		binary.LittleEndian.PutUint32(n, uint32(len(c)))
+		ret = append(ret, n...)
+		ret = append(ret, c...)
+	}
+	return ret
+}
+
+// encode returns the frames for all complete blocks in pcm
+func (e *flacEncoder) encode(pcm []byte) [][]byte {
+
+	e.pending = append(e.pending, pcm...)
+	blockBytes := flacBlockSize * e.format.BytesPerFrame()
+
+	frames := [][]byte{}
+	for len(e.pending) >= blockBytes {
+		frames = append(frames, e.encodeFrame(e.pending[:blockBytes]))
+		e.pending = e.pending[blockBytes:]
+	}
+	e.pending = append([]byte{}, e.pending...)
+
+	return frames
+}
+
+// flush encodes what is left into a shorter frame
+func (e *flacEncoder) flush() [][]byte {
+	n := len(e.pending) / e.format.BytesPerFrame() * e.format.BytesPerFrame()
+	if n == 0 {
+		return nil
+	}
+	frame := e.encodeFrame(e.pending[:n])
+	e.pending = nil
+	return [][]byte{frame}
+}
+
+func (e *flacEncoder) encodeFrame(pcm []byte) []byte {
+
+	channels := e.format.Channels
+	blockSize := len(pcm) / e.format.BytesPerFrame()
+
+	w := bitWriter{}
+	w.writeBits(0x3ffe, 14)
+	w.writeBits(0, 1)
+	w.writeBits(0, 1)
+	if blockSize == flacBlockSize {
+		w.writeBits(0xc, 4)
+	} else {
+		w.writeBits(0x7, 4)
+	}
+	// Unusual rates are only in the stream info (code 0)
+	w.writeBits(flacSampleRateCodes[e.format.Samplerate], 4)
+	w.writeBits(uint64(channels-1), 4)
+	w.writeBits(0x4, 3)
+	w.writeBits(0, 1)
+	writeUTF8Number(&w, e.frameNumber)
+	if blockSize != flacBlockSize {
+		w.writeBits(uint64(blockSize-1), 16)
+	}
+	w.writeBits(uint64(flacCRC8(w.buf)), 8)
+
+	samples := make([]int32, blockSize)
+	for c := 0; c < channels; c++ {
+		for i := range samples {
+			offset := (i*channels + c) * 2
+			samples[i] = int32(int16(binary.LittleEndian.Uint16(pcm[offset:])))
+		}
+		writeSubframe(&w, samples)
+	}
+
+	w.align()
+	crc := flacCRC16(w.buf)
+	w.writeBits(uint64(crc), 16)
+
+	e.frameNumber++
+	e.samples += uint64(blockSize)
+
+	return w.buf
+}
+
+func writeUTF8Number(w *bitWriter, v uint64) {
+	if v < 0x80 {
+		w.writeBits(v, 8)
+		return
+	}
+
+	// Number of continuation bytes
+	n := uint(1)
+	for v >= 1<<(5*n+6) {
+		n++
+	}
+
+	lead := uint64(0xff<<(7-n)) & 0xff
+	w.writeBits(lead|v>>(6*n), 8)
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBits(0x80|(v>>(6*uint(i)))&0x3f, 8)
+	}
+}
+
+// fixedResidual returns the residual of the fixed predictor of order
+func fixedResidual(x []int32, order int) []int32 {
+	r := make([]int32, len(x)-order)
+	for i := order; i < len(x); i++ {
+		var p int32
+		switch order {
+		case 1:
+			p = x[i-1]
+		case 2:
+			p = 2*x[i-1] - x[i-2]
+		case 3:
+			p = 3*x[i-1] - 3*x[i-2] + x[i-3]
+		case 4:
+			p = 4*x[i-1] - 6*x[i-2] + 4*x[i-3] - x[i-4]
+		}
+		r[i-order] = x[i] - p
+	}
+	return r
+}
+
+func zigzag(v int32) uint64 {
+	return uint64(uint32(v<<1) ^ uint32(v>>31))
+}
+
+// riceParameter returns the best rice parameter for values and the number of bits
+func riceParameter(values []int32) (uint, uint64) {
+
+	sum := uint64(0)
+	for _, v := range values {
+		sum += zigzag(v)
+	}
+
+	// The best parameter is close to log2 of the mean
+	guess := uint(0)
+	if n := uint64(len(values)); n > 0 {
+		for mean := sum / n; mean > 1; mean >>= 1 {
+			guess++
+		}
+	}
+
+	if guess > 14 {
+		guess = 14
+	}
+
+	first := guess
+	if first > 0 {
+		first--
+	}
+
+	bestK, bestBits := uint(0), ^uint64(0)
+	for k := first; k <= guess+1 && k < 15; k++ {
+		bits := uint64(len(values)) * uint64(k+1)
+		for _, v := range values {
+			bits += zigzag(v) >> k
+		}
+		if bits < bestBits {
+			bestK, bestBits = k, bits
+		}
+	}
+
+	return bestK, bestBits
+}
+
+type riceCoding struct {
+	order  uint
+	params []uint
+	bits   uint64
+}
+
+// bestPartitioning finds the partition order with the fewest bits for a residual
+func bestPartitioning(residual []int32, blockSize, predictorOrder int) riceCoding {
+
+	best := riceCoding{bits: ^uint64(0)}
+
+	for order := uint(0); order <= flacMaxPartitionOrder; order++ {
+		partitions := 1 << order
+		if blockSize%partitions != 0 || blockSize>>order <= predictorOrder {
+			break
+		}
+
+		coding := riceCoding{order: order}
+		start := 0
+		for p := 0; p < partitions; p++ {
+			n := blockSize >> order
+			if p == 0 {
+				n -= predictorOrder
+			}
+			k, bits := riceParameter(residual[start : start+n])
+			coding.params = append(coding.params, k)
+			coding.bits += bits + 4
+			start += n
+		}
+
+		if coding.bits < best.bits {
+			best = coding
+		}
+	}
+
+	return best
+}
+
+func writeSubframe(w *bitWriter, x []int32) {
+
+	blockSize := len(x)
+
+	// Silence and dc are sent as one value
+	constant := true
+	for _, v := range x[1:] {
+		if v != x[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w.writeBits(0, 1)
+		w.writeBits(0x00, 6)
+		w.writeBits(0, 1)
+		w.writeBits(uint64(uint16(x[0])), 16)
+		return
+	}
+
+	bestOrder := -1
+	var bestCoding riceCoding
+	var bestResidual []int32
+	bestBits := uint64(blockSize) * 16
+
+	for order := 0; order <= flacMaxFixedOrder && order < blockSize; order++ {
+		residual := fixedResidual(x, order)
+		coding := bestPartitioning(residual, blockSize, order)
+		if coding.params == nil {
+			continue
+		}
+		bits := uint64(order)*16 + 6 + coding.bits
+		if bits < bestBits {
+			bestOrder, bestCoding, bestResidual, bestBits = order, coding, residual, bits
+		}
+	}
+
+	// Header: padding, type, no wasted bits
+	w.writeBits(0, 1)
+	if bestOrder < 0 {
+		w.writeBits(0x01, 6)
+		w.writeBits(0, 1)
+		for _, v := range x {
+			w.writeBits(uint64(uint16(v)), 16)
+		}
+		return
+	}
+
+	w.writeBits(0x08|uint64(bestOrder), 6)
+	w.writeBits(0, 1)
+
+	for _, v := range x[:bestOrder] {
+		w.writeBits(uint64(uint16(v)), 16)
+	}
+
+	w.writeBits(0, 2)
+	w.writeBits(uint64(bestCoding.order), 4)
+
+	start := 0
+	for p, k := range bestCoding.params {
+		n := blockSize >> bestCoding.order
+		if p == 0 {
+			n -= bestOrder
+		}
+		w.writeBits(uint64(k), 4)
+		for _, v := range bestResidual[start : start+n] {
+			u := zigzag(v)
+			w.writeUnary(u >> k)
+			w.writeBits(u, k)
+		}
+		start += n
+	}
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The check values of the CRC catalogue for "123456789"
+func TestFLACCRC(t *testing.T) {
+	data := []byte("123456789")
+
+	if crc := flacCRC8(data); crc != 0xf4 {
+		t.Errorf("flacCRC8 = %#02x, want 0xf4", crc)
+	}
+	if crc := flacCRC16(data); crc != 0xfee8 {
+		t.Errorf("flacCRC16 = %#04x, want 0xfee8", crc)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint
+}
+
+func (r *bitReader) readBits(bits uint) (uint64, error) {
+	v := uint64(0)
+	for i := uint(0); i < bits; i++ {
+		if r.pos/8 >= uint(len(r.buf)) {
+			return 0, fmt.Errorf("Unexpected end of frame")
+		}
+		bit := r.buf[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) readUnary() (uint64, error) {
+	q := uint64(0)
+	for {
+		bit, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			return q, nil
+		}
+		q++
+	}
+}
+
+func (r *bitReader) readSigned(bits uint) (int32, error) {
+	v, err := r.readBits(bits)
+	if err != nil {
+		return 0, err
+	}
+	return int32(int64(v<<(64-bits)) >> (64 - bits)), nil
+}
+
+// decodeFLACFrame decodes a frame of 16 bit samples as written by the
+// encoder and returns the interleaved samples
+func decodeFLACFrame(frame []byte, format AudioFormat, frameNumber uint64) ([]int16, error) {
+
+	if len(frame) < 2 || flacCRC16(frame[:len(frame)-2]) != binary.BigEndian.Uint16(frame[len(frame)-2:]) {
+		return nil, fmt.Errorf("CRC-16 mismatch")
+	}
+
+	r := &bitReader{buf: frame}
+	if sync, _ := r.readBits(14); sync != 0x3ffe {
+		return nil, fmt.Errorf("Sync code %#x", sync)
+	}
+	r.readBits(2)
+	blockSizeCode, _ := r.readBits(4)
+	rateCode, _ := r.readBits(4)
+	channelCode, _ := r.readBits(4)
+	sizeCode, _ := r.readBits(3)
+	r.readBits(1)
+
+	if rateCode != flacSampleRateCodes[format.Samplerate] {
+		return nil, fmt.Errorf("Sample rate code %d", rateCode)
+	}
+	if int(channelCode) != format.Channels-1 || sizeCode != 0x4 {
+		return nil, fmt.Errorf("Channels %d, sample size %d", channelCode, sizeCode)
+	}
+
+	// UTF-8 coded frame number
+	first, _ := r.readBits(8)
+	number := first
+	if first >= 0x80 {
+		n := uint(0)
+		for first<<(n+1)&0x80 != 0 {
+			n++
+		}
+		number = first & (0x3f >> n)
+		for i := uint(0); i < n; i++ {
+			b, _ := r.readBits(8)
+			number = number<<6 | b&0x3f
+		}
+	}
+	if number != frameNumber {
+		return nil, fmt.Errorf("Frame number %d, want %d", number, frameNumber)
+	}
+
+	blockSize := flacBlockSize
+	switch blockSizeCode {
+	case 0xc:
+	case 0x7:
+		v, _ := r.readBits(16)
+		blockSize = int(v) + 1
+	default:
+		return nil, fmt.Errorf("Block size code %#x", blockSizeCode)
+	}
+
+	headerCRC, err := r.readBits(8)
+	if err != nil || byte(headerCRC) != flacCRC8(frame[:r.pos/8-1]) {
+		return nil, fmt.Errorf("CRC-8 mismatch")
+	}
+
+	channels := make([][]int32, format.Channels)
+	for c := range channels {
+		if channels[c], err = decodeSubframe(r, blockSize); err != nil {
+			return nil, fmt.Errorf("Channel %d: %v", c, err)
+		}
+	}
+
+	// Padding up to the byte boundary, then the CRC-16
+	if (r.pos+7)/8 != uint(len(frame)-2) {
+		return nil, fmt.Errorf("%d bytes left after the subframes", len(frame)-2-int((r.pos+7)/8))
+	}
+
+	ret := make([]int16, 0, blockSize*format.Channels)
+	for i := 0; i < blockSize; i++ {
+		for c := range channels {
+			ret = append(ret, int16(channels[c][i]))
+		}
+	}
+	return ret, nil
+}
+
+func decodeSubframe(r *bitReader, blockSize int) ([]int32, error) {
+
+	header, err := r.readBits(8)
+	if err != nil {
+		return nil, err
+	}
+	if header&0x81 != 0 {
+		return nil, fmt.Errorf("Padding or wasted bits set")
+	}
+
+	x := make([]int32, blockSize)
+	kind := header >> 1
+
+	switch {
+	case kind == 0x00:
+		v, err := r.readSigned(16)
+		if err != nil {
+			return nil, err
+		}
+		for i := range x {
+			x[i] = v
+		}
+		return x, nil
+
+	case kind == 0x01:
+		for i := range x {
+			if x[i], err = r.readSigned(16); err != nil {
+				return nil, err
+			}
+		}
+		return x, nil
+
+	case kind&0x38 == 0x08 && kind&0x07 <= 4:
+		order := int(kind & 0x07)
+		for i := 0; i < order; i++ {
+			if x[i], err = r.readSigned(16); err != nil {
+				return nil, err
+			}
+		}
+
+		method, _ := r.readBits(2)
+		partitionOrder, err := r.readBits(4)
+		if err != nil || method != 0 {
+			return nil, fmt.Errorf("Residual coding method %d", method)
+		}
+
+		residual := make([]int32, 0, blockSize-order)
+		for p := 0; p < 1<<partitionOrder; p++ {
+			k, err := r.readBits(4)
+			if err != nil || k == 0xf {
+				return nil, fmt.Errorf("Escaped partition")
+			}
+			n := blockSize >> partitionOrder
+			if p == 0 {
+				n -= order
+			}
+			for i := 0; i < n; i++ {
+				q, err := r.readUnary()
+				if err != nil {
+					return nil, err
+				}
+				low, err := r.readBits(uint(k))
+				if err != nil {
+					return nil, err
+				}
+				u := q<<k | low
+				residual = append(residual, int32(u>>1)^-int32(u&1))
+			}
+		}
+
+		coefficients := [][]int32{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}[order]
+		for i := order; i < blockSize; i++ {
+			p := int32(0)
+			for j, c := range coefficients {
+				p += c * x[i-1-j]
+			}
+			x[i] = p + residual[i-order]
+		}
+		return x, nil
+	}
+
+	return nil, fmt.Errorf("Subframe type %#x", kind)
+}
+
+// testSignal returns pcm which makes the encoder use every subframe type:
+// silence, a sine with noise, a dc offset and full scale noise
+func testSignal(format AudioFormat, frames int) []byte {
+
+	random := rand.New(rand.NewSource(1))
+	pcm := make([]byte, frames*format.BytesPerFrame())
+
+	for i := 0; i < frames; i++ {
+		for c := 0; c < format.Channels; c++ {
+			var v int16
+			switch {
+			case i < flacBlockSize:
+			case i < 2*flacBlockSize:
+				v = int16(12000*math.Sin(float64(i)*float64(c+1)*0.01) + random.NormFloat64()*50)
+			case i < 3*flacBlockSize && c == 0:
+				v = -1234
+			default:
+				v = int16(random.Intn(65536) - 32768)
+			}
+			binary.LittleEndian.PutUint16(pcm[(i*format.Channels+c)*2:], uint16(v))
+		}
+	}
+	return pcm
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+
+	format := DefaultAudioFormat
+	pcm := testSignal(format, 4*flacBlockSize+1000)
+
+	e, err := newFLACEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Odd write sizes, the encoder collects whole blocks
+	frames := [][]byte{}
+	for rest := pcm; len(rest) > 0; {
+		n := 3001 * 4
+		if n > len(rest) {
+			n = len(rest)
+		}
+		frames = append(frames, e.encode(rest[:n])...)
+		rest = rest[n:]
+	}
+	frames = append(frames, e.flush()...)
+
+	if len(frames) != 5 {
+		t.Fatalf("%d frames, want 5", len(frames))
+	}
+
+	decoded := []byte{}
+	for n, frame := range frames {
+		samples, err := decodeFLACFrame(frame, format, uint64(n))
+		if err != nil {
+			t.Fatalf("Frame %d: %v", n, err)
+		}
+		for _, v := range samples {
+			decoded = append(decoded, byte(v), byte(uint16(v)>>8))
+		}
+	}
+
+	if len(decoded) != len(pcm) {
+		t.Fatalf("Decoded %d bytes, want %d", len(decoded), len(pcm))
+	}
+	for i := range pcm {
+		if decoded[i] != pcm[i] {
+			t.Fatalf("Decoded pcm differs at byte %d", i)
+		}
+	}
+
+	if e.samples != uint64(4*flacBlockSize+1000) {
+		t.Errorf("Encoder counted %d samples", e.samples)
+	}
+}
+
+func TestWriteUTF8Number(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want []byte
+	}{
+		{0x00, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0xc2, 0x80}},
+		{0x7ff, []byte{0xdf, 0xbf}},
+		{0x800, []byte{0xe0, 0xa0, 0x80}},
+		{0xffff, []byte{0xef, 0xbf, 0xbf}},
+		{0x10000, []byte{0xf0, 0x90, 0x80, 0x80}},
+	}
+
+	for _, test := range tests {
+		w := bitWriter{}
+		writeUTF8Number(&w, test.v)
+		if string(w.buf) != string(test.want) {
+			t.Errorf("writeUTF8Number(%#x) = % x, want % x", test.v, w.buf, test.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+// AudioFormat describes the raw audio handed to storage handlers
+type AudioFormat struct {
+	Samplerate     int
+	Channels       int
+	SampleFormat   string
+	BytesPerSample int
+}
+
+// BytesPerFrame returns the size of one frame in bytes
+func (f AudioFormat) BytesPerFrame() int {
+	return f.Channels * f.BytesPerSample
+}
+
+// DefaultAudioFormat is the format the recorder delivers
+var DefaultAudioFormat = AudioFormat{
+	Samplerate:     48000,
+	Channels:       2,
+	SampleFormat:   "S16_LE",
+	BytesPerSample: 2,
+}
+
+// formatHandler is implemented by handlers which need to know the audio format
+type formatHandler interface {
+	setFormat(AudioFormat)
+}
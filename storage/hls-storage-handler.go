@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// HLSLivePlaylist is the name of the sliding window playlist of the handler
+const HLSLivePlaylist = "live.m3u8"
+
+type hlsSegment struct {
+	uri      string
+	initURI  string
+	duration float64
+	// discontinuity is set on the first segment of a session, when the
+	// live playlist already holds segments of the previous one
+	discontinuity bool
+}
+
+// HLSStorageHandler writes HLS segments for browser playback. Audio is
+// encoded to flac in fragmented mp4. Every session gets its own playlist,
+// which is complete (VOD) once the session is finished. The live playlist
+// is a sliding window across sessions.
+type HLSStorageHandler struct {
+	storagePath   string
+	recorderID    string
+	format        AudioFormat
+	segmentLength time.Duration
+	liveWindow    int
+
+	sessionID  string
+	encoder    *flacEncoder
+	frames     [][]byte
+	durations  []uint32
+	decodeTime uint64
+	sequence   uint32
+	segments   []hlsSegment
+
+	live                  []hlsSegment
+	mediaSequence         int
+	discontinuitySequence int
+}
+
+// NewHLSStorageHandler factory. Segments are about segmentLength long, the
+// live playlist holds the last liveWindow segments.
+func NewHLSStorageHandler(storagePath, recorderID string, segmentLength time.Duration, liveWindow int) *HLSStorageHandler {
+	return &HLSStorageHandler{
+		storagePath:   storagePath,
+		recorderID:    recorderID,
+		format:        DefaultAudioFormat,
+		segmentLength: segmentLength,
+		liveWindow:    liveWindow,
+	}
+}
+
+// HLSPlaylistFileName returns the name of the playlist of a session
+func HLSPlaylistFileName(recorderID, sessionID string) string {
+	return fmt.Sprintf("%s_%s.m3u8", recorderID, sessionID)
+}
+
+func (hsh *HLSStorageHandler) setFormat(f AudioFormat) {
+	hsh.format = f
+}
+
+func (hsh *HLSStorageHandler) endSession() {
+	hsh.finish()
+	hsh.sessionID = ""
+}
+
+func (hsh *HLSStorageHandler) setSession(s *Session) {
+	hsh.finish()
+
+	hsh.sessionID = s.ID()
+	hsh.encoder = nil
+	hsh.frames = nil
+	hsh.durations = nil
+	hsh.decodeTime = 0
+	hsh.sequence = 0
+	hsh.segments = nil
+}
+
+func (hsh *HLSStorageHandler) store(b []byte) {
+	if hsh.sessionID == "" {
+		return
+	}
+
+	if hsh.encoder == nil {
+		if err := hsh.start(); err != nil {
+			fmt.Printf("Cannot start hls session: %v\n", err)
+			hsh.sessionID = ""
+			return
+		}
+	}
+
+	for _, f := range hsh.encoder.encode(b) {
+		hsh.frames = append(hsh.frames, f)
+		hsh.durations = append(hsh.durations, flacBlockSize)
+	}
+
+	if len(hsh.frames) >= hsh.segmentFrames() {
+		hsh.writeSegment()
+	}
+}
+
+// segmentFrames returns the number of flac frames in one segment
+func (hsh *HLSStorageHandler) segmentFrames() int {
+	n := int(math.Round(hsh.segmentLength.Seconds() * float64(hsh.format.Samplerate) / flacBlockSize))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func (hsh *HLSStorageHandler) targetDuration() int {
+	return int(math.Ceil(float64(hsh.segmentFrames()*flacBlockSize) / float64(hsh.format.Samplerate)))
+}
+
+func (hsh *HLSStorageHandler) fileName(suffix string) string {
+	return fmt.Sprintf("%s_%s_%s", hsh.recorderID, hsh.sessionID, suffix)
+}
+
+func (hsh *HLSStorageHandler) start() error {
+	encoder, err := newFLACEncoder(hsh.format)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(hsh.storagePath, 0777); err != nil {
+		return fmt.Errorf("Cannot create hls directory: %v", err)
+	}
+
+	init := mp4InitSegment(hsh.format, encoder.streamInfo())
+	if err := hsh.writeFile(hsh.fileName("init.mp4"), init); err != nil {
+		return err
+	}
+
+	hsh.encoder = encoder
+	return nil
+}
+
+// finish writes what is left of the current session and completes its playlist
+func (hsh *HLSStorageHandler) finish() {
+	if hsh.encoder == nil {
+		return
+	}
+
+	for _, f := range hsh.encoder.flush() {
+		hsh.frames = append(hsh.frames, f)
+		hsh.durations = append(hsh.durations, uint32(hsh.encoder.samples-hsh.decodeTime-hsh.pendingSamples()))
+	}
+	if len(hsh.frames) > 0 {
+		hsh.writeSegment()
+	}
+
+	playlist := hlsPlaylist(hsh.segments, hsh.targetDuration(), 0, 0, "VOD", true)
+	if err := hsh.writeFile(HLSPlaylistFileName(hsh.recorderID, hsh.sessionID), playlist); err != nil {
+		fmt.Printf("Cannot write hls playlist: %v\n", err)
+	}
+
+	hsh.encoder = nil
+}
+
+func (hsh *HLSStorageHandler) pendingSamples() uint64 {
+	ret := uint64(0)
+	for _, d := range hsh.durations {
+		ret += uint64(d)
+	}
+	return ret
+}
+
+func (hsh *HLSStorageHandler) writeSegment() {
+
+	samples := hsh.pendingSamples()
+	segment := hlsSegment{
+		uri:      hsh.fileName(fmt.Sprintf("%06d.m4s", hsh.sequence)),
+		initURI:  hsh.fileName("init.mp4"),
+		duration: float64(samples) / float64(hsh.format.Samplerate),
+	}
+
+	data := mp4Fragment(hsh.sequence+1, hsh.decodeTime, hsh.frames, hsh.durations)
+
+	hsh.sequence++
+	hsh.decodeTime += samples
+	hsh.frames = nil
+	hsh.durations = nil
+
+	if err := hsh.writeFile(segment.uri, data); err != nil {
+		fmt.Printf("Cannot write hls segment: %v\n", err)
+		return
+	}
+
+	hsh.segments = append(hsh.segments, segment)
+
+	segment.discontinuity = len(hsh.segments) == 1 && hsh.mediaSequence+len(hsh.live) > 0
+	hsh.live = append(hsh.live, segment)
+	for len(hsh.live) > hsh.liveWindow {
+		if hsh.live[0].discontinuity {
+			hsh.discontinuitySequence++
+		}
+		hsh.live = hsh.live[1:]
+		hsh.mediaSequence++
+	}
+
+	// The session playlist grows while recording, so players can seek back
+	playlist := hlsPlaylist(hsh.segments, hsh.targetDuration(), 0, 0, "EVENT", false)
+	if err := hsh.writeFile(HLSPlaylistFileName(hsh.recorderID, hsh.sessionID), playlist); err != nil {
+		fmt.Printf("Cannot write hls playlist: %v\n", err)
+	}
+
+	playlist = hlsPlaylist(hsh.live, hsh.targetDuration(), hsh.mediaSequence, hsh.discontinuitySequence, "", false)
+	if err := hsh.writeFile(HLSLivePlaylist, playlist); err != nil {
+		fmt.Printf("Cannot write hls playlist: %v\n", err)
+	}
+}
+
+// writeFile replaces a file atomically, so the web server never delivers
+// partial playlists or segments
+func (hsh *HLSStorageHandler) writeFile(name string, data []byte) error {
+	fileName := path.Join(hsh.storagePath, name)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func hlsPlaylist(segments []hlsSegment, targetDuration, mediaSequence, discontinuitySequence int, playlistType string, ended bool) []byte {
+
+	var p strings.Builder
+	fmt.Fprintf(&p, "#EXTM3U\n")
+	fmt.Fprintf(&p, "#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&p, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&p, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	if discontinuitySequence > 0 {
+		fmt.Fprintf(&p, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence)
+	}
+	if playlistType != "" {
+		fmt.Fprintf(&p, "#EXT-X-PLAYLIST-TYPE:%s\n", playlistType)
+	}
+	fmt.Fprintf(&p, "#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	initURI := ""
+	for _, s := range segments {
+		if s.discontinuity {
+			fmt.Fprintf(&p, "#EXT-X-DISCONTINUITY\n")
+		}
+		if s.initURI != initURI {
+			fmt.Fprintf(&p, "#EXT-X-MAP:URI=\"%s\"\n", s.initURI)
+			initURI = s.initURI
+		}
+		fmt.Fprintf(&p, "#EXTINF:%.5f,\n%s\n", s.duration, s.uri)
+	}
+
+	if ended {
+		fmt.Fprintf(&p, "#EXT-X-ENDLIST\n")
+	}
+	return []byte(p.String())
+}
+
+func (hsh *HLSStorageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	switch path.Ext(r.URL.Path) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".mp4":
+		w.Header().Set("Content-Type", "audio/mp4")
+	case ".m4s":
+		w.Header().Set("Content-Type", "audio/iso.segment")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	http.FileServer(http.Dir(hsh.storagePath)).ServeHTTP(w, r)
+}
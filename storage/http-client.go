@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPClientConfig describes how uploads connect and authenticate to a server
+type HTTPClientConfig struct {
+	// CAFile is a PEM file with the certificate authorities the server
+	// certificate is checked against. The system roots are used if empty.
+	CAFile string
+	// CertFile and KeyFile are PEM files of the client certificate
+	CertFile string
+	KeyFile  string
+	// BearerToken is sent in the Authorization header if not empty
+	BearerToken string
+	// HMACKey signs every request if not empty, HMACKeyID tells the
+	// server which key was used
+	HMACKey   string
+	HMACKeyID string
+	// Timeout limits a whole request including the upload of the body
+	Timeout time.Duration
+	// IdleTimeout replaces Timeout for uploads of whole sessions, which
+	// take long. It limits the time the upload of the body may stall.
+	IdleTimeout time.Duration
+}
+
+// DefaultHTTPClientConfig returns a config without authentication
+func DefaultHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		Timeout:     time.Second * 30,
+		IdleTimeout: time.Second * 30,
+	}
+}
+
+// newHTTPClient creates a client which keeps connections alive between uploads
+func newHTTPClient(config HTTPClientConfig) (*http.Client, error) {
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Cannot parse CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Second * 10,
+			KeepAlive: time.Second * 30,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 30,
+		IdleConnTimeout:       time.Second * 90,
+		MaxIdleConnsPerHost:   2,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}, nil
+}
+
+// authorize adds the credentials of config to req. body is the complete
+// request body, it is needed for the signature.
+func (config *HTTPClientConfig) authorize(req *http.Request, body []byte) {
+
+	if config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+	}
+
+	if config.HMACKey == "" {
+		return
+	}
+
+	// The signature covers method, path, time and body, so a request can
+	// neither be altered nor replayed later
+	timestamp := strconv.FormatInt(time.Now().UTC().Unix(), 10)
+	bodySum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(config.HMACKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	if config.HMACKeyID != "" {
+		req.Header.Set("X-Key-Id", config.HMACKeyID)
+	}
+}
+
+// idleReader restarts a timer with every read until the end of the body
+type idleReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == nil {
+		r.timer.Reset(r.timeout)
+	} else {
+		r.timer.Stop()
+	}
+	return n, err
+}
+
+// withIdleTimeout cancels req when its body is not read for timeout, so a
+// stalled upload fails while a long one goes on. The client must not have
+// a Timeout. Waiting for the response is limited by the transport. The
+// returned function has to be called when the response is read.
+func withIdleTimeout(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	if req.Body == nil || timeout <= 0 {
+		return req, cancel
+	}
+
+	timer := time.AfterFunc(timeout, cancel)
+	req.Body = &idleReader{ReadCloser: req.Body, timer: timer, timeout: timeout}
+
+	return req, func() {
+		timer.Stop()
+		cancel()
+	}
+}
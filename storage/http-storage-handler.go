@@ -2,94 +2,292 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math"
+	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
 )
 
-// HTTPStorageHandler can upload chungs with http post
+// uploadQueueSize is the number of chunks waiting for upload before chunks are dropped
+const uploadQueueSize = 64
+
+// chunkUpload describes a chunk and where it belongs in its session
+type chunkUpload struct {
+	session    *Session
+	sessionID  string
+	index      int
+	byteOffset int64
+	data       []byte
+	checksum   string
+}
+
+// uploadReceipt is the optional answer of the server to an upload. A server
+// confirms what it stored by answering with a JSON body like
+//
+//	{"sha256": "<hex of the chunk>", "byteOffset": 0, "length": 262144, "nextOffset": 262144}
+//
+// where byteOffset and length echo the form fields of the chunk and
+// nextOffset, if given, is the offset the server expects next. Servers
+// which answer any 2xx without a body are accepted unless receipts are
+// required with SetRequireReceipt.
+type uploadReceipt struct {
+	SHA256     string `json:"sha256"`
+	ByteOffset *int64 `json:"byteOffset"`
+	Length     *int64 `json:"length"`
+	NextOffset *int64 `json:"nextOffset"`
+}
+
+// HTTPStorageHandler can upload chungs with http post. Chunks are queued,
+// retried and spooled like the files of the other remote handlers. The
+// metadata of a session is sent with every chunk while it is known, chunks
+// written from the spool after a restart come without.
 type HTTPStorageHandler struct {
+	*remoteUploader
 	server     string
 	recorderID string
-	sessionID  string
-	chunkCount int
 	chunkSize  int
-	buffer     bytes.Buffer
+	mutex      sync.Mutex
+	format     AudioFormat
+	client     *http.Client
+	config     HTTPClientConfig
+	// sessions are the sessions with chunks to upload by id
+	sessions map[string]*Session
+	// requireReceipt fails uploads the server does not confirm
+	requireReceipt bool
 }
 
-// NewHTTPStorageHandler factory
-func NewHTTPStorageHandler(server, recoderID string, chunkSize int) *HTTPStorageHandler {
+// NewHTTPStorageHandler factory. chunkSize has to be greater than 0, chunks
+// which cannot be uploaded are kept in spoolDir/HTTPStorageHandler.
+func NewHTTPStorageHandler(server, recoderID string, chunkSize int, spoolDir string) *HTTPStorageHandler {
+
+	config := DefaultHTTPClientConfig()
+	client, _ := newHTTPClient(config)
 
 	ret := &HTTPStorageHandler{
 		server:     server,
 		recorderID: recoderID,
-		sessionID:  strconv.FormatInt(time.Now().UTC().UnixNano(), 10),
-		chunkCount: 0,
 		chunkSize:  chunkSize,
-		buffer:     bytes.Buffer{},
+		format:     DefaultAudioFormat,
+		client:     client,
+		config:     config,
+		sessions:   map[string]*Session{},
 	}
 
+	// Uploads run in the background and in order, so a slow server does not
+	// hold up recording and the server sees the chunks in sequence
+	ret.remoteUploader = newRemoteUploader("HTTPStorageHandler", recoderID, chunkSize, spoolDir, ret)
+
 	return ret
 }
 
-func (hus *HTTPStorageHandler) store(b []byte) {
+// SetRequireReceipt makes uploads fail unless the server answers with a
+// receipt, see uploadReceipt
+func (hus *HTTPStorageHandler) SetRequireReceipt(required bool) {
+	hus.mutex.Lock()
+	defer hus.mutex.Unlock()
+	hus.requireReceipt = required
+}
+
+// SetClientConfig sets up TLS, authentication and timeouts for all
+// following uploads
+func (hus *HTTPStorageHandler) SetClientConfig(config HTTPClientConfig) error {
 
-	n, err := hus.buffer.Write(b)
-	if err != nil || n != len(b) {
-		fmt.Printf("ERROR 1: %v n=%d\n", err, n)
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return fmt.Errorf("Cannot configure http storage handler: %v", err)
 	}
 
-	if hus.buffer.Len() >= hus.chunkSize {
+	hus.mutex.Lock()
+	defer hus.mutex.Unlock()
+	hus.client = client
+	hus.config = config
 
-		r := 0
-		var toSend []byte
-		for i := hus.chunkSize; i != 0; i -= r {
-			toSend = make([]byte, int(math.Min(float64(i), float64(hus.chunkSize))))
+	return nil
+}
 
-			r, err = hus.buffer.Read(toSend)
-			if err != nil {
-				fmt.Printf("Cannot read from byte buffer: %v  len(toSend)=%d hus.buffer.Len=%d\n", err, len(toSend), hus.buffer.Len())
-			}
-		}
+func (hus *HTTPStorageHandler) setFormat(f AudioFormat) {
+	hus.mutex.Lock()
+	defer hus.mutex.Unlock()
+	hus.format = f
+}
 
-		var requestBody bytes.Buffer
-		multiPartWriter := multipart.NewWriter(&requestBody)
+func (hus *HTTPStorageHandler) setSession(s *Session) {
+	hus.mutex.Lock()
+	hus.sessions[s.ID()] = s
+	hus.mutex.Unlock()
 
-		fileName := fmt.Sprintf("%s_%s_%016d_%s.raw", hus.recorderID, hus.sessionID, hus.chunkCount, strconv.FormatInt(time.Now().UTC().UnixNano(), 10))
-		hus.chunkCount++
+	hus.remoteUploader.setSession(s)
+}
 
-		fileWriter, err := multiPartWriter.CreateFormFile("raw_audio", fileName)
-		if err != nil {
-			fmt.Printf("Cannot create multi part file writer: %v\n", err)
-		}
+// put uploads a chunk. The metadata file, the last file of a session, is
+// not uploaded, the server got the metadata with every chunk.
+func (hus *HTTPStorageHandler) put(name string, r io.Reader, size int64) error {
+
+	if strings.HasSuffix(name, ".json") {
+		hus.mutex.Lock()
+		delete(hus.sessions, hus.spoolSessionID(name))
+		hus.mutex.Unlock()
+		return nil
+	}
+
+	sessionID, index, ok := parseChunkFileName(hus.recorderID, name)
+	if !ok {
+		return fmt.Errorf("Cannot upload %s: Not a chunk", name)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %v", name, err)
+	}
+
+	hus.mutex.Lock()
+	session := hus.sessions[sessionID]
+	hus.mutex.Unlock()
 
-		n, err := fileWriter.Write(toSend)
+	// All chunks but the last one of a session have chunkSize bytes
+	sum := sha256.Sum256(data)
+	return hus.upload(chunkUpload{
+		session:    session,
+		sessionID:  sessionID,
+		index:      index,
+		byteOffset: int64(index) * int64(hus.chunkSize),
+		data:       data,
+		checksum:   hex.EncodeToString(sum[:]),
+	})
+}
+
+func (hus *HTTPStorageHandler) upload(c chunkUpload) error {
+
+	var requestBody bytes.Buffer
+	multiPartWriter := multipart.NewWriter(&requestBody)
+
+	hus.mutex.Lock()
+	format := hus.format
+	hus.mutex.Unlock()
+
+	fields := map[string]string{
+		"recorder_id":   hus.recorderID,
+		"session_id":    c.sessionID,
+		"chunk_index":   strconv.Itoa(c.index),
+		"byte_offset":   strconv.FormatInt(c.byteOffset, 10),
+		"sample_offset": strconv.FormatInt(c.byteOffset/int64(format.BytesPerFrame()), 10),
+		"length":        strconv.Itoa(len(c.data)),
+		"sha256":        c.checksum,
+		"sample_rate":   strconv.Itoa(format.Samplerate),
+		"channels":      strconv.Itoa(format.Channels),
+		"sample_format": format.SampleFormat,
+	}
+
+	if c.session != nil {
+		metadata, err := json.Marshal(c.session)
 		if err != nil {
-			fmt.Printf("Cannot write frames into form: %v n=%d\n", err, n)
+			return fmt.Errorf("Cannot marshal session: %v", err)
 		}
-		multiPartWriter.Close()
+		fields["session"] = string(metadata)
+	}
 
-		// By now our original request body should have been populated, so let's just use it with our custom request
-		req, err := http.NewRequest("POST", hus.server, &requestBody)
-		if err != nil {
-			fmt.Printf("Cannot issue pos request: %v\n", err)
+	for k, v := range fields {
+		if err := multiPartWriter.WriteField(k, v); err != nil {
+			return fmt.Errorf("Cannot write field %s: %v", k, err)
 		}
-		req.Header.Set("Content-Type", multiPartWriter.FormDataContentType())
+	}
 
-		// Do the request
-		client := &http.Client{}
-		response, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("Cannot execute request: %v\n", err)
-			return
+	fileName := chunkFileName(hus.recorderID, c.sessionID, c.index)
+
+	fileWriter, err := multiPartWriter.CreateFormFile("raw_audio", fileName)
+	if err != nil {
+		return fmt.Errorf("Cannot create multi part file writer: %v", err)
+	}
+
+	n, err := fileWriter.Write(c.data)
+	if err != nil {
+		return fmt.Errorf("Cannot write frames into form: %v n=%d", err, n)
+	}
+	multiPartWriter.Close()
+
+	// By now our original request body should have been populated, so let's just use it with our custom request
+	body := requestBody.Bytes()
+	req, err := http.NewRequest("POST", hus.server, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Cannot issue pos request: %v", err)
+	}
+	req.Header.Set("Content-Type", multiPartWriter.FormDataContentType())
+	req.Header.Set("X-Content-SHA256", c.checksum)
+
+	hus.mutex.Lock()
+	client := hus.client
+	config := hus.config
+	requireReceipt := hus.requireReceipt
+	hus.mutex.Unlock()
+
+	config.authorize(req, body)
+
+	// Do the request
+	response, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cannot execute request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Response was not good: %s", response.Status)
+	}
+
+	return hus.verify(c, response, requireReceipt)
+}
+
+// verify checks the receipt of the server against what was sent, a
+// response without a body is fine unless a receipt is required
+func (hus *HTTPStorageHandler) verify(c chunkUpload, response *http.Response, required bool) error {
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return fmt.Errorf("Cannot read upload receipt: %v", err)
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if required {
+			return fmt.Errorf("Server sent no upload receipt")
 		}
+		return nil
+	}
 
-		if response.StatusCode != http.StatusOK {
-			fmt.Print("HTTPStorageHandlker: Response was not good!\n")
+	receipt := uploadReceipt{}
+	if err := json.Unmarshal(body, &receipt); err != nil {
+		if required {
+			return fmt.Errorf("Cannot read upload receipt: %v", err)
 		}
+		// Not a receipt, e.g. a plain "OK"
+		return nil
+	}
+
+	if receipt.SHA256 == "" && !required {
+		return nil
+	}
+
+	if receipt.SHA256 != c.checksum {
+		return fmt.Errorf("Checksum mismatch: sent %s, server has %s", c.checksum, receipt.SHA256)
+	}
+
+	if receipt.ByteOffset == nil || *receipt.ByteOffset != c.byteOffset {
+		return fmt.Errorf("Offset mismatch: sent %d, server has %v", c.byteOffset, receipt.ByteOffset)
+	}
+
+	if receipt.Length == nil || *receipt.Length != int64(len(c.data)) {
+		return fmt.Errorf("Length mismatch: sent %d, server has %v", len(c.data), receipt.Length)
+	}
 
+	end := c.byteOffset + int64(len(c.data))
+	if receipt.NextOffset != nil && *receipt.NextOffset != end {
+		return fmt.Errorf("Gap detected: server continues at %d, expected %d", *receipt.NextOffset, end)
 	}
+
+	return nil
 }
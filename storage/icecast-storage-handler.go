@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// icecastQueueSize is the number of buffers waiting to be sent before
+	// buffers are dropped
+	icecastQueueSize = 64
+	// icecastTimeout limits connecting and every write
+	icecastTimeout = time.Second * 10
+	// icecastMaxRetryDelay limits the time between two connection attempts
+	icecastMaxRetryDelay = time.Second * 30
+)
+
+// IcecastConfig describes the mount point the stream is sent to
+type IcecastConfig struct {
+	// URL of the mount point, e.g. http://stream.lan:8000/booth.ogg, https is supported
+	URL string
+	// User defaults to "source"
+	User     string
+	Password string
+	// Legacy uses the SOURCE method for old Icecast and Shoutcast servers
+	Legacy      bool
+	Name        string
+	Description string
+	Genre       string
+	Public      bool
+}
+
+type icecastItem struct {
+	data  []byte
+	title string
+}
+
+// IcecastStorageHandler is an Icecast source client which streams Ogg/FLAC.
+// Every session starts a new chained stream, so listeners see the session
+// title. The connection is reestablished automatically, audio is dropped
+// while the server cannot be reached.
+type IcecastStorageHandler struct {
+	config      IcecastConfig
+	recorderID  string
+	format      AudioFormat
+	eventStream chan Event
+	input       chan icecastItem
+
+	// only used by run
+	encoder   streamEncoder
+	conn      net.Conn
+	title     string
+	failing   bool
+	nextTry   time.Time
+	retryWait time.Duration
+}
+
+// NewIcecastStorageHandler factory
+func NewIcecastStorageHandler(config IcecastConfig, recorderID string) *IcecastStorageHandler {
+
+	if config.User == "" {
+		config.User = "source"
+	}
+
+	ret := &IcecastStorageHandler{
+		config:     config,
+		recorderID: recorderID,
+		format:     DefaultAudioFormat,
+		input:      make(chan icecastItem, icecastQueueSize),
+		title:      recorderID,
+		retryWait:  time.Second,
+	}
+
+	go ret.run()
+
+	return ret
+}
+
+// SetTitle changes the title listeners see
+func (ish *IcecastStorageHandler) SetTitle(title string) {
+	ish.input <- icecastItem{title: title}
+}
+
+func (ish *IcecastStorageHandler) setEventStream(s chan Event) {
+	ish.eventStream = s
+}
+
+func (ish *IcecastStorageHandler) setFormat(f AudioFormat) {
+	ish.format = f
+}
+
+func (ish *IcecastStorageHandler) setSession(s *Session) {
+	title := fmt.Sprintf("%s %s", ish.recorderID, s.Started().Local().Format("2006-01-02 15:04"))
+	if v, ok := s.Get("title"); ok {
+		if t, ok := v.(string); ok && t != "" {
+			title = t
+		}
+	}
+	ish.SetTitle(title)
+}
+
+func (ish *IcecastStorageHandler) store(b []byte) {
+	select {
+	case ish.input <- icecastItem{data: b}:
+	default:
+		// Only report the first loss, a live stream drops a lot when the network is gone
+		if !ish.failing {
+			sendEvent(ish.eventStream, "IcecastStorageHandler", EventDataDropped, "Stream is too slow, dropping audio")
+		}
+	}
+}
+
+func (ish *IcecastStorageHandler) comments() map[string]string {
+	return map[string]string{
+		"TITLE":  ish.title,
+		"ARTIST": ish.recorderID,
+	}
+}
+
+func (ish *IcecastStorageHandler) run() {
+	for item := range ish.input {
+
+		if item.data == nil {
+			ish.title = item.title
+			if ish.conn != nil {
+				// A new chained stream carries the new title
+				ish.write(append(ish.encoder.end(), ish.encoder.begin(ish.comments())...))
+			}
+			continue
+		}
+
+		if ish.conn == nil {
+			if time.Now().Before(ish.nextTry) {
+				continue
+			}
+			if err := ish.connect(); err != nil {
+				ish.fail(err)
+				continue
+			}
+			if ish.failing {
+				ish.failing = false
+				sendEvent(ish.eventStream, "IcecastStorageHandler", EventRecovered, "Streaming to %s", ish.config.URL)
+			}
+			ish.retryWait = time.Second
+			ish.write(ish.encoder.begin(ish.comments()))
+		}
+
+		ish.write(ish.encoder.encode(item.data))
+	}
+}
+
+func (ish *IcecastStorageHandler) fail(err error) {
+	if !ish.failing {
+		sendEvent(ish.eventStream, "IcecastStorageHandler", EventWriteError, "%v", err)
+	}
+	ish.failing = true
+
+	ish.nextTry = time.Now().Add(ish.retryWait)
+	if ish.retryWait *= 2; ish.retryWait > icecastMaxRetryDelay {
+		ish.retryWait = icecastMaxRetryDelay
+	}
+}
+
+func (ish *IcecastStorageHandler) write(b []byte) {
+	if ish.conn == nil || len(b) == 0 {
+		return
+	}
+
+	ish.conn.SetWriteDeadline(time.Now().Add(icecastTimeout))
+	if _, err := ish.conn.Write(b); err != nil {
+		ish.conn.Close()
+		ish.conn = nil
+		ish.fail(fmt.Errorf("Cannot stream: %v", err))
+	}
+}
+
+func (ish *IcecastStorageHandler) connect() error {
+
+	u, err := url.Parse(ish.config.URL)
+	if err != nil {
+		return fmt.Errorf("Cannot parse url: %v", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host += ":443"
+		} else {
+			host += ":8000"
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: icecastTimeout}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot connect to %s: %v", host, err)
+	}
+
+	encoder, err := newOggFLACEncoder(ish.format)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	method, protocol := "PUT", "HTTP/1.1"
+	if ish.config.Legacy {
+		method, protocol = "SOURCE", "HTTP/1.0"
+	}
+
+	public := "0"
+	if ish.config.Public {
+		public = "1"
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(ish.config.User + ":" + ish.config.Password))
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "%s %s %s\r\n", method, u.RequestURI(), protocol)
+	fmt.Fprintf(&request, "Host: %s\r\n", u.Host)
+	fmt.Fprintf(&request, "Authorization: Basic %s\r\n", auth)
+	fmt.Fprintf(&request, "User-Agent: recorder-booth\r\n")
+	fmt.Fprintf(&request, "Content-Type: %s\r\n", encoder.contentType())
+	fmt.Fprintf(&request, "Ice-Public: %s\r\n", public)
+	fmt.Fprintf(&request, "Ice-Name: %s\r\n", ish.config.Name)
+	fmt.Fprintf(&request, "Ice-Description: %s\r\n", ish.config.Description)
+	fmt.Fprintf(&request, "Ice-Genre: %s\r\n", ish.config.Genre)
+	fmt.Fprintf(&request, "Ice-Audio-Info: samplerate=%d;channels=%d\r\n", ish.format.Samplerate, ish.format.Channels)
+	fmt.Fprintf(&request, "\r\n")
+
+	conn.SetDeadline(time.Now().Add(icecastTimeout))
+
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		conn.Close()
+		return fmt.Errorf("Cannot send request: %v", err)
+	}
+
+	// The server answers before any audio is sent
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Cannot read response: %v", err)
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 {
+		conn.Close()
+		return fmt.Errorf("Invalid response: %q", status)
+	}
+	if code, _ := strconv.Atoi(fields[1]); code != 200 && code != 100 {
+		conn.Close()
+		return fmt.Errorf("Server refused stream: %s", strings.TrimSpace(status))
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("Cannot read response: %v", err)
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	fmt.Printf("Streaming to %s\n", ish.config.URL)
+
+	ish.conn = conn
+	ish.encoder = encoder
+	return nil
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// liveClientBuffer is the number of buffers a client may lag behind before
+// it is dropped
+const liveClientBuffer = 64
+
+type liveClient struct {
+	output chan []byte
+	ogg    bool
+	remote string
+}
+
+// LiveStreamHandler serves the input as endless stream over http to any
+// number of clients. Requests for a path ending in .ogg get Ogg/FLAC, all
+// others get WAV. Clients which do not keep up are disconnected.
+type LiveStreamHandler struct {
+	recorderID string
+	mutex      sync.Mutex
+	format     AudioFormat
+	clients    map[*liveClient]struct{}
+	oggClients int
+	title      string
+	encoder    *oggFLACEncoder
+	// oggHeader starts the current ogg stream for new clients
+	oggHeader []byte
+}
+
+// NewLiveStreamHandler factory
+func NewLiveStreamHandler(recorderID string) *LiveStreamHandler {
+	return &LiveStreamHandler{
+		recorderID: recorderID,
+		format:     DefaultAudioFormat,
+		clients:    map[*liveClient]struct{}{},
+		title:      recorderID,
+	}
+}
+
+// Clients returns the number of connected clients
+func (lsh *LiveStreamHandler) Clients() int {
+	lsh.mutex.Lock()
+	defer lsh.mutex.Unlock()
+	return len(lsh.clients)
+}
+
+func (lsh *LiveStreamHandler) setFormat(f AudioFormat) {
+	lsh.mutex.Lock()
+	defer lsh.mutex.Unlock()
+	lsh.format = f
+}
+
+func (lsh *LiveStreamHandler) setSession(s *Session) {
+	lsh.mutex.Lock()
+	defer lsh.mutex.Unlock()
+
+	lsh.title = fmt.Sprintf("%s %s", lsh.recorderID, s.Started().Local().Format("2006-01-02 15:04"))
+	if v, ok := s.Get("title"); ok {
+		if t, ok := v.(string); ok && t != "" {
+			lsh.title = t
+		}
+	}
+
+	if lsh.encoder == nil {
+		return
+	}
+
+	// Chain a new stream, so listeners see the new title
+	end := lsh.encoder.end()
+	lsh.oggHeader = lsh.encoder.begin(lsh.comments())
+	lsh.send(append(end, lsh.oggHeader...), true)
+}
+
+func (lsh *LiveStreamHandler) comments() map[string]string {
+	return map[string]string{
+		"TITLE":  lsh.title,
+		"ARTIST": lsh.recorderID,
+	}
+}
+
+func (lsh *LiveStreamHandler) store(b []byte) {
+	lsh.mutex.Lock()
+	defer lsh.mutex.Unlock()
+
+	if len(lsh.clients) == 0 {
+		return
+	}
+
+	// Audio is encoded once for all clients
+	if lsh.encoder != nil {
+		if pages := lsh.encoder.encode(b); len(pages) > 0 {
+			lsh.send(pages, true)
+		}
+	}
+	lsh.send(b, false)
+}
+
+// send hands b to all ogg or all wav clients, the mutex has to be held
+func (lsh *LiveStreamHandler) send(b []byte, ogg bool) {
+	for c := range lsh.clients {
+		if c.ogg != ogg {
+			continue
+		}
+		select {
+		case c.output <- b:
+		default:
+			fmt.Printf("Live stream: Dropping slow client %s\n", c.remote)
+			lsh.remove(c)
+			close(c.output)
+		}
+	}
+}
+
+// remove unregisters a client, the mutex has to be held
+func (lsh *LiveStreamHandler) remove(c *liveClient) {
+	if _, ok := lsh.clients[c]; !ok {
+		return
+	}
+	delete(lsh.clients, c)
+
+	if c.ogg {
+		lsh.oggClients--
+		if lsh.oggClients == 0 {
+			lsh.encoder = nil
+			lsh.oggHeader = nil
+		}
+	}
+}
+
+// add registers a client and returns the data it has to start with
+func (lsh *LiveStreamHandler) add(c *liveClient) ([]byte, error) {
+	lsh.mutex.Lock()
+	defer lsh.mutex.Unlock()
+
+	lsh.clients[c] = struct{}{}
+
+	if !c.ogg {
+		return wavStreamHeader(lsh.format), nil
+	}
+
+	if lsh.encoder == nil {
+		encoder, err := newOggFLACEncoder(lsh.format)
+		if err != nil {
+			delete(lsh.clients, c)
+			return nil, err
+		}
+		lsh.encoder = encoder
+		lsh.oggHeader = encoder.begin(lsh.comments())
+	}
+	lsh.oggClients++
+
+	return lsh.oggHeader, nil
+}
+
+// wavStreamHeader returns a wav header with unknown length
+func wavStreamHeader(f AudioFormat) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 0xffffffff)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1)
+	binary.LittleEndian.PutUint16(h[22:], uint16(f.Channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(f.Samplerate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(f.Samplerate*f.BytesPerFrame()))
+	binary.LittleEndian.PutUint16(h[32:], uint16(f.BytesPerFrame()))
+	binary.LittleEndian.PutUint16(h[34:], uint16(f.BytesPerSample*8))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], 0xffffffff)
+	return h
+}
+
+func (lsh *LiveStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &liveClient{
+		output: make(chan []byte, liveClientBuffer),
+		ogg:    strings.HasSuffix(r.URL.Path, ".ogg"),
+		remote: r.RemoteAddr,
+	}
+
+	header, err := lsh.add(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		lsh.mutex.Lock()
+		lsh.remove(c)
+		lsh.mutex.Unlock()
+	}()
+
+	if c.ogg {
+		w.Header().Set("Content-Type", "audio/ogg")
+	} else {
+		w.Header().Set("Content-Type", "audio/wav")
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	fmt.Printf("Live stream: %s connected\n", c.remote)
+
+	if _, err := w.Write(header); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case b, ok := <-c.output:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			fmt.Printf("Live stream: %s disconnected\n", c.remote)
+			return
+		}
+	}
+}
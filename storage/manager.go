@@ -2,14 +2,40 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Manager can store an audio stream
 type Manager struct {
-	byteStream chan []byte
-	mutex      sync.Mutex
-	handlers   []Handler
+	byteStream  chan []byte
+	eventStream chan Event
+	// handlerEvents is handed to handlers, events are recorded for Health
+	// before they are passed on to eventStream
+	handlerEvents chan Event
+	mutex         sync.Mutex
+	handlers      []*handlerEntry
+	session       *Session
+	ended         bool
+	format        AudioFormat
+	lastEvents    map[string]Event
+	listeners     []func(*Session)
+}
+
+// HandlerHealth describes the state of a storage handler
+type HandlerHealth struct {
+	Handler string `json:"handler"`
+	// Healthy is false if the last event reported by the handler is an
+	// error. Dropped buffers count until the handler has caught up.
+	Healthy   bool       `json:"healthy"`
+	LastEvent string     `json:"lastEvent,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+	// Dropped is the number of buffers dropped because the handler was too slow
+	Dropped int `json:"dropped"`
+	// Queued is the number of buffers waiting for the handler
+	Queued int `json:"queued"`
 }
 
 // Handler used to add storage handlers
@@ -17,12 +43,143 @@ type Handler interface {
 	store([]byte)
 }
 
+// sessionHandler is implemented by handlers which need to know the session
+type sessionHandler interface {
+	setSession(*Session)
+}
+
+// sessionEnder is implemented by handlers which complete a session, e.g.
+// finish an upload, when it ends without a next one
+type sessionEnder interface {
+	endSession()
+}
+
+// handlerQueueSize is the number of buffers a handler may lag behind before
+// buffers are dropped for it
+const handlerQueueSize = 64
+
+// handlerItem is either data, a session change or the end of a session,
+// so all arrive in order
+type handlerItem struct {
+	data    []byte
+	session *Session
+	end     bool
+}
+
+func (i handlerItem) isData() bool {
+	return i.session == nil && !i.end
+}
+
+// handlerEntry queues items for a handler. Only data counts against
+// handlerQueueSize, session changes are always queued, so queuing never
+// blocks, not even behind a stalled handler.
+type handlerEntry struct {
+	name    string
+	handler Handler
+	dropped int
+	// dropping is true from a drop until the queue has drained
+	dropping bool
+
+	mutex  sync.Mutex
+	queue  []handlerItem
+	queued int
+	notify chan struct{}
+}
+
+func newHandlerEntry(h Handler) *handlerEntry {
+	ret := &handlerEntry{
+		name:    strings.TrimPrefix(fmt.Sprintf("%T", h), "*storage."),
+		handler: h,
+		notify:  make(chan struct{}, 1),
+	}
+	go ret.run()
+	return ret
+}
+
+// push queues an item, it returns false if data was dropped because the
+// queue is full
+func (e *handlerEntry) push(item handlerItem) bool {
+	e.mutex.Lock()
+	if item.isData() {
+		if e.queued >= handlerQueueSize {
+			e.mutex.Unlock()
+			return false
+		}
+		e.queued++
+	}
+	e.queue = append(e.queue, item)
+	e.mutex.Unlock()
+
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (e *handlerEntry) pop() (handlerItem, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.queue) == 0 {
+		return handlerItem{}, false
+	}
+
+	item := e.queue[0]
+	e.queue[0] = handlerItem{}
+	e.queue = e.queue[1:]
+	if item.isData() {
+		e.queued--
+	}
+	return item, true
+}
+
+// pending returns the number of buffers waiting for the handler
+func (e *handlerEntry) pending() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.queued
+}
+
+// run feeds the handler in order, a slow handler does not hold up the others
+func (e *handlerEntry) run() {
+	for range e.notify {
+		for {
+			item, ok := e.pop()
+			if !ok {
+				break
+			}
+			e.handle(item)
+		}
+	}
+}
+
+func (e *handlerEntry) handle(item handlerItem) {
+	switch {
+	case item.session != nil:
+		if sh, ok := e.handler.(sessionHandler); ok {
+			sh.setSession(item.session)
+		}
+	case item.end:
+		if se, ok := e.handler.(sessionEnder); ok {
+			se.endSession()
+		}
+	default:
+		e.handler.store(item.data)
+	}
+}
+
 // NewManager factory for manager
 func NewManager() *Manager {
 	ret := Manager{
-		byteStream: make(chan []byte),
+		byteStream:    make(chan []byte),
+		eventStream:   make(chan Event, 64),
+		handlerEvents: make(chan Event, 64),
+		format:        DefaultAudioFormat,
+		lastEvents:    map[string]Event{},
 	}
 	go ret.run()
+	go ret.watch()
 	return &ret
 }
 
@@ -31,12 +188,126 @@ func (m *Manager) InputChannel() chan []byte {
 	return m.byteStream
 }
 
+// Events returns the channel handlers report errors and recoveries on.
+// Events are dropped if nobody reads them.
+func (m *Manager) Events() <-chan Event {
+	return m.eventStream
+}
+
 // Add adds handlers
 func (m *Manager) Add(h Handler) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.handlers = append(m.handlers, h)
+	if er, ok := h.(eventReporter); ok {
+		er.setEventStream(m.handlerEvents)
+	}
+
+	if fh, ok := h.(formatHandler); ok {
+		fh.setFormat(m.format)
+	}
+
+	e := newHandlerEntry(h)
+	m.handlers = append(m.handlers, e)
+
+	if m.session != nil {
+		e.push(handlerItem{session: m.session})
+	}
+}
+
+// AddSessionListener registers f to be called with every new session, e.g.
+// to reset analyzers which report positions within the session
+func (m *Manager) AddSessionListener(f func(*Session)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.listeners = append(m.listeners, f)
+}
+
+// SetSession sets the session all handlers store into. Data which has
+// been passed to the manager before still goes into the previous session.
+func (m *Manager) SetSession(s *Session) {
+	m.mutex.Lock()
+
+	m.session = s
+	m.ended = false
+	for _, e := range m.handlers {
+		e.push(handlerItem{session: s})
+	}
+	listeners := m.listeners
+	m.mutex.Unlock()
+
+	for _, f := range listeners {
+		f(s)
+	}
+}
+
+// EndSession ends the current session without starting a new one, handlers
+// complete it like on a session change. Data passed to the manager
+// afterwards is discarded until the next session is set.
+func (m *Manager) EndSession() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.session == nil || m.ended {
+		return
+	}
+
+	m.session = nil
+	m.ended = true
+	for _, e := range m.handlers {
+		e.push(handlerItem{end: true})
+	}
+}
+
+// SetFormat sets the format of the audio passed to the manager. It has to
+// be called before handlers are added.
+func (m *Manager) SetFormat(f AudioFormat) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.format = f
+}
+
+// Format returns the format of the audio passed to the manager
+func (m *Manager) Format() AudioFormat {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.format
+}
+
+// Health returns the state of all handlers
+func (m *Manager) Health() []HandlerHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make([]HandlerHealth, 0, len(m.handlers))
+	for _, e := range m.handlers {
+		h := HandlerHealth{
+			Handler: e.name,
+			Healthy: true,
+			Dropped: e.dropped,
+			Queued:  e.pending(),
+		}
+		if ev, ok := m.lastEvents[e.name]; ok {
+			t := ev.Time
+			h.Healthy = ev.Type == EventRecovered || ev.Type == EventPathSwitched
+			h.LastEvent = ev.Type.String()
+			h.Message = ev.Message
+			h.Time = &t
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// Session returns the current session, nil after EndSession
+func (m *Manager) Session() *Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.session
 }
 
 func (m *Manager) run() {
@@ -45,11 +316,41 @@ func (m *Manager) run() {
 		data := <-m.byteStream
 
 		m.mutex.Lock()
-		curHandlers := m.handlers
+		if m.ended {
+			m.mutex.Unlock()
+			continue
+		}
+		for _, e := range m.handlers {
+			if !e.push(handlerItem{data: data}) {
+				e.dropped++
+				e.dropping = true
+				sendEvent(m.handlerEvents, e.name, EventDataDropped, "Handler is too slow, dropped %d buffers", e.dropped)
+				continue
+			}
+
+			// The handler caught up when only the new buffer is queued. The
+			// drop is cleared unless the handler reported something since.
+			if e.dropping && e.pending() == 1 {
+				e.dropping = false
+				if m.lastEvents[e.name].Type == EventDataDropped {
+					sendEvent(m.handlerEvents, e.name, EventRecovered, "Handler caught up after dropping %d buffers", e.dropped)
+				}
+			}
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// watch records the last event of every handler and passes events on
+func (m *Manager) watch() {
+	for e := range m.handlerEvents {
+		m.mutex.Lock()
+		m.lastEvents[e.Handler] = e
 		m.mutex.Unlock()
 
-		for _, ca := range curHandlers {
-			go ca.store(data)
+		select {
+		case m.eventStream <- e:
+		default:
 		}
 	}
 }
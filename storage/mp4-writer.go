@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"encoding/binary"
+)
+
+// Fragmented mp4 (ISO BMFF) with flac samples as described in
+// https://github.com/xiph/flac/blob/master/doc/isoflac.txt
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	ret := make([]byte, 0, size)
+	ret = append(ret, u32(uint32(size))...)
+	ret = append(ret, boxType...)
+	for _, p := range payload {
+		ret = append(ret, p...)
+	}
+	return ret
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// mp4InitSegment returns the initialization segment for a flac audio track
+func mp4InitSegment(format AudioFormat, streamInfo []byte) []byte {
+
+	timescale := uint32(format.Samplerate)
+
+	ftyp := mp4Box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcmp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		mp4Matrix, make([]byte, 24),
+		u32(2))
+
+	tkhd := mp4FullBox("tkhd", 0, 0x000003,
+		u32(0), u32(0), u32(1), u32(0), u32(0),
+		make([]byte, 8), u16(0), u16(0), u16(0x0100), u16(0),
+		mp4Matrix, u32(0), u32(0))
+
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		u32(0), u32(0), u32(timescale), u32(0),
+		// Language "und"
+		u16(0x55c4), u16(0))
+
+	hdlr := mp4FullBox("hdlr", 0, 0,
+		u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+
+	dfLa := mp4FullBox("dfLa", 0, 0, flacMetadataBlock(0, true, streamInfo))
+
+	sampleRate := timescale << 16
+	if timescale > 0xffff {
+		sampleRate = 0
+	}
+	fLaC := mp4Box("fLaC",
+		make([]byte, 6), u16(1), make([]byte, 8),
+		u16(uint16(format.Channels)), u16(uint16(format.BytesPerSample*8)),
+		u16(0), u16(0), u32(sampleRate),
+		dfLa)
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), fLaC),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+
+	minf := mp4Box("minf",
+		mp4FullBox("smhd", 0, 0, u16(0), u16(0)),
+		mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1))),
+		stbl)
+
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	trak := mp4Box("trak", tkhd, mdia)
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+	moov := mp4Box("moov", mvhd, trak, mvex)
+
+	return append(ftyp, moov...)
+}
+
+// mp4Fragment returns a media segment holding one flac frame per sample.
+// decodeTime is the position of the first frame, durations are given in
+// samples as well.
+func mp4Fragment(sequence uint32, decodeTime uint64, frames [][]byte, durations []uint32) []byte {
+
+	trun := func(dataOffset uint32) []byte {
+		entries := make([]byte, 0, len(frames)*8)
+		for i, f := range frames {
+			entries = append(entries, u32(durations[i])...)
+			entries = append(entries, u32(uint32(len(f)))...)
+		}
+		// Flags: data offset, sample duration and sample size present
+		return mp4FullBox("trun", 0, 0x000301, u32(uint32(len(frames))), u32(dataOffset), entries)
+	}
+
+	moof := func(dataOffset uint32) []byte {
+		return mp4Box("moof",
+			mp4FullBox("mfhd", 0, 0, u32(sequence)),
+			mp4Box("traf",
+				// Flags: default base is moof
+				mp4FullBox("tfhd", 0, 0x020000, u32(1)),
+				mp4FullBox("tfdt", 1, 0, u64(decodeTime)),
+				trun(dataOffset)))
+	}
+
+	// The data offset points behind the mdat header
+	ret := moof(uint32(len(moof(0)) + 8))
+
+	return append(ret, mp4Box("mdat", frames...)...)
+}
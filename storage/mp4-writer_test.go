@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mp4Containers are the boxes of the init segment and the fragments which
+// hold other boxes. The offset is where the child boxes start.
+var mp4Containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "dinf": 0, "stbl": 0,
+	"mvex": 0, "moof": 0, "traf": 0,
+	// Full boxes with an entry count
+	"stsd": 8, "dref": 8,
+	// Audio sample entry
+	"fLaC": 28,
+}
+
+type mp4ParsedBox struct {
+	path    string
+	offset  int
+	payload []byte
+}
+
+// parseMP4 returns all boxes of data by their path, e.g. moov/trak/tkhd.
+// Every box must fit exactly into its parent.
+func parseMP4(data []byte, parent string, offset int) ([]mp4ParsedBox, error) {
+
+	ret := []mp4ParsedBox{}
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, fmt.Errorf("%s: %d bytes left at %d", parent, len(data)-pos, offset+pos)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		boxType := string(data[pos+4 : pos+8])
+		if size < 8 || pos+size > len(data) {
+			return nil, fmt.Errorf("%s/%s: Size %d at %d does not fit", parent, boxType, size, offset+pos)
+		}
+
+		path := strings.TrimPrefix(parent+"/"+boxType, "/")
+		box := mp4ParsedBox{path: path, offset: offset + pos, payload: data[pos+8 : pos+size]}
+		ret = append(ret, box)
+
+		if skip, ok := mp4Containers[boxType]; ok {
+			children, err := parseMP4(box.payload[skip:], path, box.offset+8+skip)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, children...)
+		}
+		pos += size
+	}
+	return ret, nil
+}
+
+func findMP4Box(t *testing.T, boxes []mp4ParsedBox, path string) mp4ParsedBox {
+	for _, b := range boxes {
+		if b.path == path {
+			return b
+		}
+	}
+	t.Fatalf("No box %s", path)
+	return mp4ParsedBox{}
+}
+
+func TestMP4InitSegment(t *testing.T) {
+
+	format := DefaultAudioFormat
+	encoder, err := newFLACEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamInfo := encoder.streamInfo()
+
+	boxes, err := parseMP4(mp4InitSegment(format, streamInfo), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, b := range boxes {
+		paths = append(paths, b.path)
+	}
+	want := []string{
+		"ftyp",
+		"moov",
+		"moov/mvhd",
+		"moov/trak",
+		"moov/trak/tkhd",
+		"moov/trak/mdia",
+		"moov/trak/mdia/mdhd",
+		"moov/trak/mdia/hdlr",
+		"moov/trak/mdia/minf",
+		"moov/trak/mdia/minf/smhd",
+		"moov/trak/mdia/minf/dinf",
+		"moov/trak/mdia/minf/dinf/dref",
+		"moov/trak/mdia/minf/dinf/dref/url ",
+		"moov/trak/mdia/minf/stbl",
+		"moov/trak/mdia/minf/stbl/stsd",
+		"moov/trak/mdia/minf/stbl/stsd/fLaC",
+		"moov/trak/mdia/minf/stbl/stsd/fLaC/dfLa",
+		"moov/trak/mdia/minf/stbl/stts",
+		"moov/trak/mdia/minf/stbl/stsc",
+		"moov/trak/mdia/minf/stbl/stsz",
+		"moov/trak/mdia/minf/stbl/stco",
+		"moov/mvex",
+		"moov/mvex/trex",
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("Boxes\n%s\nwant\n%s", strings.Join(paths, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Payload sizes of the version 0 boxes in ISO/IEC 14496-12
+	sizes := map[string]int{
+		"moov/mvhd":                     100,
+		"moov/trak/tkhd":                84,
+		"moov/trak/mdia/mdhd":           24,
+		"moov/trak/mdia/minf/smhd":      8,
+		"moov/trak/mdia/minf/stbl/stts": 8,
+		"moov/trak/mdia/minf/stbl/stsc": 8,
+		"moov/trak/mdia/minf/stbl/stsz": 12,
+		"moov/trak/mdia/minf/stbl/stco": 8,
+		"moov/mvex/trex":                24,
+		// Version and flags, metadata block header, STREAMINFO
+		"moov/trak/mdia/minf/stbl/stsd/fLaC/dfLa": 4 + 4 + 34,
+	}
+	for path, size := range sizes {
+		if b := findMP4Box(t, boxes, path); len(b.payload) != size {
+			t.Errorf("%s: Payload of %d bytes, want %d", path, len(b.payload), size)
+		}
+	}
+
+	ftyp := findMP4Box(t, boxes, "ftyp").payload
+	if string(ftyp[:4]) != "iso6" || !strings.Contains(string(ftyp[8:]), "cmfc") {
+		t.Errorf("ftyp brands %q", ftyp)
+	}
+
+	tkhd := findMP4Box(t, boxes, "moov/trak/tkhd").payload
+	if flags := binary.BigEndian.Uint32(tkhd) & 0xffffff; flags != 3 || binary.BigEndian.Uint32(tkhd[12:]) != 1 {
+		t.Errorf("tkhd flags %#x, track id %d", flags, binary.BigEndian.Uint32(tkhd[12:]))
+	}
+
+	mdhd := findMP4Box(t, boxes, "moov/trak/mdia/mdhd").payload
+	if timescale := binary.BigEndian.Uint32(mdhd[12:]); timescale != uint32(format.Samplerate) {
+		t.Errorf("mdhd timescale %d", timescale)
+	}
+
+	hdlr := findMP4Box(t, boxes, "moov/trak/mdia/hdlr").payload
+	if string(hdlr[8:12]) != "soun" {
+		t.Errorf("hdlr handler type %q", hdlr[8:12])
+	}
+
+	stsd := findMP4Box(t, boxes, "moov/trak/mdia/minf/stbl/stsd").payload
+	if binary.BigEndian.Uint32(stsd[4:]) != 1 {
+		t.Errorf("stsd entry count %d", binary.BigEndian.Uint32(stsd[4:]))
+	}
+
+	// Audio sample entry: reserved, data reference index, reserved, channel
+	// count, sample size, pre defined, reserved, sample rate 16.16
+	entry := findMP4Box(t, boxes, "moov/trak/mdia/minf/stbl/stsd/fLaC").payload
+	if binary.BigEndian.Uint16(entry[6:]) != 1 {
+		t.Errorf("fLaC data reference index %d", binary.BigEndian.Uint16(entry[6:]))
+	}
+	if channels := binary.BigEndian.Uint16(entry[16:]); int(channels) != format.Channels {
+		t.Errorf("fLaC channel count %d", channels)
+	}
+	if bits := binary.BigEndian.Uint16(entry[18:]); bits != 16 {
+		t.Errorf("fLaC sample size %d", bits)
+	}
+	if rate := binary.BigEndian.Uint32(entry[24:]); rate != uint32(format.Samplerate)<<16 {
+		t.Errorf("fLaC sample rate %#x", rate)
+	}
+
+	// dfLa holds the STREAMINFO as the last metadata block
+	dfLa := findMP4Box(t, boxes, "moov/trak/mdia/minf/stbl/stsd/fLaC/dfLa").payload
+	if !bytes.Equal(dfLa[4:8], []byte{0x80, 0, 0, 34}) || !bytes.Equal(dfLa[8:], streamInfo) {
+		t.Errorf("dfLa % x", dfLa)
+	}
+
+	trex := findMP4Box(t, boxes, "moov/mvex/trex").payload
+	if binary.BigEndian.Uint32(trex[4:]) != 1 || binary.BigEndian.Uint32(trex[8:]) != 1 {
+		t.Errorf("trex track id %d, sample description index %d", binary.BigEndian.Uint32(trex[4:]), binary.BigEndian.Uint32(trex[8:]))
+	}
+}
+
+func TestMP4Fragment(t *testing.T) {
+
+	frames := [][]byte{[]byte("first frame"), []byte("second"), []byte("3")}
+	durations := []uint32{4096, 4096, 1000}
+	fragment := mp4Fragment(7, 123456, frames, durations)
+
+	boxes, err := parseMP4(fragment, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mfhd := findMP4Box(t, boxes, "moof/mfhd").payload; binary.BigEndian.Uint32(mfhd[4:]) != 7 {
+		t.Errorf("mfhd sequence %d", binary.BigEndian.Uint32(mfhd[4:]))
+	}
+
+	tfhd := findMP4Box(t, boxes, "moof/traf/tfhd").payload
+	if flags := binary.BigEndian.Uint32(tfhd) & 0xffffff; flags != 0x020000 || binary.BigEndian.Uint32(tfhd[4:]) != 1 {
+		t.Errorf("tfhd flags %#x, track id %d", flags, binary.BigEndian.Uint32(tfhd[4:]))
+	}
+
+	tfdt := findMP4Box(t, boxes, "moof/traf/tfdt").payload
+	if tfdt[0] != 1 || binary.BigEndian.Uint64(tfdt[4:]) != 123456 {
+		t.Errorf("tfdt % x", tfdt)
+	}
+
+	trun := findMP4Box(t, boxes, "moof/traf/trun").payload
+	if binary.BigEndian.Uint32(trun[4:]) != uint32(len(frames)) {
+		t.Fatalf("trun sample count %d", binary.BigEndian.Uint32(trun[4:]))
+	}
+
+	// The data offset is relative to the moof and points to the first frame
+	moof := findMP4Box(t, boxes, "moof")
+	mdat := findMP4Box(t, boxes, "mdat")
+	dataOffset := int(binary.BigEndian.Uint32(trun[8:]))
+	if moof.offset+dataOffset != mdat.offset+8 {
+		t.Errorf("trun data offset %d points to %d, mdat data starts at %d", dataOffset, moof.offset+dataOffset, mdat.offset+8)
+	}
+
+	pos := 0
+	for i, f := range frames {
+		entry := trun[12+i*8:]
+		duration, size := binary.BigEndian.Uint32(entry), int(binary.BigEndian.Uint32(entry[4:]))
+		if duration != durations[i] || size != len(f) {
+			t.Errorf("Sample %d: Duration %d, size %d", i, duration, size)
+		}
+		if !bytes.Equal(mdat.payload[pos:pos+size], f) {
+			t.Errorf("Sample %d: Data differs", i)
+		}
+		pos += size
+	}
+	if pos != len(mdat.payload) {
+		t.Errorf("mdat holds %d bytes, samples %d", len(mdat.payload), pos)
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+// oggSerials is seeded, so serials differ between runs. A rand.Rand is not
+// safe for concurrent use, handlers create streams from their goroutines.
+var (
+	oggSerials      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	oggSerialsMutex sync.Mutex
+)
+
+// oggStream writes the pages of one logical ogg stream
+type oggStream struct {
+	serial   uint32
+	sequence uint32
+}
+
+func newOggStream() *oggStream {
+	oggSerialsMutex.Lock()
+	defer oggSerialsMutex.Unlock()
+	return &oggStream{serial: oggSerials.Uint32()}
+}
+
+func oggCRC(page []byte) uint32 {
+	crc := uint32(0)
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// page returns a page holding exactly one packet, or none if packet is nil.
+// Packets of more than 255*255 bytes are not supported, flac frames are
+// much smaller.
+func (s *oggStream) page(packet []byte, granule int64, flags byte) []byte {
+
+	segments := 0
+	if packet != nil {
+		segments = len(packet)/255 + 1
+	}
+
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], s.serial)
+	binary.LittleEndian.PutUint32(page[18:], s.sequence)
+	page[26] = byte(segments)
+	for i := 0; i < segments; i++ {
+		page[27+i] = 255
+	}
+	if segments > 0 {
+		page[27+segments-1] = byte(len(packet) % 255)
+	}
+	page = append(page, packet...)
+
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	s.sequence++
+	return page
+}
+
+// streamEncoder encodes pcm for live streams. Every begin starts a new
+// stream which carries the given comments, e.g. the title.
+type streamEncoder interface {
+	begin(comments map[string]string) []byte
+	encode(pcm []byte) []byte
+	end() []byte
+	contentType() string
+}
+
+// oggFLACEncoder encodes pcm to flac in an ogg container
+type oggFLACEncoder struct {
+	format AudioFormat
+	flac   *flacEncoder
+	stream *oggStream
+}
+
+func newOggFLACEncoder(format AudioFormat) (*oggFLACEncoder, error) {
+	if _, err := newFLACEncoder(format); err != nil {
+		return nil, err
+	}
+	return &oggFLACEncoder{format: format}, nil
+}
+
+func (e *oggFLACEncoder) contentType() string {
+	return "application/ogg"
+}
+
+func (e *oggFLACEncoder) begin(comments map[string]string) []byte {
+
+	e.flac, _ = newFLACEncoder(e.format)
+	e.stream = newOggStream()
+
+	// Ogg FLAC mapping: 0x7F "FLAC" version 1.0, one more header packet
+	first := append([]byte{0x7f, 'F', 'L', 'A', 'C', 1, 0, 0, 1}, "fLaC"...)
+	first = append(first, flacMetadataBlock(0, false, e.flac.streamInfo())...)
+
+	ret := e.stream.page(first, 0, oggBOS)
+	ret = append(ret, e.stream.page(flacMetadataBlock(4, true, vorbisComment(comments)), 0, 0)...)
+	return ret
+}
+
+func (e *oggFLACEncoder) encode(pcm []byte) []byte {
+	frames := e.flac.encode(pcm)
+
+	// The granule of a page is the number of samples up to its end, encode
+	// only returns complete blocks
+	granule := int64(e.flac.samples) - int64(len(frames))*flacBlockSize
+
+	ret := []byte{}
+	for _, frame := range frames {
+		granule += flacBlockSize
+		ret = append(ret, e.stream.page(frame, granule, 0)...)
+	}
+	return ret
+}
+
+func (e *oggFLACEncoder) end() []byte {
+	if e.stream == nil {
+		return nil
+	}
+
+	frames := e.flac.flush()
+	if len(frames) == 0 {
+		// A page without packets only marks the end
+		return e.stream.page(nil, int64(e.flac.samples), oggEOS)
+	}
+	return e.stream.page(frames[0], int64(e.flac.samples), oggEOS)
+}
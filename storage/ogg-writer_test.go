@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// The check value of CRC-32/OGG for "123456789"
+func TestOggCRC(t *testing.T) {
+	if crc := oggCRC([]byte("123456789")); crc != 0x89a1897f {
+		t.Errorf("oggCRC = %#08x, want 0x89a1897f", crc)
+	}
+}
+
+type oggPage struct {
+	flags    byte
+	granule  int64
+	serial   uint32
+	sequence uint32
+	packet   []byte
+}
+
+// readOggPages splits data into pages and checks their CRC. Every page
+// must hold at most one complete packet.
+func readOggPages(data []byte) ([]oggPage, error) {
+
+	pages := []oggPage{}
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" || data[4] != 0 {
+			return nil, fmt.Errorf("Page %d: No capture pattern", len(pages))
+		}
+
+		segments := int(data[26])
+		if len(data) < 27+segments {
+			return nil, fmt.Errorf("Page %d: Truncated segment table", len(pages))
+		}
+		size := 0
+		for i, s := range data[27 : 27+segments] {
+			size += int(s)
+			if s < 255 && i != segments-1 {
+				return nil, fmt.Errorf("Page %d: More than one packet", len(pages))
+			}
+		}
+		if segments > 0 && data[27+segments-1] == 255 {
+			return nil, fmt.Errorf("Page %d: Packet continues on the next page", len(pages))
+		}
+
+		end := 27 + segments + size
+		if len(data) < end {
+			return nil, fmt.Errorf("Page %d: Truncated body", len(pages))
+		}
+
+		page := append([]byte{}, data[:end]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			return nil, fmt.Errorf("Page %d: CRC mismatch", len(pages))
+		}
+
+		p := oggPage{
+			flags:    data[5],
+			granule:  int64(binary.LittleEndian.Uint64(data[6:])),
+			serial:   binary.LittleEndian.Uint32(data[14:]),
+			sequence: binary.LittleEndian.Uint32(data[18:]),
+		}
+		if segments > 0 {
+			p.packet = data[27+segments : end]
+		}
+		pages = append(pages, p)
+		data = data[end:]
+	}
+	return pages, nil
+}
+
+func TestOggPageSizes(t *testing.T) {
+
+	// Packets which end exactly on a segment boundary need a 0 segment
+	for _, size := range []int{0, 1, 254, 255, 256, 510, 4000} {
+		s := newOggStream()
+		packet := bytes.Repeat([]byte{0xa5}, size)
+
+		pages, err := readOggPages(s.page(packet, 7, 0))
+		if err != nil {
+			t.Fatalf("Packet of %d bytes: %v", size, err)
+		}
+		if len(pages) != 1 || !bytes.Equal(pages[0].packet, packet) || pages[0].granule != 7 {
+			t.Errorf("Packet of %d bytes not read back", size)
+		}
+	}
+}
+
+func TestOggFLACRoundTrip(t *testing.T) {
+
+	format := DefaultAudioFormat
+	pcm := testSignal(format, 4*flacBlockSize+1000)
+
+	e, err := newOggFLACEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := e.begin(map[string]string{"TITLE": "Test"})
+	stream = append(stream, e.encode(pcm[:len(pcm)/2])...)
+	stream = append(stream, e.encode(pcm[len(pcm)/2:])...)
+	stream = append(stream, e.end()...)
+
+	pages, err := readOggPages(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 7 {
+		t.Fatalf("%d pages, want 2 header and 5 audio pages", len(pages))
+	}
+
+	for n, p := range pages {
+		if p.serial != pages[0].serial || p.sequence != uint32(n) {
+			t.Errorf("Page %d: Serial %d, sequence %d", n, p.serial, p.sequence)
+		}
+	}
+	if pages[0].flags != oggBOS || pages[len(pages)-1].flags != oggEOS {
+		t.Errorf("Flags of the first page %#x, of the last page %#x", pages[0].flags, pages[len(pages)-1].flags)
+	}
+
+	// Ogg FLAC mapping: 0x7F "FLAC", version 1.0, 1 more header packet, then
+	// "fLaC" and the STREAMINFO block
+	first := pages[0].packet
+	if len(first) != 13+4+34 || !bytes.Equal(first[:13], []byte{0x7f, 'F', 'L', 'A', 'C', 1, 0, 0, 1, 'f', 'L', 'a', 'C'}) {
+		t.Fatalf("First packet % x", first)
+	}
+	if first[13] != 0 || int(first[14])<<16|int(first[15])<<8|int(first[16]) != 34 {
+		t.Errorf("STREAMINFO block header % x", first[13:17])
+	}
+	info := first[17:]
+	if binary.BigEndian.Uint16(info) != flacBlockSize || binary.BigEndian.Uint16(info[2:]) != flacBlockSize {
+		t.Errorf("STREAMINFO block sizes % x", info[:4])
+	}
+	samplerate := int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+	channels := int(info[12]>>1&0x7) + 1
+	bits := int(info[12]&1)<<4 | int(info[13]>>4) + 1
+	if samplerate != format.Samplerate || channels != format.Channels || bits != 16 {
+		t.Errorf("STREAMINFO %d Hz, %d channels, %d bits", samplerate, channels, bits)
+	}
+
+	comment := pages[1].packet
+	if comment[0] != 0x84 || !bytes.Contains(comment, []byte("TITLE=Test")) {
+		t.Errorf("Comment packet % x", comment)
+	}
+
+	decoded := []byte{}
+	samples := int64(0)
+	for n, p := range pages[2:] {
+		s, err := decodeFLACFrame(p.packet, format, uint64(n))
+		if err != nil {
+			t.Fatalf("Frame %d: %v", n, err)
+		}
+		for _, v := range s {
+			decoded = append(decoded, byte(v), byte(uint16(v)>>8))
+		}
+
+		// The granule position is the number of samples up to the end of the page
+		samples += int64(len(s) / format.Channels)
+		if p.granule != samples {
+			t.Errorf("Page %d: Granule %d, want %d", n+2, p.granule, samples)
+		}
+	}
+
+	if !bytes.Equal(decoded, pcm) {
+		t.Errorf("Decoded pcm differs")
+	}
+}
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PCM stream protocol
+//
+// Every packet starts with a 40 byte header, all fields big endian:
+//
+//   0  magic "RBPC"
+//   4  version (1)
+//   5  type: 1 = stream info (JSON payload), 2 = audio
+//   6  header length (40)
+//   8  sequence number, counts all packets of the handler
+//  12  payload length
+//  16  session id
+//  24  offset of the first frame in the session
+//  32  samplerate
+//  36  channels
+//  37  bytes per sample
+//  38  reserved
+//
+// Audio payloads are interleaved pcm in the format of the stream info. A
+// stream info packet is sent first on every connection, on every session
+// change and once per second over udp. Receivers detect lost packets by
+// gaps in the sequence numbers and lost audio by gaps in the offsets.
+
+const (
+	pcmStreamVersion    = 1
+	pcmStreamHeaderSize = 40
+	pcmStreamInfo       = 1
+	pcmStreamAudio      = 2
+
+	// pcmStreamQueueSize is the number of packets a receiver may lag behind
+	// before packets are dropped
+	pcmStreamQueueSize = 256
+	// pcmStreamUDPPayload keeps udp packets below the ethernet mtu
+	pcmStreamUDPPayload = 1400 - pcmStreamHeaderSize
+	// pcmStreamTCPPayload limits the size of tcp packets
+	pcmStreamTCPPayload = 64 * 1024
+	// pcmStreamTimeout limits connecting and every write
+	pcmStreamTimeout = time.Second * 10
+	// pcmStreamMaxRetryDelay limits the time between two connection attempts
+	pcmStreamMaxRetryDelay = time.Second * 30
+)
+
+// PCMStreamMode selects how receivers are reached
+type PCMStreamMode string
+
+// PCMStreamModes
+const (
+	// PCMStreamTCPServer accepts any number of receivers
+	PCMStreamTCPServer PCMStreamMode = "tcp-server"
+	// PCMStreamTCPClient connects to one receiver and reconnects on errors
+	PCMStreamTCPClient PCMStreamMode = "tcp-client"
+	// PCMStreamUDP sends datagrams to an unicast, broadcast or multicast address
+	PCMStreamUDP PCMStreamMode = "udp"
+)
+
+// PCMStreamInfo is the payload of stream info packets
+type PCMStreamInfo struct {
+	RecorderID     string `json:"recorderId"`
+	SessionID      string `json:"sessionId"`
+	Samplerate     int    `json:"samplerate"`
+	Channels       int    `json:"channels"`
+	SampleFormat   string `json:"sampleFormat"`
+	BytesPerSample int    `json:"bytesPerSample"`
+}
+
+type pcmStreamClient struct {
+	output  chan []byte
+	conn    net.Conn
+	dropped bool
+	done    chan struct{}
+}
+
+// PCMStreamHandler streams raw pcm with a small framing header over tcp or
+// udp, see the protocol description above
+type PCMStreamHandler struct {
+	mode        PCMStreamMode
+	address     string
+	recorderID  string
+	eventStream chan Event
+
+	mutex     sync.Mutex
+	format    AudioFormat
+	sessionID string
+	sequence  uint32
+	offset    uint64
+	lastInfo  time.Time
+	clients   map[*pcmStreamClient]struct{}
+}
+
+// NewPCMStreamHandler factory. address is the address to listen on in
+// server mode, or the address of the receiver.
+func NewPCMStreamHandler(mode PCMStreamMode, address, recorderID string) (*PCMStreamHandler, error) {
+
+	ret := &PCMStreamHandler{
+		mode:       mode,
+		address:    address,
+		recorderID: recorderID,
+		format:     DefaultAudioFormat,
+		clients:    map[*pcmStreamClient]struct{}{},
+	}
+
+	switch mode {
+	case PCMStreamTCPServer:
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot listen on %s: %v", address, err)
+		}
+		go ret.accept(listener)
+	case PCMStreamTCPClient:
+		go ret.dial()
+	case PCMStreamUDP:
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open udp socket: %v", err)
+		}
+		ret.add(conn)
+	default:
+		return nil, fmt.Errorf("Unknown pcm stream mode %s", mode)
+	}
+
+	return ret, nil
+}
+
+func (psh *PCMStreamHandler) setEventStream(s chan Event) {
+	psh.eventStream = s
+}
+
+func (psh *PCMStreamHandler) setFormat(f AudioFormat) {
+	psh.mutex.Lock()
+	defer psh.mutex.Unlock()
+	psh.format = f
+}
+
+func (psh *PCMStreamHandler) setSession(s *Session) {
+	psh.mutex.Lock()
+	defer psh.mutex.Unlock()
+
+	psh.sessionID = s.ID()
+	psh.offset = 0
+	psh.send(psh.infoPacket())
+}
+
+func (psh *PCMStreamHandler) store(b []byte) {
+	psh.mutex.Lock()
+	defer psh.mutex.Unlock()
+
+	if len(psh.clients) == 0 {
+		psh.offset += uint64(len(b) / psh.format.BytesPerFrame())
+		return
+	}
+
+	if psh.mode == PCMStreamUDP && time.Since(psh.lastInfo) >= time.Second {
+		psh.send(psh.infoPacket())
+	}
+
+	maxPayload := pcmStreamTCPPayload
+	if psh.mode == PCMStreamUDP {
+		maxPayload = pcmStreamUDPPayload
+	}
+	maxPayload = maxPayload / psh.format.BytesPerFrame() * psh.format.BytesPerFrame()
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		psh.send(psh.packet(pcmStreamAudio, b[:n]))
+		psh.offset += uint64(n / psh.format.BytesPerFrame())
+		b = b[n:]
+	}
+}
+
+// packet returns a packet with the current sequence number and offset, the
+// mutex has to be held
+func (psh *PCMStreamHandler) packet(packetType byte, payload []byte) []byte {
+
+	session, _ := strconv.ParseUint(psh.sessionID, 10, 64)
+
+	p := make([]byte, pcmStreamHeaderSize, pcmStreamHeaderSize+len(payload))
+	copy(p, "RBPC")
+	p[4] = pcmStreamVersion
+	p[5] = packetType
+	binary.BigEndian.PutUint16(p[6:], pcmStreamHeaderSize)
+	binary.BigEndian.PutUint32(p[8:], psh.sequence)
+	binary.BigEndian.PutUint32(p[12:], uint32(len(payload)))
+	binary.BigEndian.PutUint64(p[16:], session)
+	binary.BigEndian.PutUint64(p[24:], psh.offset)
+	binary.BigEndian.PutUint32(p[32:], uint32(psh.format.Samplerate))
+	p[36] = byte(psh.format.Channels)
+	p[37] = byte(psh.format.BytesPerSample)
+
+	psh.sequence++
+	return append(p, payload...)
+}
+
+// infoPacket returns a stream info packet, the mutex has to be held
+func (psh *PCMStreamHandler) infoPacket() []byte {
+	psh.lastInfo = time.Now()
+
+	info, _ := json.Marshal(PCMStreamInfo{
+		RecorderID:     psh.recorderID,
+		SessionID:      psh.sessionID,
+		Samplerate:     psh.format.Samplerate,
+		Channels:       psh.format.Channels,
+		SampleFormat:   psh.format.SampleFormat,
+		BytesPerSample: psh.format.BytesPerSample,
+	})
+	return psh.packet(pcmStreamInfo, info)
+}
+
+// send queues p for all clients, the mutex has to be held
+func (psh *PCMStreamHandler) send(p []byte) {
+	for c := range psh.clients {
+		select {
+		case c.output <- p:
+			c.dropped = false
+		default:
+			// Receivers see the gap in the sequence numbers
+			if !c.dropped {
+				sendEvent(psh.eventStream, "PCMStreamHandler", EventDataDropped, "%s is too slow, dropping packets", c.conn.RemoteAddr())
+			}
+			c.dropped = true
+		}
+	}
+}
+
+// add registers a receiver, which starts with a stream info packet
+func (psh *PCMStreamHandler) add(conn net.Conn) *pcmStreamClient {
+	psh.mutex.Lock()
+	defer psh.mutex.Unlock()
+
+	c := &pcmStreamClient{
+		output: make(chan []byte, pcmStreamQueueSize),
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	c.output <- psh.infoPacket()
+	psh.clients[c] = struct{}{}
+
+	go psh.write(c)
+
+	return c
+}
+
+func (psh *PCMStreamHandler) write(c *pcmStreamClient) {
+	defer close(c.done)
+
+	for p := range c.output {
+		c.conn.SetWriteDeadline(time.Now().Add(pcmStreamTimeout))
+		if _, err := c.conn.Write(p); err != nil {
+			if psh.mode == PCMStreamUDP {
+				// Nobody listening or no route, the next packet may succeed
+				continue
+			}
+			fmt.Printf("PCM stream: %s disconnected: %v\n", c.conn.RemoteAddr(), err)
+			break
+		}
+	}
+
+	psh.mutex.Lock()
+	delete(psh.clients, c)
+	psh.mutex.Unlock()
+	c.conn.Close()
+}
+
+func (psh *PCMStreamHandler) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			sendEvent(psh.eventStream, "PCMStreamHandler", EventWriteError, "Cannot accept connections: %v", err)
+			return
+		}
+		fmt.Printf("PCM stream: %s connected\n", conn.RemoteAddr())
+		psh.add(conn)
+	}
+}
+
+func (psh *PCMStreamHandler) dial() {
+	retryWait := time.Second
+	failing := false
+
+	for {
+		conn, err := net.DialTimeout("tcp", psh.address, pcmStreamTimeout)
+		if err != nil {
+			if !failing {
+				sendEvent(psh.eventStream, "PCMStreamHandler", EventWriteError, "Cannot connect to %s: %v", psh.address, err)
+			}
+			failing = true
+
+			time.Sleep(retryWait)
+			if retryWait *= 2; retryWait > pcmStreamMaxRetryDelay {
+				retryWait = pcmStreamMaxRetryDelay
+			}
+			continue
+		}
+
+		if failing {
+			failing = false
+			sendEvent(psh.eventStream, "PCMStreamHandler", EventRecovered, "Streaming to %s", psh.address)
+		}
+		retryWait = time.Second
+
+		fmt.Printf("PCM stream: Connected to %s\n", psh.address)
+		c := psh.add(conn)
+		<-c.done
+	}
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteMaxAttempts is the number of times a file is tried to be written
+const remoteMaxAttempts = 6
+
+// remoteFileSystem is a remote server files can be written to
+type remoteFileSystem interface {
+	// put writes size bytes from r into the file name. The file must not
+	// be visible under name before it is complete.
+	put(name string, r io.Reader, size int64) error
+}
+
+// remoteFile is a file waiting to be written to the remote server. The
+// content is either data or the local file spoolPath.
+type remoteFile struct {
+	sessionID string
+	name      string
+	data      []byte
+	spoolPath string
+	// last is true for the last file of a session
+	last bool
+}
+
+func (f *remoteFile) open() (io.ReadCloser, int64, error) {
+	if f.spoolPath == "" {
+		return ioutil.NopCloser(bytes.NewReader(f.data)), int64(len(f.data)), nil
+	}
+
+	file, err := os.Open(f.spoolPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// retry calls f until it succeeds or attempts is reached, the time
+// between attempts doubles every time
+func retry(name string, attempts int, f func() error) error {
+
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt < attempts {
+			fmt.Printf("%s: Attempt %d failed: %v\n", name, attempt, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// remoteUploader writes chunks or whole sessions to a remote file system
+// in the background. It queues, retries and reports like the http upload
+// and uses the same file names as the chunk storage handler. Handlers embed
+// it and provide the remote file system.
+//
+// With a chunkSize of 0 every session is spooled into spoolDir and written
+// as one file when the session ends. Files which cannot be written, or do
+// not fit into the queue, are kept in spoolDir. They are written again at
+// startup and when the remote server works again.
+type remoteUploader struct {
+	name        string
+	recorderID  string
+	chunkSize   int
+	spoolDir    string
+	fs          remoteFileSystem
+	mutex       sync.Mutex
+	tracker     *UploadTracker
+	eventStream chan Event
+	files       chan remoteFile
+	failing     bool
+	// current is the id of the session being recorded
+	current string
+	// queued are the spool files which are recorded or queued
+	queued map[string]bool
+	// held are the spool files of this run which wait to be written again,
+	// they are still pending in the tracker
+	held map[string]bool
+
+	// only used by store and setSession
+	session    *Session
+	chunkCount int
+	buffer     bytes.Buffer
+	spool      *os.File
+}
+
+func newRemoteUploader(name, recorderID string, chunkSize int, spoolDir string, fs remoteFileSystem) *remoteUploader {
+
+	ret := &remoteUploader{
+		name:       name,
+		recorderID: recorderID,
+		chunkSize:  chunkSize,
+		spoolDir:   path.Join(spoolDir, name),
+		fs:         fs,
+		files:      make(chan remoteFile, uploadQueueSize),
+		queued:     map[string]bool{},
+		held:       map[string]bool{},
+	}
+
+	return ret
+}
+
+// SetUploadTracker sets a tracker which is informed about every file
+func (ru *remoteUploader) SetUploadTracker(t *UploadTracker) {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+	ru.tracker = t
+}
+
+func (ru *remoteUploader) getTracker() *UploadTracker {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+	return ru.tracker
+}
+
+// setEventStream is called when the handler is added to the manager, the
+// files left over from the last run are written from then on
+func (ru *remoteUploader) setEventStream(s chan Event) {
+	ru.eventStream = s
+	go ru.run()
+}
+
+func (ru *remoteUploader) setSession(s *Session) {
+	ru.endSession()
+
+	ru.session = s
+	ru.chunkCount = 0
+
+	ru.mutex.Lock()
+	ru.current = s.ID()
+	ru.mutex.Unlock()
+
+	if ru.chunkSize > 0 {
+		return
+	}
+
+	if err := os.MkdirAll(ru.spoolDir, 0777); err != nil {
+		sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot create spool directory: %v", err)
+		return
+	}
+
+	spoolPath := path.Join(ru.spoolDir, sessionFileName(ru.recorderID, s.ID()))
+	ru.mutex.Lock()
+	ru.queued[spoolPath] = true
+	ru.mutex.Unlock()
+
+	spool, err := os.Create(spoolPath)
+	if err != nil {
+		sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot create spool file: %v", err)
+		ru.mutex.Lock()
+		delete(ru.queued, spoolPath)
+		ru.mutex.Unlock()
+		return
+	}
+	ru.spool = spool
+}
+
+func (ru *remoteUploader) finishSession() {
+
+	sessionID := ru.session.ID()
+
+	if ru.spool != nil {
+		spoolPath := ru.spool.Name()
+		if err := ru.spool.Close(); err != nil {
+			sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot close spool file: %v", err)
+		}
+		ru.spool = nil
+		ru.queue(remoteFile{sessionID: sessionID, name: sessionFileName(ru.recorderID, sessionID), spoolPath: spoolPath})
+	} else if ru.buffer.Len() > 0 {
+		ru.queue(remoteFile{sessionID: sessionID, name: chunkFileName(ru.recorderID, sessionID, ru.chunkCount), data: append([]byte{}, ru.buffer.Bytes()...)})
+	}
+	ru.buffer.Reset()
+
+	metadata, err := ru.session.MarshalJSON()
+	if err != nil {
+		sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot marshal session: %v", err)
+		return
+	}
+	ru.queue(remoteFile{sessionID: sessionID, name: ru.session.MetadataFileName(), data: metadata, last: true})
+}
+
+func (ru *remoteUploader) endSession() {
+	if ru.session != nil {
+		ru.finishSession()
+		ru.session = nil
+
+		ru.mutex.Lock()
+		ru.current = ""
+		ru.mutex.Unlock()
+	}
+}
+
+func (ru *remoteUploader) store(b []byte) {
+
+	if ru.session == nil {
+		return
+	}
+
+	if ru.chunkSize == 0 {
+		if ru.spool == nil {
+			return
+		}
+		if _, err := ru.spool.Write(b); err != nil {
+			sendEvent(ru.eventStream, ru.name, EventDataDropped, "Cannot write spool file: %v", err)
+		}
+		return
+	}
+
+	ru.buffer.Write(b)
+
+	for ru.buffer.Len() >= ru.chunkSize {
+		sessionID := ru.session.ID()
+		ru.queue(remoteFile{sessionID: sessionID, name: chunkFileName(ru.recorderID, sessionID, ru.chunkCount), data: append([]byte{}, ru.buffer.Next(ru.chunkSize)...)})
+		ru.chunkCount++
+	}
+}
+
+func (ru *remoteUploader) queue(f remoteFile) {
+
+	tracker := ru.getTracker()
+	if tracker != nil {
+		tracker.begin(f.sessionID)
+	}
+
+	// Whole sessions and metadata are never dropped, chunks are
+	if f.spoolPath != "" || f.last {
+		ru.files <- f
+		return
+	}
+
+	select {
+	case ru.files <- f:
+	default:
+		if err := ru.hold(f); err != nil {
+			sendEvent(ru.eventStream, ru.name, EventDataDropped, "Upload queue full, dropped %s: %v", f.name, err)
+			if tracker != nil {
+				tracker.done(f.sessionID, fmt.Errorf("Dropped"))
+			}
+			return
+		}
+		sendEvent(ru.eventStream, ru.name, EventWriteError, "Upload queue full, spooled %s", f.name)
+	}
+}
+
+// hold keeps a file which could not be written in the spool directory, it
+// stays pending in the tracker until it is written by resend
+func (ru *remoteUploader) hold(f remoteFile) error {
+
+	spoolPath := f.spoolPath
+	if spoolPath == "" {
+		if err := os.MkdirAll(ru.spoolDir, 0777); err != nil {
+			return fmt.Errorf("Cannot create spool directory: %v", err)
+		}
+		spoolPath = path.Join(ru.spoolDir, f.name)
+		if err := ioutil.WriteFile(spoolPath, f.data, 0666); err != nil {
+			os.Remove(spoolPath)
+			return fmt.Errorf("Cannot write spool file: %v", err)
+		}
+	}
+
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+	delete(ru.queued, spoolPath)
+	ru.held[spoolPath] = true
+	return nil
+}
+
+func (ru *remoteUploader) run() {
+
+	// Files left over from the last run
+	ru.resend()
+
+	for f := range ru.files {
+		err := retry(ru.name, remoteMaxAttempts, func() error { return ru.write(f) })
+		tracker := ru.getTracker()
+
+		if err != nil {
+			ru.failing = true
+			sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot write %s: %v", f.name, err)
+
+			// A held file stays pending until resend writes it
+			if holdErr := ru.hold(f); holdErr != nil {
+				sendEvent(ru.eventStream, ru.name, EventDataDropped, "Dropped %s: %v", f.name, holdErr)
+			} else {
+				if tracker != nil && f.last {
+					tracker.finish(f.sessionID)
+				}
+				continue
+			}
+		} else if f.spoolPath != "" {
+			os.Remove(f.spoolPath)
+			ru.mutex.Lock()
+			delete(ru.queued, f.spoolPath)
+			ru.mutex.Unlock()
+		}
+
+		if tracker != nil {
+			tracker.done(f.sessionID, err)
+			if f.last {
+				tracker.finish(f.sessionID)
+			}
+		}
+
+		if err == nil && ru.failing {
+			ru.failing = false
+			sendEvent(ru.eventStream, ru.name, EventRecovered, "Writing %s", f.name)
+			ru.resend()
+		}
+	}
+}
+
+// spoolSessionID returns the id of the session a spooled file belongs to
+func (ru *remoteUploader) spoolSessionID(name string) string {
+	id := strings.TrimPrefix(name, ru.recorderID+"_")
+	if i := strings.IndexAny(id, "_."); i >= 0 {
+		id = id[:i]
+	}
+	return id
+}
+
+// resend writes the files in the spool directory which are neither
+// recorded nor queued. It stops at the first file which fails.
+func (ru *remoteUploader) resend() {
+
+	infos, err := ioutil.ReadDir(ru.spoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot read spool directory: %v", err)
+		}
+		return
+	}
+
+	ru.mutex.Lock()
+	current := ru.current
+	files := []remoteFile{}
+	remaining := map[string]int{}
+	for _, info := range infos {
+		spoolPath := path.Join(ru.spoolDir, info.Name())
+		if info.IsDir() || ru.queued[spoolPath] {
+			continue
+		}
+		f := remoteFile{sessionID: ru.spoolSessionID(info.Name()), name: info.Name(), spoolPath: spoolPath}
+		files = append(files, f)
+		remaining[f.sessionID]++
+	}
+	ru.mutex.Unlock()
+
+	if len(files) > 0 {
+		fmt.Printf("%s: Writing %d spooled files\n", ru.name, len(files))
+	}
+
+	for _, f := range files {
+		tracker := ru.getTracker()
+
+		ru.mutex.Lock()
+		held := ru.held[f.spoolPath]
+		ru.mutex.Unlock()
+
+		// Files of the last run are not known to the tracker yet
+		if !held && tracker != nil {
+			tracker.begin(f.sessionID)
+		}
+
+		if err := retry(ru.name, remoteMaxAttempts, func() error { return ru.write(f) }); err != nil {
+			ru.failing = true
+			sendEvent(ru.eventStream, ru.name, EventWriteError, "Cannot write %s: %v", f.name, err)
+			if !held {
+				ru.mutex.Lock()
+				ru.held[f.spoolPath] = true
+				ru.mutex.Unlock()
+			}
+			return
+		}
+
+		os.Remove(f.spoolPath)
+		ru.mutex.Lock()
+		delete(ru.held, f.spoolPath)
+		ru.mutex.Unlock()
+
+		if tracker != nil {
+			tracker.done(f.sessionID, nil)
+			// Sessions of the last run are complete when all their files are written
+			remaining[f.sessionID]--
+			if remaining[f.sessionID] == 0 && f.sessionID != current {
+				tracker.finish(f.sessionID)
+			}
+		}
+	}
+}
+
+func (ru *remoteUploader) write(f remoteFile) error {
+	r, size, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return ru.fs.put(f.name, r, size)
+}
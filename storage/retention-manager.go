@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetentionPolicy describes how much local storage may be used
+type RetentionPolicy struct {
+	// MaxUsage is the maximum number of bytes all sessions may use, 0 means unlimited
+	MaxUsage int64
+	// MinFree is the number of bytes which have to stay free on the file system
+	MinFree int64
+	// MaxAge is the age after which sessions are deleted, 0 means forever
+	MaxAge time.Duration
+	// Interval is the time between two checks
+	Interval time.Duration
+	// RequireUpload keeps sessions until they are uploaded. Without an
+	// uploader it has to be false, then sessions are deleted by the limits
+	// above only.
+	RequireUpload bool
+	// MaxUploadWait is the time after which a session which is still not
+	// uploaded, e.g. because a chunk failed, may be deleted anyway. It is
+	// off with 0, the default, so sessions are kept until they are uploaded.
+	MaxUploadWait time.Duration
+	// EmergencyFree is the number of free bytes below which the oldest
+	// sessions are deleted even if they are not uploaded, so recording can
+	// go on. It is off with 0, the default.
+	EmergencyFree int64
+}
+
+// Usage reports the state of local storage
+type Usage struct {
+	Used     int64 `json:"used"`
+	Free     int64 `json:"free"`
+	Total    int64 `json:"total"`
+	Sessions int   `json:"sessions"`
+	// Pending is the number of sessions which may not be deleted yet
+	Pending int `json:"pending"`
+}
+
+func (u *Usage) String() string {
+	return fmt.Sprintf("Storage: %d sessions (%d pending), %d MiB used, %d of %d MiB free",
+		u.Sessions, u.Pending, u.Used>>20, u.Free>>20, u.Total>>20)
+}
+
+// localSession collects all files of a session in the storage directories
+type localSession struct {
+	id       string
+	files    []string
+	size     int64
+	modified time.Time
+}
+
+// RetentionManager deletes old sessions from local storage directories.
+// The current session is never deleted. With RequireUpload, sessions which
+// have not been uploaded yet are kept unless MaxUploadWait or EmergencyFree
+// are set explicitly.
+type RetentionManager struct {
+	dirs        []string
+	recorderID  string
+	policy      RetentionPolicy
+	manager     *Manager
+	isUploaded  func(sessionID string) bool
+	usageStream chan Usage
+}
+
+// NewRetentionManager factory. isUploaded tells if a session has been
+// uploaded and is only used with policy.RequireUpload, usageStream receives
+// the usage after every check if not nil.
+func NewRetentionManager(dirs []string, recorderID string, policy RetentionPolicy, manager *Manager, isUploaded func(sessionID string) bool, usageStream chan Usage) *RetentionManager {
+
+	ret := &RetentionManager{
+		dirs:        dirs,
+		recorderID:  recorderID,
+		policy:      policy,
+		manager:     manager,
+		isUploaded:  isUploaded,
+		usageStream: usageStream,
+	}
+	go ret.run()
+
+	return ret
+}
+
+func (r *RetentionManager) run() {
+	fmt.Printf("Starting retention manager\n")
+	for {
+		usage, err := r.apply()
+		if err != nil {
+			fmt.Printf("Retention manager: %v\n", err)
+		} else if r.usageStream != nil {
+			r.usageStream <- usage
+		}
+		time.Sleep(r.policy.Interval)
+	}
+}
+
+// sessionID extracts the session id from a file name like
+// <recorderID>_<sessionID>_... or <recorderID>_<sessionID>.ext
+func (r *RetentionManager) sessionID(fileName string) (string, bool) {
+	prefix := r.recorderID + "_"
+	if !strings.HasPrefix(fileName, prefix) {
+		return "", false
+	}
+
+	rest := fileName[len(prefix):]
+	if i := strings.IndexAny(rest, "_."); i > 0 {
+		return rest[:i], true
+	}
+	return "", false
+}
+
+func (r *RetentionManager) scan() ([]*localSession, error) {
+
+	sessions := map[string]*localSession{}
+
+	for _, dir := range r.dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("Cannot read %s: %v", dir, err)
+		}
+
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+
+			id, ok := r.sessionID(info.Name())
+			if !ok {
+				continue
+			}
+
+			s, ok := sessions[id]
+			if !ok {
+				s = &localSession{id: id}
+				sessions[id] = s
+			}
+			s.files = append(s.files, path.Join(dir, info.Name()))
+			s.size += info.Size()
+			if info.ModTime().After(s.modified) {
+				s.modified = info.ModTime()
+			}
+		}
+	}
+
+	ret := []*localSession{}
+	for _, s := range sessions {
+		ret = append(ret, s)
+	}
+
+	// Oldest first
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].modified.Before(ret[j].modified)
+	})
+
+	return ret, nil
+}
+
+func (r *RetentionManager) fileSystem() (free, total int64, err error) {
+
+	// All directories are expected to live on the same file system
+	var stat syscall.Statfs_t
+	for _, dir := range r.dirs {
+		if err = syscall.Statfs(dir, &stat); err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+		}
+	}
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot stat file system: %v", err)
+	}
+	return 0, 0, nil
+}
+
+func (r *RetentionManager) isCurrent(s *localSession) bool {
+	current := r.manager.Session()
+	return current != nil && current.ID() == s.id
+}
+
+func (r *RetentionManager) deletable(s *localSession) bool {
+
+	if r.isCurrent(s) {
+		return false
+	}
+
+	if !r.policy.RequireUpload || (r.isUploaded != nil && r.isUploaded(s.id)) {
+		return true
+	}
+
+	// The upload failed or got lost, the session is not kept forever
+	return r.policy.MaxUploadWait > 0 && time.Since(s.modified) > r.policy.MaxUploadWait
+}
+
+func (r *RetentionManager) delete(s *localSession) {
+	fmt.Printf("Retention manager: Deleting session %s (%d MiB)\n", s.id, s.size>>20)
+	for _, f := range s.files {
+		if err := os.Remove(f); err != nil {
+			fmt.Printf("Cannot delete %s: %v\n", f, err)
+		}
+	}
+}
+
+func (r *RetentionManager) apply() (Usage, error) {
+
+	sessions, err := r.scan()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	free, total, err := r.fileSystem()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var used int64
+	for _, s := range sessions {
+		used += s.size
+	}
+
+	kept := []*localSession{}
+	for _, s := range sessions {
+		if !r.deletable(s) {
+			kept = append(kept, s)
+			continue
+		}
+
+		tooOld := r.policy.MaxAge > 0 && time.Since(s.modified) > r.policy.MaxAge
+		tooBig := r.policy.MaxUsage > 0 && used > r.policy.MaxUsage
+		tooFull := r.policy.MinFree > 0 && free < r.policy.MinFree
+
+		if tooOld || tooBig || tooFull {
+			if r.policy.RequireUpload && (r.isUploaded == nil || !r.isUploaded(s.id)) {
+				fmt.Printf("Retention manager: Session %s is not uploaded after %v, giving up\n", s.id, r.policy.MaxUploadWait)
+			}
+			r.delete(s)
+			used -= s.size
+			free += s.size
+			continue
+		}
+
+		kept = append(kept, s)
+	}
+
+	// Rather lose sessions which are not uploaded than stop recording
+	if r.policy.EmergencyFree > 0 && free < r.policy.EmergencyFree {
+		remaining := []*localSession{}
+		for _, s := range kept {
+			if free >= r.policy.EmergencyFree || r.isCurrent(s) {
+				remaining = append(remaining, s)
+				continue
+			}
+			fmt.Printf("Retention manager: Free space below %d MiB, deleting session %s although it is not uploaded\n", r.policy.EmergencyFree>>20, s.id)
+			r.delete(s)
+			used -= s.size
+			free += s.size
+		}
+		kept = remaining
+	}
+
+	usage := Usage{
+		Used:     used,
+		Free:     free,
+		Total:    total,
+		Sessions: len(kept),
+	}
+	for _, s := range kept {
+		if !r.deletable(s) {
+			usage.Pending++
+		}
+	}
+
+	if (r.policy.MaxUsage > 0 && used > r.policy.MaxUsage) || (r.policy.MinFree > 0 && free < r.policy.MinFree) {
+		fmt.Printf("Retention manager: Storage limits exceeded, but %d sessions are not uploaded yet\n", usage.Pending)
+	}
+
+	return usage, nil
+}
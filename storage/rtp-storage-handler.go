@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// rtpQueueSize is the number of buffers waiting to be sent before
+	// buffers are dropped
+	rtpQueueSize = 64
+	// rtpMaxLag is how far sending may fall behind before the stream is
+	// resynchronized to the clock
+	rtpMaxLag = time.Millisecond * 20
+	// rtpMaxPayload keeps packets below the ethernet mtu
+	rtpMaxPayload = 1440
+	// rtpRetryDelay is the time between two attempts to open the socket
+	rtpRetryDelay = time.Second * 10
+	// sapInterval is the time between two announcements
+	sapInterval = time.Second * 30
+	// sapAddress is the SAP group for administratively scoped sessions
+	sapAddress = "239.255.255.255:9875"
+	// taiOffset is the difference between PTP time (TAI) and UTC
+	taiOffset = time.Second * 37
+)
+
+// RTPConfig describes an AES67 compatible RTP stream
+type RTPConfig struct {
+	// Destination is the multicast group and port, e.g. 239.69.83.1:5004
+	Destination string
+	// Interface to send from, the default route is used if empty
+	Interface string
+	// Encoding is L16 or L24, defaults to L24
+	Encoding string
+	// PayloadType defaults to 96
+	PayloadType int
+	// PacketTime defaults to 1ms, AES67 allows 125µs to 4ms
+	PacketTime time.Duration
+	// TTL of the multicast packets, defaults to 16
+	TTL int
+	// SessionName shown by receivers, defaults to the recorder id
+	SessionName string
+	// PTPClock is the grandmaster the system clock is synchronized to,
+	// e.g. IEEE1588-2008:00-1D-C1-FF-FE-12-34-56:0. Timestamps are derived
+	// from the system clock, so it has to be disciplined by ptp4l/phc2sys
+	// for receivers which lock to PTP. Empty announces the local clock.
+	PTPClock string
+	// Announce enables SAP announcements of the stream
+	Announce bool
+}
+
+// RTPStorageHandler sends the input as RTP multicast stream as specified by
+// AES67. Packets are paced to the packet time, the stream is optionally
+// announced via SAP/SDP so receivers can find it.
+type RTPStorageHandler struct {
+	config      RTPConfig
+	recorderID  string
+	format      AudioFormat
+	eventStream chan Event
+	input       chan []byte
+
+	// only used by run
+	conn        *ipv4.PacketConn
+	destination *net.UDPAddr
+	origin      net.IP
+	sdp         []byte
+	ssrc        uint32
+	sequence    uint16
+	timestamp   uint32
+	started     time.Time
+	sent        uint64
+	pending     []byte
+	failing     bool
+	nextTry     time.Time
+}
+
+// NewRTPStorageHandler factory
+func NewRTPStorageHandler(config RTPConfig, recorderID string) *RTPStorageHandler {
+
+	if config.Encoding == "" {
+		config.Encoding = "L24"
+	}
+	if config.PayloadType == 0 {
+		config.PayloadType = 96
+	}
+	if config.PacketTime == 0 {
+		config.PacketTime = time.Millisecond
+	}
+	if config.TTL == 0 {
+		config.TTL = 16
+	}
+	if config.SessionName == "" {
+		config.SessionName = recorderID
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	ret := &RTPStorageHandler{
+		config:     config,
+		recorderID: recorderID,
+		format:     DefaultAudioFormat,
+		input:      make(chan []byte, rtpQueueSize),
+		ssrc:       random.Uint32(),
+		sequence:   uint16(random.Uint32()),
+	}
+
+	go ret.run()
+
+	return ret
+}
+
+func (rsh *RTPStorageHandler) setEventStream(s chan Event) {
+	rsh.eventStream = s
+}
+
+func (rsh *RTPStorageHandler) setFormat(f AudioFormat) {
+	rsh.format = f
+}
+
+func (rsh *RTPStorageHandler) store(b []byte) {
+	select {
+	case rsh.input <- b:
+	default:
+		if !rsh.failing {
+			sendEvent(rsh.eventStream, "RTPStorageHandler", EventDataDropped, "Stream is too slow, dropping audio")
+		}
+	}
+}
+
+func (rsh *RTPStorageHandler) run() {
+
+	announce := time.NewTicker(sapInterval)
+	defer announce.Stop()
+
+	for {
+		select {
+		case b := <-rsh.input:
+			if rsh.conn == nil {
+				if time.Now().Before(rsh.nextTry) {
+					continue
+				}
+				if err := rsh.open(); err != nil {
+					rsh.fail(err)
+					continue
+				}
+				if rsh.failing {
+					rsh.failing = false
+					sendEvent(rsh.eventStream, "RTPStorageHandler", EventRecovered, "Streaming to %s", rsh.config.Destination)
+				}
+				rsh.announce()
+			}
+			rsh.send(b)
+
+		case <-announce.C:
+			rsh.announce()
+		}
+	}
+}
+
+func (rsh *RTPStorageHandler) fail(err error) {
+	if !rsh.failing {
+		sendEvent(rsh.eventStream, "RTPStorageHandler", EventWriteError, "%v", err)
+	}
+	rsh.failing = true
+	rsh.nextTry = time.Now().Add(rtpRetryDelay)
+}
+
+func (rsh *RTPStorageHandler) samplesPerPacket() int {
+	return int(time.Duration(rsh.format.Samplerate) * rsh.config.PacketTime / time.Second)
+}
+
+func (rsh *RTPStorageHandler) bytesPerSample() int {
+	if rsh.config.Encoding == "L16" {
+		return 2
+	}
+	return 3
+}
+
+func (rsh *RTPStorageHandler) open() error {
+
+	if rsh.format.BytesPerSample != 2 {
+		return fmt.Errorf("Cannot stream rtp: Unsupported sample format %s", rsh.format.SampleFormat)
+	}
+	if rsh.config.Encoding != "L16" && rsh.config.Encoding != "L24" {
+		return fmt.Errorf("Cannot stream rtp: Unsupported encoding %s", rsh.config.Encoding)
+	}
+	n := rsh.samplesPerPacket()
+	if n < 1 || n*rsh.format.Channels*rsh.bytesPerSample() > rtpMaxPayload {
+		return fmt.Errorf("Cannot stream rtp: Invalid packet time %v", rsh.config.PacketTime)
+	}
+
+	destination, err := net.ResolveUDPAddr("udp4", rsh.config.Destination)
+	if err != nil {
+		return fmt.Errorf("Cannot resolve %s: %v", rsh.config.Destination, err)
+	}
+
+	var iface *net.Interface
+	if rsh.config.Interface != "" {
+		if iface, err = net.InterfaceByName(rsh.config.Interface); err != nil {
+			return fmt.Errorf("Cannot find interface %s: %v", rsh.config.Interface, err)
+		}
+	}
+
+	origin, err := originAddress(iface, destination)
+	if err != nil {
+		return err
+	}
+
+	c, err := net.ListenPacket("udp4", origin.String()+":0")
+	if err != nil {
+		return fmt.Errorf("Cannot open socket: %v", err)
+	}
+
+	conn := ipv4.NewPacketConn(c)
+	if err := conn.SetMulticastTTL(rsh.config.TTL); err != nil {
+		conn.Close()
+		return fmt.Errorf("Cannot set ttl: %v", err)
+	}
+	if iface != nil {
+		if err := conn.SetMulticastInterface(iface); err != nil {
+			conn.Close()
+			return fmt.Errorf("Cannot set multicast interface: %v", err)
+		}
+	}
+
+	fmt.Printf("Streaming rtp to %s\n", destination)
+
+	rsh.conn = conn
+	rsh.destination = destination
+	rsh.origin = origin
+	rsh.sdp = rsh.sessionDescription()
+	rsh.started = time.Time{}
+	return nil
+}
+
+// originAddress returns the ipv4 address packets to destination are sent from
+func originAddress(iface *net.Interface, destination *net.UDPAddr) (net.IP, error) {
+
+	if iface == nil {
+		// Connecting an udp socket only looks up the route
+		c, err := net.DialUDP("udp4", nil, destination)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find route to %s: %v", destination, err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).IP, nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get address of %s: %v", iface.Name, err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("Interface %s has no ipv4 address", iface.Name)
+}
+
+// mediaClock returns the media clock at t, which is PTP time in samples
+func (rsh *RTPStorageHandler) mediaClock(t time.Time) uint32 {
+	t = t.Add(taiOffset)
+	rate := uint64(rsh.format.Samplerate)
+	return uint32(uint64(t.Unix())*rate + uint64(t.Nanosecond())*rate/uint64(time.Second))
+}
+
+// send splits b into packets and sends each at its time
+func (rsh *RTPStorageHandler) send(b []byte) {
+
+	n := rsh.samplesPerPacket()
+	packetBytes := n * rsh.format.BytesPerFrame()
+
+	rsh.pending = append(rsh.pending, b...)
+	for len(rsh.pending) >= packetBytes && rsh.conn != nil {
+
+		now := time.Now()
+		due := rsh.started.Add(time.Duration(rsh.sent) * time.Second / time.Duration(rsh.format.Samplerate))
+		if now.Sub(due) > rtpMaxLag {
+			// Startup or a gap in the input, the timestamps follow the clock again
+			rsh.started = now
+			rsh.sent = 0
+			rsh.timestamp = rsh.mediaClock(now)
+			due = now
+		}
+		time.Sleep(due.Sub(now))
+
+		packet := rsh.packet(rsh.pending[:packetBytes])
+		if _, err := rsh.conn.WriteTo(packet, nil, rsh.destination); err != nil {
+			rsh.conn.Close()
+			rsh.conn = nil
+			rsh.fail(fmt.Errorf("Cannot send rtp: %v", err))
+		}
+
+		rsh.pending = rsh.pending[packetBytes:]
+		rsh.sequence++
+		rsh.timestamp += uint32(n)
+		rsh.sent += uint64(n)
+	}
+	rsh.pending = append([]byte{}, rsh.pending...)
+}
+
+// packet returns an rtp packet with pcm converted to big endian L16 or L24
+func (rsh *RTPStorageHandler) packet(pcm []byte) []byte {
+
+	width := rsh.bytesPerSample()
+	samples := len(pcm) / 2
+
+	ret := make([]byte, 12+samples*width)
+	ret[0] = 0x80
+	ret[1] = byte(rsh.config.PayloadType & 0x7f)
+	binary.BigEndian.PutUint16(ret[2:], rsh.sequence)
+	binary.BigEndian.PutUint32(ret[4:], rsh.timestamp)
+	binary.BigEndian.PutUint32(ret[8:], rsh.ssrc)
+
+	payload := ret[12:]
+	for i := 0; i < samples; i++ {
+		payload[i*width] = pcm[i*2+1]
+		payload[i*width+1] = pcm[i*2]
+	}
+	return ret
+}
+
+func (rsh *RTPStorageHandler) sessionDescription() []byte {
+
+	ptime := strconv.FormatFloat(float64(rsh.config.PacketTime)/float64(time.Millisecond), 'f', -1, 64)
+
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- %d 0 IN IP4 %s", rsh.ssrc, rsh.origin),
+		fmt.Sprintf("s=%s", rsh.config.SessionName),
+		fmt.Sprintf("c=IN IP4 %s/%d", rsh.destination.IP, rsh.config.TTL),
+		"t=0 0",
+	}
+
+	refclk := ""
+	if rsh.config.PTPClock != "" {
+		refclk = "ptp=" + rsh.config.PTPClock
+		fields := strings.Split(rsh.config.PTPClock, ":")
+		lines = append(lines, fmt.Sprintf("a=clock-domain:PTPv2 %s", fields[len(fields)-1]))
+	} else {
+		refclk = "localmac=" + localMAC(rsh.origin)
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("m=audio %d RTP/AVP %d", rsh.destination.Port, rsh.config.PayloadType),
+		fmt.Sprintf("i=%d channels from %s", rsh.format.Channels, rsh.recorderID),
+		fmt.Sprintf("a=rtpmap:%d %s/%d/%d", rsh.config.PayloadType, rsh.config.Encoding, rsh.format.Samplerate, rsh.format.Channels),
+		"a=sendonly",
+		fmt.Sprintf("a=ptime:%s", ptime),
+		fmt.Sprintf("a=ts-refclk:%s", refclk),
+		"a=mediaclk:direct=0",
+	)
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// localMAC returns the hardware address of the interface with the given
+// address, formatted as in RFC 7273
+func localMAC(ip net.IP) string {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) && len(iface.HardwareAddr) > 0 {
+				return strings.ToUpper(strings.Replace(iface.HardwareAddr.String(), ":", "-", -1))
+			}
+		}
+	}
+	return "00-00-00-00-00-00"
+}
+
+// announce sends the session description as SAP packet (RFC 2974)
+func (rsh *RTPStorageHandler) announce() {
+	if !rsh.config.Announce || rsh.conn == nil {
+		return
+	}
+
+	sap, err := net.ResolveUDPAddr("udp4", sapAddress)
+	if err != nil {
+		return
+	}
+
+	hash := fnv.New32a()
+	hash.Write(rsh.sdp)
+
+	packet := []byte{0x20, 0, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:], uint16(hash.Sum32()))
+	packet = append(packet, rsh.origin.To4()...)
+	packet = append(packet, "application/sdp\x00"...)
+	packet = append(packet, rsh.sdp...)
+
+	if _, err := rsh.conn.WriteTo(packet, nil, sap); err != nil {
+		fmt.Printf("Cannot send SAP announcement: %v\n", err)
+	}
+}
@@ -0,0 +1,619 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts, except for the last one
+	s3MinPartSize = 5 * 1024 * 1024
+	// s3QueueSize is the number of parts waiting for upload before parts are dropped
+	s3QueueSize = 4
+	// s3MaxAttempts is the number of times a request is tried
+	s3MaxAttempts = 6
+	// s3MaxHeldParts is the number of failed or dropped parts of a session
+	// which are kept in memory to be tried again when the session ends
+	s3MaxHeldParts = 8
+	// s3RetryInterval is the time between two attempts to complete uploads
+	// which still miss parts
+	s3RetryInterval = time.Minute
+)
+
+// S3Config describes the bucket sessions are uploaded to
+type S3Config struct {
+	// Endpoint is the url of the server, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://minio.lan:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is put in front of every object key
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket into the path instead of the host name, MinIO needs this
+	PathStyle bool
+	// PartSize is the size of the parts of the multipart upload
+	PartSize int
+}
+
+// s3Upload is the multipart upload of one session
+type s3Upload struct {
+	session  *Session
+	key      string
+	uploadID string
+	parts    []s3CompletedPart
+	// completed is true when S3 has assembled the object
+	completed bool
+
+	// mutex guards held and lost, parts are dropped by store while run
+	// uploads the others
+	mutex sync.Mutex
+	// held are the parts which could not be uploaded yet by part number
+	held map[int][]byte
+	// lost is true if a part was dropped while s3MaxHeldParts were held
+	lost bool
+}
+
+// hold keeps a part which could not be uploaded, it is tried again
+// before the upload is completed. It returns false if the part is lost.
+func (u *s3Upload) hold(number int, data []byte) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if len(u.held) >= s3MaxHeldParts {
+		u.lost = true
+		return false
+	}
+	if u.held == nil {
+		u.held = map[int][]byte{}
+	}
+	u.held[number] = data
+	return true
+}
+
+func (u *s3Upload) release(number int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.held, number)
+}
+
+// heldParts returns the numbers of the held parts in ascending order
+func (u *s3Upload) heldParts() []int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ret := make([]int, 0, len(u.held))
+	for number := range u.held {
+		ret = append(ret, number)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func (u *s3Upload) heldData(number int) []byte {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.held[number]
+}
+
+func (u *s3Upload) isLost() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.lost
+}
+
+type s3Job struct {
+	upload *s3Upload
+	number int
+	data   []byte
+	// complete is true for the job which finishes the upload
+	complete bool
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// S3StorageHandler uploads every session as one object with S3 multipart
+// upload. The upload is completed when the session ends. Parts which fail
+// or are dropped are kept and tried again before the upload is completed.
+// If they still fail the upload stays open and is tried again every
+// s3RetryInterval, the session is not marked as uploaded until then. Only
+// an upload which lost a part for good is aborted.
+type S3StorageHandler struct {
+	config      S3Config
+	credentials sigV4Credentials
+	recorderID  string
+	mutex       sync.Mutex
+	client      *http.Client
+	tracker     *UploadTracker
+	format      AudioFormat
+	eventStream chan Event
+	jobs        chan s3Job
+
+	// only used by run, the uploads which wait for missing parts
+	pending []*s3Upload
+
+	// only used by store and setSession
+	upload     *s3Upload
+	buffer     bytes.Buffer
+	partNumber int
+}
+
+// NewS3StorageHandler factory
+func NewS3StorageHandler(config S3Config, recorderID string) *S3StorageHandler {
+
+	if config.PartSize < s3MinPartSize {
+		config.PartSize = s3MinPartSize
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	client, _ := newHTTPClient(DefaultHTTPClientConfig())
+
+	ret := &S3StorageHandler{
+		config: config,
+		credentials: sigV4Credentials{
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			region:    config.Region,
+			service:   "s3",
+		},
+		recorderID: recorderID,
+		client:     client,
+		format:     DefaultAudioFormat,
+		jobs:       make(chan s3Job, s3QueueSize),
+	}
+
+	go ret.run()
+
+	return ret
+}
+
+// SetClientConfig sets up TLS and timeouts. Authentication is done with
+// the credentials of the S3 config.
+func (s3h *S3StorageHandler) SetClientConfig(config HTTPClientConfig) error {
+
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return fmt.Errorf("Cannot configure s3 storage handler: %v", err)
+	}
+
+	s3h.mutex.Lock()
+	defer s3h.mutex.Unlock()
+	s3h.client = client
+
+	return nil
+}
+
+// SetUploadTracker sets a tracker which is informed about every part
+func (s3h *S3StorageHandler) SetUploadTracker(t *UploadTracker) {
+	s3h.mutex.Lock()
+	defer s3h.mutex.Unlock()
+	s3h.tracker = t
+}
+
+func (s3h *S3StorageHandler) setEventStream(s chan Event) {
+	s3h.eventStream = s
+}
+
+func (s3h *S3StorageHandler) setFormat(f AudioFormat) {
+	s3h.format = f
+}
+
+func (s3h *S3StorageHandler) getTracker() *UploadTracker {
+	s3h.mutex.Lock()
+	defer s3h.mutex.Unlock()
+	return s3h.tracker
+}
+
+func (s3h *S3StorageHandler) setSession(s *Session) {
+	s3h.endSession()
+
+	s3h.upload = &s3Upload{
+		session: s,
+		key:     s3h.config.Prefix + sessionFileName(s3h.recorderID, s.ID()),
+	}
+	s3h.partNumber = 1
+}
+
+// endSession uploads what is left and completes the upload
+func (s3h *S3StorageHandler) endSession() {
+	if s3h.upload == nil {
+		return
+	}
+
+	if s3h.buffer.Len() > 0 {
+		s3h.queue(s3Job{upload: s3h.upload, number: s3h.partNumber, data: append([]byte{}, s3h.buffer.Bytes()...)})
+		s3h.buffer.Reset()
+	}
+	s3h.queue(s3Job{upload: s3h.upload, complete: true})
+	s3h.upload = nil
+}
+
+func (s3h *S3StorageHandler) store(b []byte) {
+
+	if s3h.upload == nil {
+		return
+	}
+
+	s3h.buffer.Write(b)
+
+	if s3h.buffer.Len() >= s3h.config.PartSize {
+		s3h.queue(s3Job{upload: s3h.upload, number: s3h.partNumber, data: append([]byte{}, s3h.buffer.Next(s3h.config.PartSize)...)})
+		s3h.partNumber++
+	}
+}
+
+func (s3h *S3StorageHandler) queue(job s3Job) {
+
+	sessionID := job.upload.session.ID()
+	tracker := s3h.getTracker()
+	if tracker != nil {
+		tracker.begin(sessionID)
+	}
+
+	// The completion must not get lost, the upload would be left unfinished
+	if job.complete {
+		s3h.jobs <- job
+		return
+	}
+
+	select {
+	case s3h.jobs <- job:
+	default:
+		// A held part stays pending in the tracker until it is tried again
+		if job.upload.hold(job.number, job.data) {
+			sendEvent(s3h.eventStream, "S3StorageHandler", EventDataDropped, "Upload queue full, holding part %d of %s", job.number, job.upload.key)
+			return
+		}
+		sendEvent(s3h.eventStream, "S3StorageHandler", EventDataDropped, "Upload queue full, dropped part %d of %s", job.number, job.upload.key)
+		if tracker != nil {
+			tracker.done(sessionID, fmt.Errorf("Dropped"))
+		}
+	}
+}
+
+func (s3h *S3StorageHandler) run() {
+	ticker := time.NewTicker(s3RetryInterval)
+	for {
+		select {
+		case job := <-s3h.jobs:
+			s3h.handle(job)
+		case <-ticker.C:
+			s3h.resume()
+		}
+	}
+}
+
+func (s3h *S3StorageHandler) handle(job s3Job) {
+
+	var err error
+	if job.complete {
+		err = s3h.complete(job.upload)
+	} else {
+		err = s3h.process(job)
+	}
+	if err != nil {
+		sendEvent(s3h.eventStream, "S3StorageHandler", EventWriteError, "%s: %v", job.upload.key, err)
+	}
+
+	sessionID := job.upload.session.ID()
+	tracker := s3h.getTracker()
+
+	// A failed part is held and tried again when the session ends
+	if err != nil && !job.complete && job.upload.hold(job.number, job.data) {
+		return
+	}
+
+	if tracker == nil {
+		return
+	}
+
+	// The completion of an upload which waits for parts stays pending
+	// until resume completes it
+	if !job.complete || !s3h.isPending(job.upload) {
+		tracker.done(sessionID, err)
+	}
+	if job.complete {
+		tracker.finish(sessionID)
+	}
+}
+
+func (s3h *S3StorageHandler) isPending(u *s3Upload) bool {
+	for _, p := range s3h.pending {
+		if p == u {
+			return true
+		}
+	}
+	return false
+}
+
+// resume tries again to complete the uploads which miss parts
+func (s3h *S3StorageHandler) resume() {
+
+	remaining := []*s3Upload{}
+	for _, u := range s3h.pending {
+		if err := s3h.finishUpload(u); err != nil {
+			fmt.Printf("S3StorageHandler: %s: Still incomplete: %v\n", u.key, err)
+			remaining = append(remaining, u)
+			continue
+		}
+
+		sendEvent(s3h.eventStream, "S3StorageHandler", EventRecovered, "Completed %s", u.key)
+		if tracker := s3h.getTracker(); tracker != nil {
+			tracker.done(u.session.ID(), nil)
+		}
+	}
+	s3h.pending = remaining
+}
+
+func (s3h *S3StorageHandler) process(job s3Job) error {
+
+	u := job.upload
+
+	if u.uploadID == "" {
+		if err := retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.initiate(u) }); err != nil {
+			return err
+		}
+	}
+
+	return retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.uploadPart(u, job.number, job.data) })
+}
+
+// complete uploads the held parts and completes the upload. If a held part
+// still fails the upload is kept open and tried again by resume. An upload
+// which lost a part for good is aborted.
+func (s3h *S3StorageHandler) complete(u *s3Upload) error {
+
+	if u.uploadID == "" && len(u.heldParts()) == 0 && !u.isLost() {
+		// Nothing was uploaded, only the metadata is stored
+		return retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.putMetadata(u) })
+	}
+
+	if u.isLost() {
+		// The parts which are still held are counted as failed, so the
+		// session is not marked as uploaded
+		tracker := s3h.getTracker()
+		for _, number := range u.heldParts() {
+			u.release(number)
+			if tracker != nil {
+				tracker.done(u.session.ID(), fmt.Errorf("Cannot upload part %d", number))
+			}
+		}
+		if u.uploadID != "" {
+			if err := retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.abortUpload(u) }); err != nil {
+				fmt.Printf("S3StorageHandler: %v\n", err)
+			}
+		}
+		return fmt.Errorf("Aborted upload, a part was dropped")
+	}
+
+	if err := s3h.finishUpload(u); err != nil {
+		s3h.pending = append(s3h.pending, u)
+		return fmt.Errorf("Upload incomplete, trying again in %v: %v", s3RetryInterval, err)
+	}
+	return nil
+}
+
+// finishUpload uploads the held parts, completes the upload and stores the
+// metadata. It can be called again after an error.
+func (s3h *S3StorageHandler) finishUpload(u *s3Upload) error {
+
+	tracker := s3h.getTracker()
+	sessionID := u.session.ID()
+
+	for _, number := range u.heldParts() {
+		if err := s3h.process(s3Job{upload: u, number: number, data: u.heldData(number)}); err != nil {
+			return err
+		}
+		u.release(number)
+		if tracker != nil {
+			tracker.done(sessionID, nil)
+		}
+	}
+
+	if !u.completed {
+		// S3 expects the parts in ascending order, held parts come last
+		sort.Slice(u.parts, func(i, j int) bool { return u.parts[i].PartNumber < u.parts[j].PartNumber })
+
+		if err := retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.completeUpload(u) }); err != nil {
+			return err
+		}
+		u.completed = true
+		fmt.Printf("S3StorageHandler: Uploaded %s in %d parts\n", u.key, len(u.parts))
+	}
+
+	return retry("S3StorageHandler", s3MaxAttempts, func() error { return s3h.putMetadata(u) })
+}
+
+func (s3h *S3StorageHandler) objectURL(key string, query url.Values) (string, error) {
+
+	u, err := url.Parse(s3h.config.Endpoint)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse endpoint: %v", err)
+	}
+
+	if s3h.config.PathStyle {
+		u.Path = "/" + s3h.config.Bucket + "/" + key
+	} else {
+		u.Host = s3h.config.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, false)
+
+	// S3 expects "uploads" without a value
+	u.RawQuery = strings.Replace(query.Encode(), "uploads=", "uploads", 1)
+
+	return u.String(), nil
+}
+
+// do signs and executes a request and returns the body of the response
+func (s3h *S3StorageHandler) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+
+	location, err := s3h.objectURL(key, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(method, location, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create %s request: %v", method, err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	s3h.credentials.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	s3h.mutex.Lock()
+	client := s3h.client
+	s3h.mutex.Unlock()
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot execute %s request: %v", method, err)
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read response: %v", err)
+	}
+
+	// Errors may come with status 200 for requests which take long
+	s3Err := s3Error{}
+	if xml.Unmarshal(data, &s3Err) == nil {
+		return nil, nil, fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+	}
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNoContent {
+		return nil, nil, fmt.Errorf("Response was not good: %s", response.Status)
+	}
+
+	return response, data, nil
+}
+
+func (s3h *S3StorageHandler) initiate(u *s3Upload) error {
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("X-Amz-Meta-Recorder-Id", s3h.recorderID)
+	header.Set("X-Amz-Meta-Session-Id", u.session.ID())
+	header.Set("X-Amz-Meta-Sample-Rate", strconv.Itoa(s3h.format.Samplerate))
+	header.Set("X-Amz-Meta-Channels", strconv.Itoa(s3h.format.Channels))
+	header.Set("X-Amz-Meta-Sample-Format", s3h.format.SampleFormat)
+
+	_, data, err := s3h.do("POST", u.key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return fmt.Errorf("Cannot initiate multipart upload: %v", err)
+	}
+
+	result := s3InitiateResult{}
+	if err := xml.Unmarshal(data, &result); err != nil || result.UploadID == "" {
+		return fmt.Errorf("Cannot initiate multipart upload: Invalid response")
+	}
+
+	u.uploadID = result.UploadID
+	return nil
+}
+
+func (s3h *S3StorageHandler) uploadPart(u *s3Upload, number int, data []byte) error {
+
+	sum := md5.Sum(data)
+	header := http.Header{}
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {u.uploadID},
+	}
+
+	response, _, err := s3h.do("PUT", u.key, query, header, data)
+	if err != nil {
+		return fmt.Errorf("Cannot upload part %d: %v", number, err)
+	}
+
+	etag := response.Header.Get("ETag")
+	if etag == "" {
+		return fmt.Errorf("Cannot upload part %d: No ETag", number)
+	}
+
+	u.parts = append(u.parts, s3CompletedPart{PartNumber: number, ETag: etag})
+	return nil
+}
+
+func (s3h *S3StorageHandler) completeUpload(u *s3Upload) error {
+
+	body, err := xml.Marshal(s3CompleteRequest{Parts: u.parts})
+	if err != nil {
+		return fmt.Errorf("Cannot marshal part list: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+
+	if _, _, err := s3h.do("POST", u.key, url.Values{"uploadId": {u.uploadID}}, header, body); err != nil {
+		return fmt.Errorf("Cannot complete multipart upload: %v", err)
+	}
+	return nil
+}
+
+// abortUpload removes the parts which have been uploaded
+func (s3h *S3StorageHandler) abortUpload(u *s3Upload) error {
+	if _, _, err := s3h.do("DELETE", u.key, url.Values{"uploadId": {u.uploadID}}, nil, nil); err != nil {
+		return fmt.Errorf("Cannot abort multipart upload: %v", err)
+	}
+	return nil
+}
+
+// putMetadata stores the session metadata next to the audio
+func (s3h *S3StorageHandler) putMetadata(u *s3Upload) error {
+
+	body, err := json.MarshalIndent(u.session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot marshal session: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	key := s3h.config.Prefix + u.session.MetadataFileName()
+	if _, _, err := s3h.do("PUT", key, nil, header, body); err != nil {
+		return fmt.Errorf("Cannot store metadata: %v", err)
+	}
+	return nil
+}
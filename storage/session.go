@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SessionEvent is something that happened during a session, e.g. a gain change
+type SessionEvent struct {
+	Type   string        `json:"type"`
+	Offset time.Duration `json:"offset"`
+	Time   time.Time     `json:"time"`
+	Data   interface{}   `json:"data,omitempty"`
+}
+
+// Session holds the metadata of a recording session
+type Session struct {
+	mutex      sync.Mutex
+	saveMutex  sync.Mutex
+	id         string
+	recorderID string
+	started    time.Time
+	values     map[string]interface{}
+	events     []SessionEvent
+}
+
+// NewSession factory
+func NewSession(recorderID string) *Session {
+	now := time.Now().UTC()
+	return &Session{
+		id:         strconv.FormatInt(now.UnixNano(), 10),
+		recorderID: recorderID,
+		started:    now,
+		values:     map[string]interface{}{},
+		events:     []SessionEvent{},
+	}
+}
+
+// ID returns the session id
+func (s *Session) ID() string {
+	return s.id
+}
+
+// RecorderID returns the id of the recorder the session belongs to
+func (s *Session) RecorderID() string {
+	return s.recorderID
+}
+
+// Started returns the time the session was created
+func (s *Session) Started() time.Time {
+	return s.started
+}
+
+// Get returns a metadata value
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set sets a metadata value
+func (s *Session) Set(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = value
+}
+
+// AddEvent appends an event. offset is the position in the recording.
+func (s *Session) AddEvent(eventType string, offset time.Duration, data interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, SessionEvent{
+		Type:   eventType,
+		Offset: offset,
+		Time:   time.Now().UTC(),
+		Data:   data,
+	})
+}
+
+// MarshalJSON implements json.Marshaler
+func (s *Session) MarshalJSON() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return json.Marshal(struct {
+		ID         string                 `json:"id"`
+		RecorderID string                 `json:"recorderId"`
+		Started    time.Time              `json:"started"`
+		Values     map[string]interface{} `json:"values"`
+		Events     []SessionEvent         `json:"events"`
+	}{
+		ID:         s.id,
+		RecorderID: s.recorderID,
+		Started:    s.started,
+		Values:     s.values,
+		Events:     s.events,
+	})
+}
+
+// MetadataFileName returns the name of the metadata file of this session
+func (s *Session) MetadataFileName() string {
+	return fmt.Sprintf("%s_%s.json", s.recorderID, s.id)
+}
+
+// Save writes the metadata as json into dir. The file is replaced
+// atomically, so readers never see a partial file. Concurrent saves are
+// serialized, they share the temporary file.
+func (s *Session) Save(dir string) error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot marshal session: %v", err)
+	}
+
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("Cannot create session directory: %v", err)
+	}
+
+	fileName := path.Join(dir, s.MetadataFileName())
+	if err = ioutil.WriteFile(fileName+".tmp", data, 0666); err != nil {
+		return fmt.Errorf("Cannot write session metadata: %v", err)
+	}
+
+	return os.Rename(fileName+".tmp", fileName)
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConfig describes the server sessions are written to
+type SFTPConfig struct {
+	// Address is host:port of the ssh server
+	Address string
+	User    string
+	// Password or KeyFile authenticate the user, the key file is tried first
+	Password string
+	KeyFile  string
+	// KnownHostsFile is used to verify the server
+	KnownHostsFile string
+	// Directory is the remote directory files are written into
+	Directory string
+}
+
+// SFTPStorageHandler writes chunks or whole sessions to an ssh server
+type SFTPStorageHandler struct {
+	*remoteUploader
+	config SFTPConfig
+	// conn and client are only used by the upload goroutine
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTPStorageHandler factory. With a chunkSize of 0 whole sessions are
+// spooled and written when the session ends. Spooled and failed files are
+// kept in spoolDir/SFTPStorageHandler.
+func NewSFTPStorageHandler(config SFTPConfig, recorderID string, chunkSize int, spoolDir string) *SFTPStorageHandler {
+
+	ret := &SFTPStorageHandler{
+		config: config,
+	}
+	ret.remoteUploader = newRemoteUploader("SFTPStorageHandler", recorderID, chunkSize, spoolDir, ret)
+
+	return ret
+}
+
+func (sfh *SFTPStorageHandler) connect() error {
+
+	auth := []ssh.AuthMethod{}
+	if sfh.config.KeyFile != "" {
+		key, err := ioutil.ReadFile(sfh.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read key file: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("Cannot parse key file: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sfh.config.Password != "" {
+		auth = append(auth, ssh.Password(sfh.config.Password))
+	}
+
+	hostKeyCallback, err := knownhosts.New(sfh.config.KnownHostsFile)
+	if err != nil {
+		return fmt.Errorf("Cannot read known hosts: %v", err)
+	}
+
+	conn, err := ssh.Dial("tcp", sfh.config.Address, &ssh.ClientConfig{
+		User:            sfh.config.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Second * 10,
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot connect to %s: %v", sfh.config.Address, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Cannot start sftp: %v", err)
+	}
+
+	if err := client.MkdirAll(sfh.config.Directory); err != nil {
+		client.Close()
+		conn.Close()
+		return fmt.Errorf("Cannot create %s: %v", sfh.config.Directory, err)
+	}
+
+	sfh.conn = conn
+	sfh.client = client
+	return nil
+}
+
+func (sfh *SFTPStorageHandler) disconnect() {
+	if sfh.client != nil {
+		sfh.client.Close()
+		sfh.client = nil
+	}
+	if sfh.conn != nil {
+		sfh.conn.Close()
+		sfh.conn = nil
+	}
+}
+
+func (sfh *SFTPStorageHandler) put(name string, r io.Reader, size int64) error {
+
+	if sfh.client == nil {
+		if err := sfh.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := sfh.write(name, r)
+	if err != nil {
+		// Start over with a new connection, the old one may be broken
+		sfh.disconnect()
+	}
+	return err
+}
+
+// write writes into a temporary file first, so there are never partial files
+func (sfh *SFTPStorageHandler) write(name string, r io.Reader) error {
+
+	filePath := path.Join(sfh.config.Directory, name)
+
+	file, err := sfh.client.Create(filePath + ".part")
+	if err != nil {
+		return fmt.Errorf("Cannot create %s: %v", filePath, err)
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sfh.client.Remove(filePath + ".part")
+		return fmt.Errorf("Cannot write %s: %v", filePath, err)
+	}
+
+	if err := sfh.client.PosixRename(filePath+".part", filePath); err != nil {
+		return fmt.Errorf("Cannot rename %s: %v", filePath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// snapcastControlTimeout limits connecting and every call
+const snapcastControlTimeout = time.Second * 5
+
+// snapcastControl is a client for the JSON-RPC control api of snapserver
+// (tcp port 1705, one json message per line)
+type snapcastControl struct {
+	address string
+	conn    net.Conn
+	reader  *bufio.Reader
+	id      int
+}
+
+type snapcastRequest struct {
+	ID      int         `json:"id"`
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type snapcastResponse struct {
+	ID     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type snapcastVolume struct {
+	Muted   bool `json:"muted"`
+	Percent int  `json:"percent"`
+}
+
+type snapcastServerStatus struct {
+	Server struct {
+		Groups []struct {
+			ID       string `json:"id"`
+			StreamID string `json:"stream_id"`
+			Clients  []struct {
+				ID        string `json:"id"`
+				Connected bool   `json:"connected"`
+				Config    struct {
+					Volume snapcastVolume `json:"volume"`
+				} `json:"config"`
+			} `json:"clients"`
+		} `json:"groups"`
+		Streams []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			URI    struct {
+				Raw   string            `json:"raw"`
+				Query map[string]string `json:"query"`
+			} `json:"uri"`
+		} `json:"streams"`
+	} `json:"server"`
+}
+
+func (c *snapcastControl) connected() bool {
+	return c.conn != nil
+}
+
+func (c *snapcastControl) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// call sends a request and waits for its response. Notifications sent by
+// the server in between are skipped.
+func (c *snapcastControl) call(method string, params interface{}, result interface{}) error {
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, snapcastControlTimeout)
+		if err != nil {
+			return fmt.Errorf("Cannot connect to snapserver: %v", err)
+		}
+		c.conn = conn
+		c.reader = bufio.NewReader(conn)
+	}
+
+	c.id++
+	request, _ := json.Marshal(snapcastRequest{ID: c.id, JSONRPC: "2.0", Method: method, Params: params})
+
+	c.conn.SetDeadline(time.Now().Add(snapcastControlTimeout))
+	if _, err := c.conn.Write(append(request, '\n')); err != nil {
+		c.close()
+		return fmt.Errorf("Cannot send %s: %v", method, err)
+	}
+
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			c.close()
+			return fmt.Errorf("Cannot read response to %s: %v", method, err)
+		}
+
+		response := snapcastResponse{}
+		if err := json.Unmarshal(line, &response); err != nil || response.ID == nil || *response.ID != c.id {
+			continue
+		}
+
+		if response.Error != nil {
+			return fmt.Errorf("%s failed: %s", method, response.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return fmt.Errorf("Cannot parse response to %s: %v", method, err)
+		}
+		return nil
+	}
+}
+
+func (c *snapcastControl) status() (*snapcastServerStatus, error) {
+	ret := &snapcastServerStatus{}
+	if err := c.call("Server.GetStatus", nil, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *snapcastControl) addStream(uri string) error {
+	return c.call("Stream.AddStream", map[string]string{"streamUri": uri}, nil)
+}
+
+// setMuted sends only the mute flag, snapserver keeps the volume the client
+// has right now
+func (c *snapcastControl) setMuted(clientID string, muted bool) error {
+	return c.call("Client.SetVolume", map[string]interface{}{"id": clientID, "volume": map[string]bool{"muted": muted}}, nil)
+}
@@ -1,52 +1,402 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// SnapcastStorageHandler can provide snapcast with a live feed
+const (
+	// snapcastQueueSize is the number of buffers waiting for the fifo before
+	// buffers are dropped
+	snapcastQueueSize = 64
+	// snapcastStallTimeout is how long a write may block before snapserver
+	// is considered stalled
+	snapcastStallTimeout = time.Second
+	// snapcastRetryDelay is the time between two attempts to open the fifo
+	snapcastRetryDelay = time.Second * 2
+	// snapcastIdleTimeout is the time without input after which the
+	// recording is considered stopped
+	snapcastIdleTimeout = time.Second * 2
+	// snapcastStatusInterval is the time between two status queries
+	snapcastStatusInterval = time.Second * 10
+	// snapcastPipeBuf is PIPE_BUF, writes of up to this size into a fifo are
+	// either complete or fail without writing anything
+	snapcastPipeBuf = 4096
+)
+
+// SnapcastControlConfig configures the use of the snapserver control api
+type SnapcastControlConfig struct {
+	// Address of the control port, e.g. localhost:1705
+	Address string
+	// StreamName is the name of the stream, defaults to the recorder id. The
+	// stream is added to snapserver if it does not exist.
+	StreamName string
+	// Mute mutes the clients playing the stream while nothing is recorded
+	Mute bool
+	// Clients to mute, defaults to all clients of groups playing the stream
+	Clients []string
+}
+
+// SnapcastStatus describes the state of the snapcast feed
+type SnapcastStatus struct {
+	FifoOpen  bool `json:"fifoOpen"`
+	Recording bool `json:"recording"`
+	// Control is true while snapserver's control api is reachable
+	Control bool `json:"control"`
+	// Stream is the stream status reported by snapserver, e.g. idle or playing
+	Stream string `json:"stream,omitempty"`
+	// Clients is the number of connected clients playing the stream
+	Clients int `json:"clients"`
+}
+
+// SnapcastStorageHandler can provide snapcast with a live feed. The fifo is
+// reopened whenever snapserver goes away, a stalled snapserver never blocks
+// the pipeline.
 type SnapcastStorageHandler struct {
-	fifoPath   string
-	recorderID string
-	chunkCount int
-	sessionID  string
-	file       *os.File
+	fifoPath    string
+	recorderID  string
+	format      AudioFormat
+	eventStream chan Event
+	input       chan []byte
+	recording   chan bool
+	// only used by store
+	dropping bool
+
+	mutex  sync.Mutex
+	status SnapcastStatus
+
+	// only used by run
+	file    *os.File
+	failing bool
+	nextTry time.Time
 }
 
 // NewSnapcastStorageHandler factory
 func NewSnapcastStorageHandler(fifoPath, recorderID string) *SnapcastStorageHandler {
 
-	f, err := os.OpenFile(fifoPath, os.O_WRONLY|os.O_APPEND, 0777)
-	if err != nil {
-		fmt.Printf("Cannot open fifo: %v. Snapcast will be disabled", err)
-	}
-
 	ret := SnapcastStorageHandler{
 		fifoPath:   fifoPath,
 		recorderID: recorderID,
-		chunkCount: 0,
-		file:       f,
+		format:     DefaultAudioFormat,
+		input:      make(chan []byte, snapcastQueueSize),
+		recording:  make(chan bool, 1),
 	}
 
+	go ret.run()
+
 	return &ret
 }
 
+// SetControl enables the use of snapserver's JSON-RPC control api
+func (ssh *SnapcastStorageHandler) SetControl(config SnapcastControlConfig) {
+	if config.StreamName == "" {
+		config.StreamName = ssh.recorderID
+	}
+	go ssh.control(config)
+}
+
+// Status returns the state of the snapcast feed
+func (ssh *SnapcastStorageHandler) Status() SnapcastStatus {
+	ssh.mutex.Lock()
+	defer ssh.mutex.Unlock()
+	return ssh.status
+}
+
+// SampleFormat returns the format snapserver has to expect, e.g. 48000:16:2
+func (ssh *SnapcastStorageHandler) SampleFormat() string {
+	return fmt.Sprintf("%d:%d:%d", ssh.format.Samplerate, ssh.format.BytesPerSample*8, ssh.format.Channels)
+}
+
+func (ssh *SnapcastStorageHandler) setEventStream(s chan Event) {
+	ssh.eventStream = s
+}
+
+func (ssh *SnapcastStorageHandler) setFormat(f AudioFormat) {
+	ssh.format = f
+}
+
 func (ssh *SnapcastStorageHandler) store(b []byte) {
+	select {
+	case ssh.input <- b:
+		ssh.dropping = false
+	default:
+		// Only report the first loss, nothing is read while snapserver is gone
+		if !ssh.dropping {
+			sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventDataDropped, "Snapserver is too slow, dropping audio")
+		}
+		ssh.dropping = true
+	}
+}
+
+func (ssh *SnapcastStorageHandler) setStatus(f func(s *SnapcastStatus)) {
+	ssh.mutex.Lock()
+	defer ssh.mutex.Unlock()
+	f(&ssh.status)
+}
+
+func (ssh *SnapcastStorageHandler) setRecording(recording bool) {
+	ssh.setStatus(func(s *SnapcastStatus) { s.Recording = recording })
+
+	// Only the latest state matters to the control loop
+	select {
+	case <-ssh.recording:
+	default:
+	}
+	ssh.recording <- recording
+}
+
+func (ssh *SnapcastStorageHandler) run() {
+
+	idle := time.NewTimer(snapcastIdleTimeout)
+	recording := false
+
+	for {
+		select {
+		case b := <-ssh.input:
+			if !recording {
+				recording = true
+				ssh.setRecording(true)
+			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(snapcastIdleTimeout)
+			ssh.write(b)
+
+		case <-idle.C:
+			if recording {
+				recording = false
+				ssh.setRecording(false)
+			}
+		}
+	}
+}
+
+func (ssh *SnapcastStorageHandler) fail(err error) {
+	if !ssh.failing {
+		sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventWriteError, "%v", err)
+	}
+	ssh.failing = true
+	ssh.nextTry = time.Now().Add(snapcastRetryDelay)
+}
+
+// open opens the fifo without blocking, which fails while snapserver is not
+// reading it
+func (ssh *SnapcastStorageHandler) open() error {
+
+	if _, err := os.Stat(ssh.fifoPath); os.IsNotExist(err) {
+		if err := syscall.Mkfifo(ssh.fifoPath, 0666); err != nil {
+			return fmt.Errorf("Cannot create fifo: %v", err)
+		}
+	}
+
+	f, err := os.OpenFile(ssh.fifoPath, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("Cannot open fifo: Snapserver is not reading %s", ssh.fifoPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot open fifo: %v", err)
+	}
+
+	fmt.Printf("Snapcast: Feeding %s with %s\n", ssh.fifoPath, ssh.SampleFormat())
+
+	ssh.file = f
+	ssh.setStatus(func(s *SnapcastStatus) { s.FifoOpen = true })
+	return nil
+}
+
+func (ssh *SnapcastStorageHandler) close() {
+	ssh.file.Close()
+	ssh.file = nil
+	ssh.setStatus(func(s *SnapcastStatus) { s.FifoOpen = false })
+}
+
+func (ssh *SnapcastStorageHandler) write(b []byte) {
+
+	if ssh.file == nil {
+		if time.Now().Before(ssh.nextTry) {
+			return
+		}
+		if err := ssh.open(); err != nil {
+			ssh.fail(err)
+			return
+		}
+		if ssh.failing {
+			ssh.failing = false
+			sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventRecovered, "Feeding %s", ssh.fifoPath)
+		}
+	}
+
+	// Whole frames are written in atomic chunks, so a write which times out
+	// never leaves a partial frame in the fifo
+	frameSize := ssh.format.BytesPerFrame()
+	chunkSize := snapcastPipeBuf / frameSize * frameSize
+	if chunkSize == 0 {
+		chunkSize = frameSize
+	}
+
+	for len(b) > 0 {
+		n := chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		ssh.file.SetWriteDeadline(time.Now().Add(snapcastStallTimeout))
+		_, err := ssh.file.Write(b[:n])
+		b = b[n:]
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			ssh.close()
+			ssh.fail(fmt.Errorf("Cannot write into fifo: Snapserver stalled"))
+			return
+		}
+		if err != nil {
+			ssh.close()
+			ssh.fail(fmt.Errorf("Cannot write into fifo: %v", err))
+			return
+		}
+	}
+}
 
-	if ssh.file != nil {
-		written := 0
-		for written < len(b) {
-			n, err := ssh.file.Write(b)
-			if err != nil {
-				fmt.Printf("Cannot write into fifo: %v", err)
-				return
+// control keeps the stream registered in snapserver, mutes clients while
+// nothing is recorded and polls the stream status
+func (ssh *SnapcastStorageHandler) control(config SnapcastControlConfig) {
+
+	c := &snapcastControl{address: config.Address}
+	ticker := time.NewTicker(snapcastStatusInterval)
+	defer ticker.Stop()
+
+	recording := ssh.Status().Recording
+	failing := false
+	setup := true
+
+	for {
+		status, err := c.status()
+		if err != nil {
+			if !failing {
+				sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventWriteError, "%v", err)
+			}
+			failing = true
+			setup = true
+			ssh.setStatus(func(s *SnapcastStatus) { s.Control = false })
+		} else {
+			if failing {
+				failing = false
+				sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventRecovered, "Connected to snapserver at %s", config.Address)
 			}
-			written += n
-			if written < len(b) {
-				fmt.Printf("Written: %d of %d\n", written, len(b))
+			if setup {
+				// Snapserver restarted or the connection is new
+				status = ssh.setupStream(c, config, status)
+				ssh.mute(c, config, status, !recording)
+				setup = false
+			}
+			ssh.updateStatus(config, status)
+		}
+
+		select {
+		case recording = <-ssh.recording:
+			if c.connected() && status != nil {
+				ssh.mute(c, config, status, !recording)
 			}
+		case <-ticker.C:
 		}
+	}
+}
 
+// setupStream adds the stream if snapserver does not know it, or warns if
+// it expects another format
+func (ssh *SnapcastStorageHandler) setupStream(c *snapcastControl, config SnapcastControlConfig, status *snapcastServerStatus) *snapcastServerStatus {
+
+	for _, s := range status.Server.Streams {
+		if s.ID != config.StreamName {
+			continue
+		}
+		if f := s.URI.Query["sampleformat"]; f != "" && f != ssh.SampleFormat() {
+			sendEvent(ssh.eventStream, "SnapcastStorageHandler", EventWriteError, "Snapserver expects %s on stream %s, but the feed is %s", f, s.ID, ssh.SampleFormat())
+		}
+		return status
 	}
+
+	query := url.Values{}
+	query.Set("name", config.StreamName)
+	query.Set("sampleformat", ssh.SampleFormat())
+	query.Set("mode", "read")
+	uri := "pipe://" + ssh.fifoPath + "?" + query.Encode()
+
+	if err := c.addStream(uri); err != nil {
+		fmt.Printf("Snapcast: Cannot add stream: %v\n", err)
+		return status
+	}
+	fmt.Printf("Snapcast: Added stream %s\n", uri)
+
+	if s, err := c.status(); err == nil {
+		return s
+	}
+	return status
+}
+
+func (ssh *SnapcastStorageHandler) mute(c *snapcastControl, config SnapcastControlConfig, status *snapcastServerStatus, muted bool) {
+	if !config.Mute {
+		return
+	}
+
+	for _, g := range status.Server.Groups {
+		for _, client := range g.Clients {
+			if !ssh.isTarget(config, g.StreamID, client.ID) {
+				continue
+			}
+			if err := c.setMuted(client.ID, muted); err != nil {
+				fmt.Printf("Snapcast: Cannot mute %s: %v\n", client.ID, err)
+			}
+		}
+	}
+}
+
+func (ssh *SnapcastStorageHandler) isTarget(config SnapcastControlConfig, streamID, clientID string) bool {
+	if len(config.Clients) == 0 {
+		return streamID == config.StreamName
+	}
+	for _, id := range config.Clients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (ssh *SnapcastStorageHandler) updateStatus(config SnapcastControlConfig, status *snapcastServerStatus) {
+
+	stream := ""
+	for _, s := range status.Server.Streams {
+		if s.ID == config.StreamName {
+			stream = s.Status
+		}
+	}
+
+	clients := 0
+	for _, g := range status.Server.Groups {
+		if g.StreamID != config.StreamName {
+			continue
+		}
+		for _, client := range g.Clients {
+			if client.Connected {
+				clients++
+			}
+		}
+	}
+
+	ssh.setStatus(func(s *SnapcastStatus) {
+		if s.Stream != stream {
+			fmt.Printf("Snapcast: Stream %s is %s\n", config.StreamName, stream)
+		}
+		s.Control = true
+		s.Stream = stream
+		s.Clients = clients
+	})
 }
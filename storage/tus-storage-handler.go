@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tusVersion is the version of the tus protocol spoken
+	tusVersion = "1.0.0"
+	// tusMaxBacklog is the number of bytes kept for retransmission before
+	// new data is dropped
+	tusMaxBacklog = 64 * 1024 * 1024
+	// tusMaxRetryDelay limits the time between two attempts
+	tusMaxRetryDelay = time.Second * 30
+)
+
+// errTusUploadGone is returned when the server does not know an upload
+// (anymore), e.g. because it expired
+var errTusUploadGone = errors.New("Upload is gone")
+
+// tusUpload is the server side upload of one session
+type tusUpload struct {
+	session   *Session
+	sessionID string
+	location  string
+	// offset is the number of bytes the server has confirmed
+	offset int64
+	// data holds everything after offset
+	data []byte
+	// finished is true when the session ended, so the length is known
+	finished bool
+	// failed is set when data of the session is lost, the upload is given
+	// up and the session stays local
+	failed error
+}
+
+// TusStorageHandler streams every session into one resumable upload with
+// the tus protocol (https://tus.io). Data is kept until the server has
+// confirmed it, interrupted uploads continue at the offset the server reports.
+type TusStorageHandler struct {
+	endpoint    string
+	recorderID  string
+	chunkSize   int
+	mutex       sync.Mutex
+	uploads     []*tusUpload
+	backlog     int
+	wake        chan struct{}
+	client      *http.Client
+	config      HTTPClientConfig
+	tracker     *UploadTracker
+	format      AudioFormat
+	eventStream chan Event
+}
+
+// NewTusStorageHandler factory. endpoint is the creation url of the tus
+// server, chunkSize the number of bytes sent with one request.
+func NewTusStorageHandler(endpoint, recorderID string, chunkSize int) *TusStorageHandler {
+
+	config := DefaultHTTPClientConfig()
+	client, _ := newHTTPClient(config)
+
+	ret := &TusStorageHandler{
+		endpoint:   endpoint,
+		recorderID: recorderID,
+		chunkSize:  chunkSize,
+		wake:       make(chan struct{}, 1),
+		client:     client,
+		config:     config,
+		format:     DefaultAudioFormat,
+	}
+
+	go ret.run()
+
+	return ret
+}
+
+// SetClientConfig sets up TLS, authentication and timeouts for all
+// following requests
+func (tsh *TusStorageHandler) SetClientConfig(config HTTPClientConfig) error {
+
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return fmt.Errorf("Cannot configure tus storage handler: %v", err)
+	}
+
+	tsh.mutex.Lock()
+	defer tsh.mutex.Unlock()
+	tsh.client = client
+	tsh.config = config
+
+	return nil
+}
+
+// SetUploadTracker sets a tracker which is informed when a session is uploaded
+func (tsh *TusStorageHandler) SetUploadTracker(t *UploadTracker) {
+	tsh.mutex.Lock()
+	defer tsh.mutex.Unlock()
+	tsh.tracker = t
+}
+
+func (tsh *TusStorageHandler) setEventStream(s chan Event) {
+	tsh.eventStream = s
+}
+
+func (tsh *TusStorageHandler) setFormat(f AudioFormat) {
+	tsh.format = f
+}
+
+func (tsh *TusStorageHandler) setSession(s *Session) {
+	tsh.endSession()
+
+	tsh.mutex.Lock()
+	tsh.uploads = append(tsh.uploads, &tusUpload{
+		session:   s,
+		sessionID: s.ID(),
+	})
+
+	tracker := tsh.tracker
+	tsh.mutex.Unlock()
+
+	if tracker != nil {
+		tracker.begin(s.ID())
+	}
+
+	tsh.signal()
+}
+
+func (tsh *TusStorageHandler) endSession() {
+	tsh.mutex.Lock()
+	if n := len(tsh.uploads); n > 0 {
+		tsh.uploads[n-1].finished = true
+	}
+	tsh.mutex.Unlock()
+
+	tsh.signal()
+}
+
+func (tsh *TusStorageHandler) store(b []byte) {
+	tsh.mutex.Lock()
+
+	if len(tsh.uploads) == 0 {
+		tsh.mutex.Unlock()
+		return
+	}
+
+	u := tsh.uploads[len(tsh.uploads)-1]
+	if u.failed != nil {
+		tsh.mutex.Unlock()
+		return
+	}
+
+	if tsh.backlog+len(b) > tusMaxBacklog {
+		tsh.fail(u, fmt.Errorf("Backlog full, dropped %d bytes", len(b)))
+		tsh.mutex.Unlock()
+		sendEvent(tsh.eventStream, "TusStorageHandler", EventDataDropped, "Backlog full, giving up the upload of session %s", u.sessionID)
+		tsh.signal()
+		return
+	}
+
+	u.data = append(u.data, b...)
+	tsh.backlog += len(b)
+	full := len(u.data) >= tsh.chunkSize
+	tsh.mutex.Unlock()
+
+	if full {
+		tsh.signal()
+	}
+}
+
+func (tsh *TusStorageHandler) signal() {
+	select {
+	case tsh.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (tsh *TusStorageHandler) run() {
+
+	delay := time.Second
+	failing := false
+
+	for range tsh.wake {
+		for {
+			progress, err := tsh.step()
+			if err != nil {
+				if !failing {
+					sendEvent(tsh.eventStream, "TusStorageHandler", EventWriteError, "%v", err)
+				}
+				failing = true
+
+				time.Sleep(delay)
+				if delay *= 2; delay > tusMaxRetryDelay {
+					delay = tusMaxRetryDelay
+				}
+				continue
+			}
+
+			if failing {
+				sendEvent(tsh.eventStream, "TusStorageHandler", EventRecovered, "Upload continues")
+				failing = false
+			}
+			delay = time.Second
+
+			if !progress {
+				break
+			}
+		}
+	}
+}
+
+// fail gives up an upload, the data which is still kept is dropped. Must
+// be called with the mutex held.
+func (tsh *TusStorageHandler) fail(u *tusUpload, err error) {
+	u.failed = err
+	tsh.backlog -= len(u.data)
+	u.data = nil
+}
+
+// step does one request for the oldest upload. It returns false if there
+// is nothing to do right now.
+func (tsh *TusStorageHandler) step() (bool, error) {
+
+	tsh.mutex.Lock()
+	if len(tsh.uploads) == 0 {
+		tsh.mutex.Unlock()
+		return false, nil
+	}
+	u := tsh.uploads[0]
+
+	// A failed upload is dropped when its session has ended, so the
+	// sessions behind it are uploaded
+	if u.failed != nil {
+		finished := u.finished
+		tsh.mutex.Unlock()
+		if !finished {
+			return false, nil
+		}
+		tsh.complete(u)
+		return true, nil
+	}
+	location := u.location
+	finished := u.finished
+	n := len(u.data)
+	if n > tsh.chunkSize {
+		n = tsh.chunkSize
+	}
+	data := u.data[:n]
+	tsh.mutex.Unlock()
+
+	if location == "" {
+		created, err := tsh.create(u)
+		if err != nil {
+			return false, err
+		}
+
+		tsh.mutex.Lock()
+		u.location = created
+		tsh.mutex.Unlock()
+		return true, nil
+	}
+
+	// Wait for a full chunk unless the session has ended
+	if !finished && n < tsh.chunkSize {
+		return false, nil
+	}
+
+	last := finished && n == len(u.data)
+
+	var length int64 = -1
+	if last {
+		length = u.offset + int64(n)
+	}
+
+	offset, err := tsh.patch(location, u.offset, data, length)
+	if err == errTusUploadGone {
+		return tsh.gone(u)
+	}
+	if err != nil {
+		// The server may have received a part of the data, ask it where to continue
+		resumed, headErr := tsh.head(location)
+		if headErr == errTusUploadGone {
+			return tsh.gone(u)
+		}
+		if headErr == nil {
+			tsh.acknowledge(u, resumed)
+		}
+		return false, err
+	}
+
+	tsh.acknowledge(u, offset)
+
+	if last && offset == length {
+		tsh.complete(u)
+	}
+
+	return true, nil
+}
+
+// gone starts an upload the server does not know anymore again. If the
+// server had confirmed data, which is not kept anymore, it is given up.
+func (tsh *TusStorageHandler) gone(u *tusUpload) (bool, error) {
+	tsh.mutex.Lock()
+	if u.offset == 0 {
+		u.location = ""
+		tsh.mutex.Unlock()
+		fmt.Printf("TusStorageHandler: Upload of session %s is gone, creating it again\n", u.sessionID)
+		return true, nil
+	}
+
+	tsh.fail(u, fmt.Errorf("Server lost the upload after %d bytes", u.offset))
+	tsh.mutex.Unlock()
+
+	sendEvent(tsh.eventStream, "TusStorageHandler", EventDataDropped, "Server lost the upload of session %s, giving it up", u.sessionID)
+	return true, nil
+}
+
+// acknowledge drops data the server has confirmed
+func (tsh *TusStorageHandler) acknowledge(u *tusUpload, offset int64) {
+	tsh.mutex.Lock()
+	defer tsh.mutex.Unlock()
+
+	confirmed := offset - u.offset
+	if confirmed <= 0 || confirmed > int64(len(u.data)) {
+		return
+	}
+
+	u.data = append([]byte{}, u.data[confirmed:]...)
+	u.offset = offset
+	tsh.backlog -= int(confirmed)
+}
+
+func (tsh *TusStorageHandler) complete(u *tusUpload) {
+	tsh.mutex.Lock()
+	tsh.uploads = tsh.uploads[1:]
+	tracker := tsh.tracker
+	tsh.mutex.Unlock()
+
+	if u.failed == nil {
+		fmt.Printf("TusStorageHandler: Session %s uploaded (%d bytes)\n", u.sessionID, u.offset)
+	} else {
+		fmt.Printf("TusStorageHandler: Session %s not uploaded: %v\n", u.sessionID, u.failed)
+	}
+
+	if tracker != nil {
+		tracker.done(u.sessionID, u.failed)
+		tracker.finish(u.sessionID)
+	}
+}
+
+func (tsh *TusStorageHandler) metadata(u *tusUpload) string {
+
+	values := map[string]string{
+		"filename":      sessionFileName(tsh.recorderID, u.sessionID),
+		"recorder_id":   tsh.recorderID,
+		"session_id":    u.sessionID,
+		"sample_rate":   strconv.Itoa(tsh.format.Samplerate),
+		"channels":      strconv.Itoa(tsh.format.Channels),
+		"sample_format": tsh.format.SampleFormat,
+	}
+
+	if u.session != nil {
+		if b, err := json.Marshal(u.session); err == nil {
+			values["session"] = string(b)
+		}
+	}
+
+	pairs := []string{}
+	for k, v := range values {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (tsh *TusStorageHandler) newRequest(method, location string, body []byte) (*http.Request, *http.Client, error) {
+
+	req, err := http.NewRequest(method, location, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot create %s request: %v", method, err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	tsh.mutex.Lock()
+	client := tsh.client
+	config := tsh.config
+	tsh.mutex.Unlock()
+
+	config.authorize(req, body)
+
+	return req, client, nil
+}
+
+// create starts a new upload with deferred length and returns its url
+func (tsh *TusStorageHandler) create(u *tusUpload) (string, error) {
+
+	req, client, err := tsh.newRequest("POST", tsh.endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Upload-Defer-Length", "1")
+	req.Header.Set("Upload-Metadata", tsh.metadata(u))
+
+	response, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Cannot create upload: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Cannot create upload: %s", response.Status)
+	}
+
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || location.String() == "" {
+		return "", fmt.Errorf("Cannot create upload: Invalid location %q", response.Header.Get("Location"))
+	}
+
+	base, err := url.Parse(tsh.endpoint)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse endpoint: %v", err)
+	}
+
+	return base.ResolveReference(location).String(), nil
+}
+
+// patch sends data at offset and returns the new offset of the server.
+// length is sent if it is not negative.
+func (tsh *TusStorageHandler) patch(location string, offset int64, data []byte, length int64) (int64, error) {
+
+	req, client, err := tsh.newRequest("PATCH", location, data)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if length >= 0 {
+		req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	}
+
+	sum := sha256.Sum256(data)
+	req.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot patch upload: %v", err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNoContent:
+	case http.StatusNotFound, http.StatusGone:
+		return 0, errTusUploadGone
+	default:
+		return 0, fmt.Errorf("Cannot patch upload at %d: %s", offset, response.Status)
+	}
+
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// head asks the server for the offset of an upload
+func (tsh *TusStorageHandler) head(location string) (int64, error) {
+
+	req, client, err := tsh.newRequest("HEAD", location, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get upload offset: %v", err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return 0, errTusUploadGone
+	default:
+		return 0, fmt.Errorf("Cannot get upload offset: %s", response.Status)
+	}
+
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
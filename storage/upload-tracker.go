@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+type uploadState struct {
+	pending  int
+	failed   int
+	finished bool
+}
+
+// UploadTracker keeps track of which sessions have been uploaded completely.
+// Completed sessions are marked with a file in markerPath, so the state
+// survives restarts.
+type UploadTracker struct {
+	markerPath string
+	recorderID string
+	mutex      sync.Mutex
+	sessions   map[string]*uploadState
+}
+
+// NewUploadTracker factory
+func NewUploadTracker(markerPath, recorderID string) *UploadTracker {
+	return &UploadTracker{
+		markerPath: markerPath,
+		recorderID: recorderID,
+		sessions:   map[string]*uploadState{},
+	}
+}
+
+func (u *UploadTracker) markerFileName(sessionID string) string {
+	return path.Join(u.markerPath, fmt.Sprintf("%s_%s.uploaded", u.recorderID, sessionID))
+}
+
+func (u *UploadTracker) state(sessionID string) *uploadState {
+	s, ok := u.sessions[sessionID]
+	if !ok {
+		s = &uploadState{}
+		u.sessions[sessionID] = s
+	}
+	return s
+}
+
+// begin is called when an upload of a chunk starts
+func (u *UploadTracker) begin(sessionID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.state(sessionID).pending++
+}
+
+// done is called when an upload of a chunk has finished
+func (u *UploadTracker) done(sessionID string, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	s := u.state(sessionID)
+	s.pending--
+	if err != nil {
+		s.failed++
+	}
+	u.check(sessionID, s)
+}
+
+// finish is called when no more chunks will be uploaded for a session
+func (u *UploadTracker) finish(sessionID string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	s := u.state(sessionID)
+	s.finished = true
+	u.check(sessionID, s)
+}
+
+func (u *UploadTracker) check(sessionID string, s *uploadState) {
+
+	if !s.finished || s.pending > 0 || s.failed > 0 {
+		return
+	}
+
+	if err := os.MkdirAll(u.markerPath, 0777); err != nil {
+		fmt.Printf("Cannot create upload marker directory: %v\n", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(u.markerFileName(sessionID), []byte{}, 0666); err != nil {
+		fmt.Printf("Cannot mark session %s as uploaded: %v\n", sessionID, err)
+		return
+	}
+
+	delete(u.sessions, sessionID)
+}
+
+// IsUploaded returns true if all chunks of a session have been uploaded
+func (u *UploadTracker) IsUploaded(sessionID string) bool {
+	_, err := os.Stat(u.markerFileName(sessionID))
+	return err == nil
+}
+
+// Backlog returns the number of chunks which are pending or failed
+func (u *UploadTracker) Backlog() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ret := 0
+	for _, s := range u.sessions {
+		ret += s.pending + s.failed
+	}
+	return ret
+}
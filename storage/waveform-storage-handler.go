@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	waveformVersion    = 2
+	waveformFlags16    = 0
+	waveformHeaderSize = 24
+	// Offset of the pixel count in the header
+	waveformLengthOffset = 16
+)
+
+// waveformLevel accumulates min/max pairs for one zoom level. Pixels are
+// kept until they are appended to the file.
+type waveformLevel struct {
+	samplesPerPixel int
+	channels        int
+	count           int
+	min, max        []int16
+	pending         []int16
+	written         uint32
+	created         bool
+}
+
+func newWaveformLevel(samplesPerPixel, channels int) *waveformLevel {
+	ret := &waveformLevel{
+		samplesPerPixel: samplesPerPixel,
+		channels:        channels,
+		min:             make([]int16, channels),
+		max:             make([]int16, channels),
+	}
+	ret.reset()
+	return ret
+}
+
+func (w *waveformLevel) reset() {
+	w.count = 0
+	for c := 0; c < w.channels; c++ {
+		w.min[c] = math.MaxInt16
+		w.max[c] = math.MinInt16
+	}
+}
+
+func (w *waveformLevel) add(frame []int16) {
+	for c, v := range frame {
+		if v < w.min[c] {
+			w.min[c] = v
+		}
+		if v > w.max[c] {
+			w.max[c] = v
+		}
+	}
+
+	w.count++
+	if w.count >= w.samplesPerPixel {
+		w.pixel()
+	}
+}
+
+func (w *waveformLevel) pixel() {
+	for c := 0; c < w.channels; c++ {
+		w.pending = append(w.pending, w.min[c], w.max[c])
+	}
+	w.reset()
+}
+
+// finish turns the frames of a partial last pixel into a pixel
+func (w *waveformLevel) finish() {
+	if w.count > 0 {
+		w.pixel()
+	}
+}
+
+// WaveformStorageHandler builds min/max peak overviews of a session at
+// several zoom levels. They are written next to the session in the binary
+// format of audiowaveform (.dat, version 2), one file per zoom level.
+// Samples wider than 16 bit are reduced to their upper 16 bit.
+type WaveformStorageHandler struct {
+	storagePath   string
+	recorderID    string
+	zoomLevels    []int
+	flushInterval time.Duration
+
+	mutex     sync.Mutex
+	format    AudioFormat
+	sessionID string
+	levels    []*waveformLevel
+	remainder []byte
+	lastFlush time.Time
+}
+
+// NewWaveformStorageHandler factory. zoomLevels are given in samples per
+// pixel, new pixels are appended to the files every flushInterval while
+// recording.
+func NewWaveformStorageHandler(storagePath, recorderID string, samplerate int, zoomLevels []int, flushInterval time.Duration) *WaveformStorageHandler {
+
+	format := DefaultAudioFormat
+	format.Samplerate = samplerate
+
+	ret := &WaveformStorageHandler{
+		storagePath:   storagePath,
+		recorderID:    recorderID,
+		format:        format,
+		zoomLevels:    zoomLevels,
+		flushInterval: flushInterval,
+		lastFlush:     time.Now(),
+	}
+	ret.resetLevels()
+
+	return ret
+}
+
+// WaveformFileName returns the name of the overview file of a session at a zoom level
+func WaveformFileName(recorderID, sessionID string, samplesPerPixel int) string {
+	return fmt.Sprintf("%s_%s_%d.dat", recorderID, sessionID, samplesPerPixel)
+}
+
+func (wsh *WaveformStorageHandler) resetLevels() {
+	wsh.levels = []*waveformLevel{}
+	for _, z := range wsh.zoomLevels {
+		wsh.levels = append(wsh.levels, newWaveformLevel(z, wsh.format.Channels))
+	}
+	wsh.remainder = nil
+}
+
+func (wsh *WaveformStorageHandler) setFormat(f AudioFormat) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	wsh.format = f
+	wsh.resetLevels()
+
+	if !wsh.supported() {
+		fmt.Printf("Cannot build waveform: Unsupported sample format %s\n", f.SampleFormat)
+	}
+}
+
+// supported reports if the samples of the format are signed integers the
+// handler can decode
+func (wsh *WaveformStorageHandler) supported() bool {
+	f := wsh.format
+	return f.Channels > 0 && f.BytesPerSample >= 2 && f.BytesPerSample <= 4 && strings.HasPrefix(f.SampleFormat, "S")
+}
+
+func (wsh *WaveformStorageHandler) setSession(s *Session) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	if wsh.sessionID != "" {
+		wsh.finish()
+	}
+
+	wsh.sessionID = s.ID()
+	wsh.resetLevels()
+}
+
+func (wsh *WaveformStorageHandler) endSession() {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	if wsh.sessionID != "" {
+		wsh.finish()
+	}
+	wsh.sessionID = ""
+}
+
+func (wsh *WaveformStorageHandler) store(b []byte) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	if wsh.sessionID == "" || !wsh.supported() {
+		return
+	}
+
+	data := append(wsh.remainder, b...)
+	sampleSize := wsh.format.BytesPerSample
+	frameSize := wsh.format.BytesPerFrame()
+
+	frame := make([]int16, wsh.format.Channels)
+	n := len(data) / frameSize * frameSize
+	for i := 0; i < n; i += frameSize {
+		for c := range frame {
+			// Little endian, the upper 16 bit are the last two bytes
+			frame[c] = int16(binary.LittleEndian.Uint16(data[i+(c+1)*sampleSize-2:]))
+		}
+		for _, l := range wsh.levels {
+			l.add(frame)
+		}
+	}
+	wsh.remainder = append([]byte{}, data[n:]...)
+
+	if time.Since(wsh.lastFlush) >= wsh.flushInterval {
+		wsh.flush()
+	}
+}
+
+// finish writes the partial last pixels of the session
+func (wsh *WaveformStorageHandler) finish() {
+	for _, l := range wsh.levels {
+		l.finish()
+	}
+	wsh.flush()
+}
+
+func (wsh *WaveformStorageHandler) flush() {
+
+	wsh.lastFlush = time.Now()
+
+	if err := os.MkdirAll(wsh.storagePath, 0777); err != nil {
+		fmt.Printf("Cannot create waveform directory: %v\n", err)
+		return
+	}
+
+	for _, l := range wsh.levels {
+		if err := wsh.write(l); err != nil {
+			fmt.Printf("Cannot write waveform: %v\n", err)
+		}
+	}
+}
+
+// write appends the pending pixels of a level to its file and updates the
+// pixel count in the header afterwards, so readers never see a count
+// beyond the data
+func (wsh *WaveformStorageHandler) write(l *waveformLevel) error {
+
+	if l.created && len(l.pending) == 0 {
+		return nil
+	}
+
+	fileName := path.Join(wsh.storagePath, WaveformFileName(wsh.recorderID, wsh.sessionID, l.samplesPerPixel))
+	pixelSize := 2 * 2 * l.channels
+
+	var buf bytes.Buffer
+	if !l.created {
+		header := []interface{}{
+			int32(waveformVersion),
+			uint32(waveformFlags16),
+			int32(wsh.format.Samplerate),
+			int32(l.samplesPerPixel),
+			uint32(0),
+			int32(l.channels),
+		}
+		for _, h := range header {
+			binary.Write(&buf, binary.LittleEndian, h)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, l.pending)
+
+	flags := os.O_WRONLY
+	if !l.created {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(fileName, flags, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := int64(waveformHeaderSize + int(l.written)*pixelSize)
+	if !l.created {
+		offset = 0
+	}
+	if _, err = f.WriteAt(buf.Bytes(), offset); err != nil {
+		return err
+	}
+	l.created = true
+
+	pixels := l.written + uint32(len(l.pending)/(2*l.channels))
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, pixels)
+	if _, err = f.WriteAt(length, waveformLengthOffset); err != nil {
+		return err
+	}
+
+	l.written = pixels
+	l.pending = l.pending[:0]
+	return nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebDAVStorageHandler writes chunks or whole sessions to a WebDAV share,
+// e.g. a Nextcloud folder
+type WebDAVStorageHandler struct {
+	*remoteUploader
+	baseURL  string
+	user     string
+	password string
+	mutex    sync.Mutex
+	client   *http.Client
+	config   HTTPClientConfig
+	// created is true when the collection is known to exist
+	created bool
+}
+
+// NewWebDAVStorageHandler factory. baseURL is the collection files are written
+// into, e.g. https://cloud.example.com/remote.php/dav/files/booth/recordings.
+// With a chunkSize of 0 whole sessions are spooled and written when the session
+// ends. Spooled and failed files are kept in spoolDir/WebDAVStorageHandler.
+func NewWebDAVStorageHandler(baseURL, user, password, recorderID string, chunkSize int, spoolDir string) *WebDAVStorageHandler {
+
+	config := DefaultHTTPClientConfig()
+	client, _ := newHTTPClient(streamingConfig(config))
+
+	ret := &WebDAVStorageHandler{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		user:     user,
+		password: password,
+		client:   client,
+		config:   config,
+	}
+	ret.remoteUploader = newRemoteUploader("WebDAVStorageHandler", recorderID, chunkSize, spoolDir, ret)
+
+	return ret
+}
+
+// SetClientConfig sets up TLS, authentication and timeouts for all
+// following requests
+func (wsh *WebDAVStorageHandler) SetClientConfig(config HTTPClientConfig) error {
+
+	client, err := newHTTPClient(streamingConfig(config))
+	if err != nil {
+		return fmt.Errorf("Cannot configure webdav storage handler: %v", err)
+	}
+
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+	wsh.client = client
+	wsh.config = config
+
+	return nil
+}
+
+// streamingConfig removes the limit of the whole request from config, the
+// requests are limited by request
+func streamingConfig(config HTTPClientConfig) HTTPClientConfig {
+	config.Timeout = 0
+	return config
+}
+
+// request executes a request. Requests with a body, which may be a whole
+// session, are limited by the IdleTimeout of the config, others by its
+// Timeout.
+func (wsh *WebDAVStorageHandler) request(method, location string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, location, body)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create %s request: %v", method, err)
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if wsh.user != "" {
+		req.SetBasicAuth(wsh.user, wsh.password)
+	}
+
+	wsh.mutex.Lock()
+	client := wsh.client
+	config := wsh.config
+	wsh.mutex.Unlock()
+
+	// Bodies are streamed from the spool, so requests are not signed
+	config.HMACKey = ""
+	config.authorize(req, nil)
+
+	req, cancel := withIdleTimeout(req, config.IdleTimeout)
+	defer cancel()
+	if body == nil && config.Timeout > 0 {
+		ctx, cancelTimeout := context.WithTimeout(req.Context(), config.Timeout)
+		defer cancelTimeout()
+		req = req.WithContext(ctx)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot execute %s request: %v", method, err)
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	return response, nil
+}
+
+// mkcol creates the collection, it is fine if it exists already
+func (wsh *WebDAVStorageHandler) mkcol() error {
+
+	response, err := wsh.request("MKCOL", wsh.baseURL+"/", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		return nil
+	}
+	return fmt.Errorf("Cannot create collection: %s", response.Status)
+}
+
+func (wsh *WebDAVStorageHandler) put(name string, r io.Reader, size int64) error {
+
+	if !wsh.created {
+		if err := wsh.mkcol(); err != nil {
+			return err
+		}
+		wsh.created = true
+	}
+
+	// Write into a temporary file first, so there are never partial files
+	location := wsh.baseURL + "/" + name
+	response, err := wsh.request("PUT", location+".part", nil, r, size)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+	case http.StatusNotFound, http.StatusConflict:
+		// The collection is gone, create it with the next attempt
+		wsh.created = false
+		return fmt.Errorf("Cannot put %s: %s", name, response.Status)
+	default:
+		return fmt.Errorf("Cannot put %s: %s", name, response.Status)
+	}
+
+	header := http.Header{}
+	header.Set("Destination", location)
+	header.Set("Overwrite", "T")
+
+	response, err = wsh.request("MOVE", location+".part", header, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		return nil
+	}
+	return fmt.Errorf("Cannot move %s: %s", name, response.Status)
+}
@@ -0,0 +1,371 @@
+package storage
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pascalhuerst/recorder-booth/audio"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// webSocketDefaultInterval is the time between two level messages
+	webSocketDefaultInterval = time.Millisecond * 100
+	// webSocketMinInterval limits the rate clients may ask for
+	webSocketMinInterval = time.Millisecond * 20
+	// webSocketClientBuffer is the number of audio chunks a client may lag
+	// behind before chunks are dropped
+	webSocketClientBuffer = 32
+	// webSocketTimeout limits every write
+	webSocketTimeout = time.Second * 10
+	// webSocketFloorDB replaces -Inf for digital silence
+	webSocketFloorDB = -120
+)
+
+// WebSocket protocol
+//
+// Clients connect to the handler's path with optional query parameters:
+//
+//   interval  time between two level messages, e.g. 50ms (default 100ms)
+//   pcm       sample rate of the audio to receive, e.g. 16000 (default off)
+//   token     the api token, needed for pcm unless the page is served from
+//             one of the allowed origins
+//
+// Text messages are JSON objects with a "type". "levels" carries the latest
+// analyzer values, "format" describes the audio and is sent before the first
+// chunk. Binary messages are audio chunks: the offset of the first frame
+// since connecting as uint64 followed by interleaved pcm, all little endian.
+// A gap in the offsets means chunks were dropped for a slow client.
+
+// WebSocketLevels is the payload of level messages
+type WebSocketLevels struct {
+	Type           string     `json:"type"`
+	Time           time.Time  `json:"time"`
+	RmsDB          [2]float64 `json:"rmsDb"`
+	PeakDB         [2]float64 `json:"peakDb"`
+	ClippingFrames int        `json:"clippingFrames"`
+	ClippingEvents int        `json:"clippingEvents"`
+	ClippedSamples [2]int     `json:"clippedSamples"`
+}
+
+// WebSocketFormat is the payload of format messages
+type WebSocketFormat struct {
+	Type         string `json:"type"`
+	Samplerate   int    `json:"samplerate"`
+	Channels     int    `json:"channels"`
+	SampleFormat string `json:"sampleFormat"`
+}
+
+type webSocketClient struct {
+	interval time.Duration
+	pcm      chan []byte
+	remote   string
+	// skipped counts the frames dropped since the last chunk
+	skipped uint64
+}
+
+// WebSocketHandler streams live levels and optionally downsampled audio to
+// any number of browser clients
+type WebSocketHandler struct {
+	mutex   sync.Mutex
+	format  AudioFormat
+	levels  WebSocketLevels
+	clients map[*webSocketClient]struct{}
+	// token and allowedOrigins grant access to the audio
+	token          string
+	allowedOrigins []string
+}
+
+// NewWebSocketHandler factory. Levels are taken from the rms, headroom and
+// clipping results published on the bus.
+func NewWebSocketHandler(results *audio.Bus) *WebSocketHandler {
+
+	ret := &WebSocketHandler{
+		format:  DefaultAudioFormat,
+		levels:  WebSocketLevels{Type: "levels"},
+		clients: map[*webSocketClient]struct{}{},
+	}
+
+	sub := results.Subscribe(0, audio.TopicRms, audio.TopicHeadroom, audio.TopicClipping)
+	go ret.collect(sub)
+
+	return ret
+}
+
+// SetPCMAccess restricts the audio to clients which send token, as query
+// parameter or bearer token, or connect from one of allowedOrigins. Without
+// both nobody gets audio, levels are available to everyone.
+func (wsh *WebSocketHandler) SetPCMAccess(token string, allowedOrigins []string) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+	wsh.token = token
+	wsh.allowedOrigins = allowedOrigins
+}
+
+// pcmAllowed checks the token or the origin of a request for audio
+func (wsh *WebSocketHandler) pcmAllowed(r *http.Request) bool {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	if wsh.token != "" {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(wsh.token)) == 1 {
+			return true
+		}
+	}
+
+	origin := r.Header.Get("Origin")
+	for _, o := range wsh.allowedOrigins {
+		if origin != "" && o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Clients returns the number of connected clients
+func (wsh *WebSocketHandler) Clients() int {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+	return len(wsh.clients)
+}
+
+func toDB(v float64) float64 {
+	db := 20 * math.Log10(v)
+	if math.IsInf(db, 0) || math.IsNaN(db) || db < webSocketFloorDB {
+		return webSocketFloorDB
+	}
+	return db
+}
+
+func (wsh *WebSocketHandler) collect(sub *audio.Subscription) {
+	for r := range sub.C() {
+		wsh.mutex.Lock()
+		wsh.levels.Time = r.Time
+
+		switch v := r.Value.(type) {
+		case audio.RmsAnalyzerResult:
+			wsh.levels.RmsDB = [2]float64{toDB(v.Rms.Left), toDB(v.Rms.Right)}
+		case audio.HeadroomAnalyzerResult:
+			wsh.levels.PeakDB = [2]float64{
+				toDB(float64(math.MaxInt16-v.LastHeadroom.Left) / math.MaxInt16),
+				toDB(float64(math.MaxInt16-v.LastHeadroom.Right) / math.MaxInt16),
+			}
+			wsh.levels.ClippingFrames = v.ClippingCount
+		case audio.ClippingStatistics:
+			wsh.levels.ClippingEvents = v.Events
+			wsh.levels.ClippedSamples = v.ClippedSamples
+		}
+		wsh.mutex.Unlock()
+	}
+}
+
+func (wsh *WebSocketHandler) setFormat(f AudioFormat) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+	wsh.format = f
+}
+
+func (wsh *WebSocketHandler) store(b []byte) {
+	wsh.mutex.Lock()
+	defer wsh.mutex.Unlock()
+
+	for c := range wsh.clients {
+		if c.pcm == nil {
+			continue
+		}
+		select {
+		case c.pcm <- b:
+		default:
+			// The client sees the gap in the offsets
+			c.skipped += uint64(len(b) / wsh.format.BytesPerFrame())
+		}
+	}
+}
+
+// downsampler averages factor frames into one, which is a cheap low pass.
+// Output frame k is the average of the input frames k*factor up to
+// (k+1)*factor, so the offsets stay exact across skipped frames.
+type downsampler struct {
+	factor   int
+	channels int
+	sum      []int32
+	n        int
+	// frames is the number of input frames passed, including skipped ones
+	frames uint64
+	// discard is the number of frames up to the start of the next output
+	// frame after a gap
+	discard int
+}
+
+// skip advances the position by frames which were not processed. The
+// output frame they interrupted is dropped.
+func (d *downsampler) skip(frames uint64) {
+	if frames == 0 {
+		return
+	}
+	for c := range d.sum {
+		d.sum[c] = 0
+	}
+	d.n = 0
+	d.frames += frames
+	d.discard = int((uint64(d.factor) - d.frames%uint64(d.factor)) % uint64(d.factor))
+}
+
+func (d *downsampler) process(pcm []byte) []byte {
+
+	frameSize := d.channels * 2
+	ret := make([]byte, 8, 8+len(pcm)/d.factor+frameSize)
+	offset := (d.frames - uint64(d.n) + uint64(d.discard)) / uint64(d.factor)
+	binary.LittleEndian.PutUint64(ret, offset)
+
+	for i := 0; i+frameSize <= len(pcm); i += frameSize {
+		d.frames++
+		if d.discard > 0 {
+			d.discard--
+			continue
+		}
+		for c := 0; c < d.channels; c++ {
+			d.sum[c] += int32(int16(binary.LittleEndian.Uint16(pcm[i+c*2:])))
+		}
+		d.n++
+		if d.n < d.factor {
+			continue
+		}
+		for c := 0; c < d.channels; c++ {
+			v := uint16(int16(d.sum[c] / int32(d.factor)))
+			ret = append(ret, byte(v), byte(v>>8))
+			d.sum[c] = 0
+		}
+		d.n = 0
+	}
+	return ret
+}
+
+func (wsh *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Dashboards may be served from anywhere, so the origin is only checked
+	// for audio
+	websocket.Server{Handler: wsh.serve}.ServeHTTP(w, r)
+}
+
+func (wsh *WebSocketHandler) serve(ws *websocket.Conn) {
+
+	query := ws.Request().URL.Query()
+
+	c := &webSocketClient{
+		interval: webSocketDefaultInterval,
+		remote:   ws.Request().RemoteAddr,
+	}
+	if v, err := time.ParseDuration(query.Get("interval")); err == nil {
+		c.interval = v
+		if c.interval < webSocketMinInterval {
+			c.interval = webSocketMinInterval
+		}
+	}
+
+	wsh.mutex.Lock()
+	format := wsh.format
+	wsh.mutex.Unlock()
+
+	var d *downsampler
+	if rate, err := strconv.Atoi(query.Get("pcm")); err == nil && rate > 0 {
+		if !wsh.pcmAllowed(ws.Request()) {
+			websocket.Message.Send(ws, `{"type":"error","message":"Unauthorized"}`)
+			return
+		}
+		if format.BytesPerSample != 2 {
+			websocket.Message.Send(ws, fmt.Sprintf(`{"type":"error","message":"Unsupported sample format %s"}`, format.SampleFormat))
+			return
+		}
+		factor := int(math.Round(float64(format.Samplerate) / float64(rate)))
+		if factor < 1 {
+			factor = 1
+		}
+		d = &downsampler{factor: factor, channels: format.Channels, sum: make([]int32, format.Channels)}
+		c.pcm = make(chan []byte, webSocketClientBuffer)
+
+		msg, _ := json.Marshal(WebSocketFormat{
+			Type:         "format",
+			Samplerate:   format.Samplerate / factor,
+			Channels:     format.Channels,
+			SampleFormat: "S16_LE",
+		})
+		if err := websocket.Message.Send(ws, string(msg)); err != nil {
+			return
+		}
+	}
+
+	wsh.mutex.Lock()
+	wsh.clients[c] = struct{}{}
+	wsh.mutex.Unlock()
+
+	defer func() {
+		wsh.mutex.Lock()
+		delete(wsh.clients, c)
+		wsh.mutex.Unlock()
+	}()
+
+	fmt.Printf("WebSocket: %s connected\n", c.remote)
+
+	// Messages from clients are ignored, reading detects the close
+	done := make(chan struct{})
+	go func() {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+		close(done)
+	}()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	var lastSent time.Time
+
+	for {
+		var err error
+
+		select {
+		case <-done:
+			fmt.Printf("WebSocket: %s disconnected\n", c.remote)
+			return
+
+		case <-ticker.C:
+			wsh.mutex.Lock()
+			levels := wsh.levels
+			wsh.mutex.Unlock()
+
+			if levels.Time.Equal(lastSent) {
+				continue
+			}
+			lastSent = levels.Time
+
+			msg, _ := json.Marshal(levels)
+			ws.SetWriteDeadline(time.Now().Add(webSocketTimeout))
+			err = websocket.Message.Send(ws, string(msg))
+
+		case b := <-c.pcm:
+			wsh.mutex.Lock()
+			d.skip(c.skipped)
+			c.skipped = 0
+			wsh.mutex.Unlock()
+
+			ws.SetWriteDeadline(time.Now().Add(webSocketTimeout))
+			err = websocket.Message.Send(ws, d.process(b))
+		}
+
+		if err != nil {
+			fmt.Printf("WebSocket: %s disconnected: %v\n", c.remote, err)
+			return
+		}
+	}
+}
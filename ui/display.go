@@ -33,6 +33,7 @@ type alignement int
 const (
 	alignLeft = alignement(iota)
 	alignCenter
+	alignRight
 )
 
 func (d *Display) clear() {
@@ -74,6 +75,9 @@ func (d *Display) drawTextAt(x, y int, text string, isBig bool, align alignement
 	case alignCenter:
 		adv := drawer.MeasureString(text)
 		drawer.Dot.X -= adv / 2
+	case alignRight:
+		adv := drawer.MeasureString(text)
+		drawer.Dot.X -= adv
 	}
 
 	b, _ := drawer.BoundString(text)
@@ -81,6 +85,14 @@ func (d *Display) drawTextAt(x, y int, text string, isBig bool, align alignement
 	drawer.DrawString(text)
 }
 
+func (d *Display) clearArea(x1, y1, x2, y2 int) {
+	draw.Draw(d.target, image.Rect(x1, y1, x2, y2), d.bg, image.ZP, draw.Src)
+}
+
+func (d *Display) fillArea(x1, y1, x2, y2 int) {
+	draw.Draw(d.target, image.Rect(x1, y1, x2, y2), d.fg, image.ZP, draw.Src)
+}
+
 func (d *Display) drawHorizontalLine(x1, x2, y int) {
 	draw.Draw(d.target, image.Rect(x1, y, x2, y+1), d.fg, image.ZP, draw.Src)
 }
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"math"
 )
 
 // Mode sets the display mode dot/bar
@@ -41,23 +42,49 @@ func (l *LedLevelMeter) Set(v int) error {
 	}
 
 	if l.mode == ModeBar {
-		for i := 0; i < l.segmentCount; i++ {
-			if m, ok := l.mappings[i]; ok {
-				if m.Controller == nil {
-					return fmt.Errorf("Cannot conrol led. No controller set for %d", i)
-				}
-
-				if i > v != m.Invert {
-					m.Controller.Set(m.GPIOIndex, true)
-					continue
-				}
-				m.Controller.Set(m.GPIOIndex, false)
-			} else {
-				return fmt.Errorf("No mapping found for value: %d which is needed to set %d", i, v)
-			}
-		}
+		return l.apply(func(i int) bool { return i <= v })
+	}
+
+	return l.apply(func(i int) bool { return i == v })
+}
+
+// SetCentered shows a needle around the center of the meter. v ranges from
+// -1 to 1, at 0 the two center segments are lit.
+func (l *LedLevelMeter) SetCentered(v float64) error {
+
+	if v < -1 || v > 1 {
+		return fmt.Errorf("Cannot set level meter: Out of range %v", v)
+	}
+
+	center := float64(l.segmentCount-1) / 2
+	pos := center + v*center
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+
+	if math.Abs(pos-center) < 0.5 {
+		lower = int(math.Floor(center))
+		upper = int(math.Ceil(center))
+	} else if pos < center {
+		upper = lower
 	} else {
-		return fmt.Errorf("Dot mode not implemented")
+		lower = upper
+	}
+
+	return l.apply(func(i int) bool { return i == lower || i == upper })
+}
+
+func (l *LedLevelMeter) apply(isOn func(int) bool) error {
+	for i := 0; i < l.segmentCount; i++ {
+		m, ok := l.mappings[i]
+		if !ok {
+			return fmt.Errorf("No mapping found for segment: %d", i)
+		}
+		if m.Controller == nil {
+			return fmt.Errorf("Cannot conrol led. No controller set for %d", i)
+		}
+
+		// The leds are active low
+		m.Controller.Set(m.GPIOIndex, !isOn(i) != m.Invert)
 	}
 
 	return nil
@@ -13,6 +13,10 @@ type RecordStatusScreen struct {
 	title    string
 	duration time.Duration
 	level    float32
+	alert    string
+	gain     string
+	clipping int
+	storage  string
 }
 
 // SetLevel is used to set the level
@@ -38,6 +42,38 @@ func (s *RecordStatusScreen) SetDuration(duration time.Duration) {
 	s.duration = duration
 }
 
+// SetAlert is used to show an alert message, an empty string clears it
+func (s *RecordStatusScreen) SetAlert(alert string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alert = alert
+}
+
+// SetGain is used to show the gain applied by the AGC
+func (s *RecordStatusScreen) SetGain(gainDB float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gain = fmt.Sprintf("%+.1fdB", gainDB)
+}
+
+// SetClipping is used to show the number of clipping events of the session
+func (s *RecordStatusScreen) SetClipping(events int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clipping = events
+}
+
+// SetStorage is used to show how much local storage is left
+func (s *RecordStatusScreen) SetStorage(free, total int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if total <= 0 {
+		s.storage = ""
+		return
+	}
+	s.storage = fmt.Sprintf("%d%% free", free*100/total)
+}
+
 func fmtDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	h := d / time.Hour
@@ -79,13 +115,33 @@ func (s *RecordStatusScreen) init() {
 
 func (s *RecordStatusScreen) refresh() {
 
-	y := 32
+	fontHeightBig := s.d.textFaceBig.Metrics().Height.Ceil()
 	fontHeightSmall := s.d.textFaceSmall.Metrics().Height.Ceil()
+
+	if s.storage != "" {
+		s.d.clearArea(s.d.width/2, fontHeightBig-fontHeightSmall, s.d.width, fontHeightBig+1)
+		s.d.drawTextAt(s.d.width-1, fontHeightBig, s.storage, false, alignRight)
+	}
+
+	y := 32
 	s.d.drawProgressBar(y, 120, 6, float32(s.level))
 
 	y += 12 + fontHeightSmall
 
 	s.d.drawTextAt(4, y, fmt.Sprintf("%s", fmtDuration(s.duration)), false, alignLeft)
+	if s.gain != "" {
+		s.d.clearArea(s.d.width/2, y-fontHeightSmall, s.d.width, y+2)
+		s.d.drawTextAt(s.d.width-4, y, s.gain, false, alignRight)
+	}
+
+	y += 2 + fontHeightSmall
+	s.d.clearArea(0, y-fontHeightSmall, s.d.width, y+2)
+	if s.alert != "" {
+		s.d.drawTextAt(4, y, s.alert, false, alignLeft)
+	}
+	if s.clipping > 0 {
+		s.d.drawTextAt(s.d.width-4, y, fmt.Sprintf("clip %d", s.clipping), false, alignRight)
+	}
 
 }
 
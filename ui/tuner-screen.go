@@ -0,0 +1,109 @@
+package ui
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TunerScreen shows the detected note and how far it is off
+type TunerScreen struct {
+	d       *Display
+	mutex   sync.Mutex
+	visible bool
+	valid   bool
+	note    string
+	cents   float64
+	freq    float64
+}
+
+// SetPitch is used to set the detected pitch
+func (s *TunerScreen) SetPitch(note string, cents, frequency float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.valid = true
+	s.note = note
+	s.cents = cents
+	s.freq = frequency
+}
+
+// ClearPitch is used when no pitch could be detected
+func (s *TunerScreen) ClearPitch() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.valid = false
+}
+
+// Show starts drawing the tuner onto the display
+func (s *TunerScreen) Show() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.visible {
+		s.d.clear()
+	}
+	s.visible = true
+}
+
+// Hide stops drawing, so the display can be used by something else
+func (s *TunerScreen) Hide() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.visible = false
+}
+
+// IsVisible returns true if the tuner is shown
+func (s *TunerScreen) IsVisible() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.visible
+}
+
+func (s *TunerScreen) update() {
+	for {
+		s.mutex.Lock()
+		if s.visible {
+			s.refresh()
+		}
+		s.mutex.Unlock()
+		time.Sleep(time.Millisecond * 40)
+	}
+}
+
+func (s *TunerScreen) refresh() {
+
+	fontHeightBig := s.d.textFaceBig.Metrics().Height.Ceil()
+	fontHeightSmall := s.d.textFaceSmall.Metrics().Height.Ceil()
+
+	s.d.clear()
+
+	y := fontHeightBig + 2
+	if !s.valid {
+		s.d.drawTextAt(s.d.width/2, y, "-", true, alignCenter)
+		return
+	}
+
+	s.d.drawTextAt(s.d.width/2, y, s.note, true, alignCenter)
+	y += 6
+
+	// Scale from -50 to +50 cents with a tick in the center
+	center := s.d.width / 2
+	halfWidth := s.d.width/2 - 4
+	s.d.drawHorizontalLine(4, s.d.width-4, y+4)
+	s.d.fillArea(center, y, center+1, y+9)
+
+	x := center + int(s.cents/50*float64(halfWidth))
+	s.d.fillArea(x-1, y+1, x+2, y+8)
+	y += 12 + fontHeightSmall
+
+	s.d.drawTextAt(4, y, fmt.Sprintf("%+.0f ct", s.cents), false, alignLeft)
+	s.d.drawTextAt(s.d.width-4, y, fmt.Sprintf("%.1f Hz", s.freq), false, alignRight)
+}
+
+// NewTunerScreen factory. The screen is hidden until Show is called.
+func NewTunerScreen(d *Display) *TunerScreen {
+	ret := &TunerScreen{
+		d: d,
+	}
+	go ret.update()
+	return ret
+}